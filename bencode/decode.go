@@ -1,20 +1,37 @@
 package bencode
 
 import (
-	"bufio"
 	"fmt"
 	"io"
 	"reflect"
-	"strconv"
 	"strings"
 )
 
+// Decoder decodes values from the tokens of a Reader
 type Decoder struct {
-	r *bufio.Reader
+	r *Reader
+}
+
+// RawMessage is a raw encoded bencode value. Decoding into a RawMessage keeps
+// the exact bytes of the value as they appeared in the input, which is needed
+// e.g. to hash the info dictionary of a torrent.
+type RawMessage []byte
+
+var rawMessageType = reflect.TypeOf(RawMessage(nil))
+
+// Unmarshaler is implemented by types that can decode a bencoded
+// representation of themselves. The input is a single complete value.
+type Unmarshaler interface {
+	UnmarshalBencode([]byte) error
 }
 
 func NewDecoder(r io.Reader) *Decoder {
-	return &Decoder{r: bufio.NewReader(r)}
+	return &Decoder{r: NewReader(r)}
+}
+
+// NewDecoderWithOptions returns a Decoder enforcing opts, see Options
+func NewDecoderWithOptions(r io.Reader, opts Options) *Decoder {
+	return &Decoder{r: NewReaderWithOptions(r, opts)}
 }
 
 func (d *Decoder) Decode(v interface{}) error {
@@ -22,11 +39,50 @@ func (d *Decoder) Decode(v interface{}) error {
 	if val.Kind() != reflect.Ptr || val.IsNil() {
 		return fmt.Errorf("bencode: Decode requires a non-nil pointer")
 	}
-	return d.bdecode(val.Elem())
+	if err := d.bdecode(val.Elem()); err != nil {
+		return err
+	}
+	if d.r.opts.Strict {
+		_, err := d.r.peekByte()
+		if err == nil {
+			return &CanonicalError{Offset: d.r.Offset(), Msg: "trailing data"}
+		}
+		if err != io.EOF {
+			return err
+		}
+	}
+	return nil
+}
+
+// InputOffset returns the number of input bytes consumed so far, which is
+// where data following a decoded value starts
+func (d *Decoder) InputOffset() int64 {
+	return d.r.Offset()
 }
 
 func (d *Decoder) bdecode(v reflect.Value) error {
-	next, err := d.r.Peek(1)
+	if v.Type() == rawMessageType {
+		return d.decodeRaw(v)
+	}
+
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.bdecode(v.Elem())
+	}
+
+	if v.CanAddr() {
+		if u, ok := v.Addr().Interface().(Unmarshaler); ok {
+			raw, err := d.r.ReadValue()
+			if err != nil {
+				return err
+			}
+			return u.UnmarshalBencode(raw)
+		}
+	}
+
+	tok, err := d.r.Next()
 	if err != nil {
 		return err
 	}
@@ -36,19 +92,14 @@ func (d *Decoder) bdecode(v reflect.Value) error {
 		v.Set(reflect.New(reflect.TypeOf((*interface{})(nil)).Elem()).Elem())
 	}
 
-	switch next[0] {
-	case 'i':
+	switch tok.Kind {
+	case IntToken:
 		if v.Kind() == reflect.Interface {
-			var i int64
-			err := d.decodeInt(reflect.ValueOf(&i).Elem())
-			if err != nil {
-				return err
-			}
-			v.Set(reflect.ValueOf(i))
+			v.Set(reflect.ValueOf(tok.Int))
 		} else {
-			return d.decodeInt(v)
+			return d.decodeInt(tok, v)
 		}
-	case 'l':
+	case ListStartToken:
 		if v.Kind() == reflect.Interface {
 			var slice []interface{}
 			sliceValue := reflect.ValueOf(&slice).Elem()
@@ -60,7 +111,7 @@ func (d *Decoder) bdecode(v reflect.Value) error {
 		} else {
 			return d.decodeList(v)
 		}
-	case 'd':
+	case DictStartToken:
 		if v.Kind() == reflect.Interface {
 			m := make(map[string]interface{})
 			mapValue := reflect.ValueOf(m)
@@ -72,31 +123,20 @@ func (d *Decoder) bdecode(v reflect.Value) error {
 		} else {
 			return d.decodeDict(v)
 		}
-	default:
+	case StringToken:
 		if v.Kind() == reflect.Interface {
-			var s string
-			err := d.decodeString(reflect.ValueOf(&s).Elem())
-			if err != nil {
-				return err
-			}
-			v.Set(reflect.ValueOf(s))
+			v.Set(reflect.ValueOf(string(tok.Bytes)))
 		} else {
-			return d.decodeString(v)
+			return d.decodeString(tok, v)
 		}
+	default:
+		return &SyntaxError{Offset: tok.Offset, Msg: fmt.Sprintf("unexpected %v", tok.Kind)}
 	}
 	return nil
 }
 
-func (d *Decoder) decodeInt(v reflect.Value) error {
-	d.r.Discard(1) // Consume 'i'
-	numStr, err := d.readUntil('e')
-	if err != nil {
-		return err
-	}
-	num, err := strconv.ParseInt(string(numStr), 10, 64)
-	if err != nil {
-		return err
-	}
+func (d *Decoder) decodeInt(tok Token, v reflect.Value) error {
+	num := tok.Int
 	switch v.Kind() {
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 		if v.OverflowInt(num) {
@@ -117,20 +157,8 @@ func (d *Decoder) decodeInt(v reflect.Value) error {
 	return nil
 }
 
-func (d *Decoder) decodeString(v reflect.Value) error {
-	lenStr, err := d.readUntil(':')
-	if err != nil {
-		return err
-	}
-	length, err := strconv.Atoi(string(lenStr))
-	if err != nil {
-		return err
-	}
-	data := make([]byte, length)
-	_, err = io.ReadFull(d.r, data)
-	if err != nil {
-		return err
-	}
+func (d *Decoder) decodeString(tok Token, v reflect.Value) error {
+	data := tok.Bytes
 	switch v.Kind() {
 	case reflect.String:
 		v.SetString(string(data))
@@ -140,6 +168,14 @@ func (d *Decoder) decodeString(v reflect.Value) error {
 		} else {
 			return fmt.Errorf("bencode: cannot bdecode string into %v", v.Type())
 		}
+	case reflect.Array:
+		if v.Type().Elem().Kind() != reflect.Uint8 {
+			return fmt.Errorf("bencode: cannot bdecode string into %v", v.Type())
+		}
+		if v.Len() != len(data) {
+			return fmt.Errorf("bencode: cannot bdecode string of length %d into %v", len(data), v.Type())
+		}
+		reflect.Copy(v, reflect.ValueOf(data))
 	default:
 		return fmt.Errorf("bencode: cannot bdecode string into %v", v.Type())
 	}
@@ -147,21 +183,15 @@ func (d *Decoder) decodeString(v reflect.Value) error {
 }
 
 func (d *Decoder) decodeList(v reflect.Value) error {
-	d.r.Discard(1) // Consume 'l'
-
 	if v.Kind() != reflect.Slice {
 		v.Set(reflect.MakeSlice(reflect.SliceOf(reflect.TypeOf((*interface{})(nil)).Elem()), 0, 0))
 	}
 
 	for {
-		next, err := d.r.Peek(1)
-		if err != nil {
+		done, err := d.atEnd()
+		if err != nil || done {
 			return err
 		}
-		if next[0] == 'e' {
-			d.r.Discard(1)
-			return nil
-		}
 
 		var elem reflect.Value
 		if v.Type().Elem().Kind() == reflect.Interface {
@@ -181,7 +211,6 @@ func (d *Decoder) decodeList(v reflect.Value) error {
 }
 
 func (d *Decoder) decodeDict(v reflect.Value) error {
-	d.r.Discard(1) // Consume 'd'
 	switch v.Kind() {
 	case reflect.Map:
 		return d.decodeDictToMap(v)
@@ -197,16 +226,15 @@ func (d *Decoder) decodeDictToMap(v reflect.Value) error {
 		v.Set(reflect.MakeMap(v.Type()))
 	}
 	for {
-		next, err := d.r.Peek(1)
+		tok, err := d.r.Next()
 		if err != nil {
 			return err
 		}
-		if next[0] == 'e' {
-			d.r.Discard(1)
+		if tok.Kind == EndToken {
 			return nil
 		}
 		key := reflect.New(v.Type().Key()).Elem()
-		if err := d.decodeString(key); err != nil {
+		if err := d.decodeString(tok, key); err != nil {
 			return err
 		}
 		elem := reflect.New(v.Type().Elem()).Elem()
@@ -245,23 +273,17 @@ func (d *Decoder) decodeDictToStruct(v reflect.Value) error {
 	}
 
 	for {
-		next, err := d.r.Peek(1)
+		tok, err := d.r.Next()
 		if err != nil {
 			return err
 		}
-		if next[0] == 'e' {
-			d.r.Discard(1)
+		if tok.Kind == EndToken {
 			return nil
 		}
 
-		var keyStr string
-		if err := d.decodeString(reflect.ValueOf(&keyStr).Elem()); err != nil {
-			return err
-		}
-
-		fieldValue, ok := fieldMap[keyStr]
+		fieldValue, ok := fieldMap[string(tok.Bytes)]
 		if !ok {
-			if err := d.skipValue(); err != nil {
+			if err := d.r.Skip(); err != nil {
 				return err
 			}
 			continue
@@ -273,68 +295,24 @@ func (d *Decoder) decodeDictToStruct(v reflect.Value) error {
 	}
 }
 
-func (d *Decoder) readUntil(delim byte) ([]byte, error) {
-	data, err := d.r.ReadBytes(delim)
+func (d *Decoder) decodeRaw(v reflect.Value) error {
+	raw, err := d.r.ReadValue()
 	if err != nil {
-		return nil, err
-	}
-	if len(data) > 0 && data[len(data)-1] == delim {
-		return data[:len(data)-1], nil
+		return err
 	}
-	return data, nil
+	v.SetBytes(raw)
+	return nil
 }
 
-func (d *Decoder) skipValue() error {
-	next, err := d.r.Peek(1)
+// atEnd consumes the end of a list if it is the next token
+func (d *Decoder) atEnd() (bool, error) {
+	kind, err := d.r.PeekKind()
 	if err != nil {
-		return err
+		return false, err
 	}
-	switch next[0] {
-	case 'i':
-		_, err = d.readUntil('e')
-	case 'l':
-		d.r.Discard(1)
-		for {
-			next, err := d.r.Peek(1)
-			if err != nil {
-				return err
-			}
-			if next[0] == 'e' {
-				d.r.Discard(1)
-				return nil
-			}
-			if err := d.skipValue(); err != nil {
-				return err
-			}
-		}
-	case 'd':
-		d.r.Discard(1)
-		for {
-			next, err := d.r.Peek(1)
-			if err != nil {
-				return err
-			}
-			if next[0] == 'e' {
-				d.r.Discard(1)
-				return nil
-			}
-			if err := d.skipValue(); err != nil { // Skip key
-				return err
-			}
-			if err := d.skipValue(); err != nil { // Skip value
-				return err
-			}
-		}
-	default:
-		lengthStr, err := d.readUntil(':')
-		if err != nil {
-			return err
-		}
-		length, err := strconv.Atoi(string(lengthStr))
-		if err != nil {
-			return err
-		}
-		_, err = io.CopyN(io.Discard, d.r, int64(length))
+	if kind != EndToken {
+		return false, nil
 	}
-	return err
+	_, err = d.r.Next()
+	return true, err
 }
@@ -2,7 +2,9 @@ package bencode
 
 import (
 	"bytes"
+	"errors"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -271,3 +273,165 @@ func TestDecodeDictToStruct(t *testing.T) {
 		})
 	}
 }
+
+func TestDecodeRawMessage(t *testing.T) {
+	type TestStruct struct {
+		Name string     `bencode:"name"`
+		Info RawMessage `bencode:"info"`
+	}
+
+	tests := []struct {
+		name     string
+		input    string
+		expected TestStruct
+	}{
+		{
+			name:     "Raw dict with unknown keys",
+			input:    "d4:infod6:lengthi10e7:privatei1e6:source3:abce4:name4:teste",
+			expected: TestStruct{Name: "test", Info: RawMessage("d6:lengthi10e7:privatei1e6:source3:abce")},
+		},
+		{
+			name:     "Raw nested list",
+			input:    "d4:infoli1el2:abee4:name1:xe",
+			expected: TestStruct{Name: "x", Info: RawMessage("li1el2:abee")},
+		},
+		{
+			name:     "Raw string",
+			input:    "d4:info5:hello4:name1:ye",
+			expected: TestStruct{Name: "y", Info: RawMessage("5:hello")},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decoder := NewDecoder(bytes.NewReader([]byte(tt.input)))
+
+			var result TestStruct
+			if err := decoder.Decode(&result); err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("Expected %+v, got %+v", tt.expected, result)
+			}
+		})
+	}
+}
+
+// upperString decodes any bencoded string and stores it upper-cased
+type upperString string
+
+func (u *upperString) UnmarshalBencode(data []byte) error {
+	var s string
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&s); err != nil {
+		return err
+	}
+	*u = upperString(strings.ToUpper(s))
+	return nil
+}
+
+func TestDecodeUnmarshaler(t *testing.T) {
+	type TestStruct struct {
+		Value   upperString            `bencode:"value"`
+		Pointer *upperString           `bencode:"pointer"`
+		List    []upperString          `bencode:"list"`
+		Map     map[string]upperString `bencode:"map"`
+		Hash    [4]byte                `bencode:"hash"`
+	}
+
+	input := "d4:hash4:abcd4:listl1:a1:be3:mapd1:k1:ve7:pointer3:ptr5:value3:vale"
+	pointer := upperString("PTR")
+	expected := TestStruct{
+		Value:   "VAL",
+		Pointer: &pointer,
+		List:    []upperString{"A", "B"},
+		Map:     map[string]upperString{"k": "V"},
+		Hash:    [4]byte{'a', 'b', 'c', 'd'},
+	}
+
+	var result TestStruct
+	if err := NewDecoder(bytes.NewReader([]byte(input))).Decode(&result); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, result)
+	}
+}
+
+func TestDecodeStrict(t *testing.T) {
+	tests := []struct {
+		input   string
+		wantErr bool
+		offset  int64
+	}{
+		{"d1:ai1e1:bi2ee", false, 0},
+		{"i0e", false, 0},
+		{"i-3e", false, 0},
+		{"i03e", true, 0},
+		{"i-0e", true, 0},
+		{"li1e02:abe", true, 4},
+		{"d1:bi1e1:ai2ee", true, 7},
+		{"d1:ai1e1:ai2ee", true, 7},
+		{"d1:xd1:bi1e1:ai2eee", true, 11},
+		{"i1ei2e", true, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			decoder := NewDecoderWithOptions(bytes.NewReader([]byte(tt.input)), Options{Strict: true})
+
+			var result interface{}
+			err := decoder.Decode(&result)
+			if !tt.wantErr {
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				return
+			}
+
+			var canonicalErr *CanonicalError
+			if !errors.As(err, &canonicalErr) {
+				t.Fatalf("Expected a CanonicalError, got %v", err)
+			}
+			if canonicalErr.Offset != tt.offset {
+				t.Errorf("Expected offset %d, got %d", tt.offset, canonicalErr.Offset)
+			}
+		})
+	}
+}
+
+func TestDecodeLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		opts   Options
+		limit  string
+		offset int64
+	}{
+		{"String length", "l3:abc99999999999:xe", Options{MaxStringLen: 10}, "string length", 6},
+		{"Depth", "llllee", Options{MaxDepth: 3}, "depth", 3},
+		{"Total bytes", "l5:hello5:worlde", Options{MaxBytes: 10}, "total bytes", 8},
+		// every prefix and delimiter counts, not only the digits
+		{"Small integers", "l" + strings.Repeat("i1e", 100) + "e", Options{MaxBytes: 100}, "total bytes", 100},
+		{"Empty lists", "l" + strings.Repeat("le", 100) + "e", Options{MaxBytes: 100}, "total bytes", 100},
+		{"Closing end", "li1ee", Options{MaxBytes: 4}, "total bytes", 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decoder := NewDecoderWithOptions(bytes.NewReader([]byte(tt.input)), tt.opts)
+
+			var result interface{}
+			err := decoder.Decode(&result)
+
+			var limitErr *LimitError
+			if !errors.As(err, &limitErr) {
+				t.Fatalf("Expected a LimitError, got %v", err)
+			}
+			if limitErr.Limit != tt.limit || limitErr.Offset != tt.offset {
+				t.Errorf("Expected %s limit at offset %d, got %s at %d", tt.limit, tt.offset, limitErr.Limit, limitErr.Offset)
+			}
+		})
+	}
+}
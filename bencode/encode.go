@@ -6,10 +6,17 @@ import (
 	"io"
 	"reflect"
 	"sort"
-	"strconv"
 	"strings"
 )
 
+// Marshaler is implemented by types that can encode themselves into a
+// valid bencoded value.
+type Marshaler interface {
+	MarshalBencode() ([]byte, error)
+}
+
+var marshalerType = reflect.TypeOf((*Marshaler)(nil)).Elem()
+
 type Encoder struct {
 	w io.Writer
 }
@@ -22,70 +29,78 @@ func NewEncoder(w io.Writer) *Encoder {
 func (e *Encoder) Encode(v interface{}) error {
 	buf := &bytes.Buffer{}
 
-	if err := e.bencode(buf, reflect.ValueOf(v)); err != nil {
+	if err := e.bencode(NewWriter(buf), reflect.ValueOf(v)); err != nil {
 		return err
 	}
 	_, err := buf.WriteTo(e.w)
 	return err
 }
 
-func (e *Encoder) bencode(buf *bytes.Buffer, v reflect.Value) error {
+func (e *Encoder) bencode(w *Writer, v reflect.Value) error {
+	if v.IsValid() && v.Type() == rawMessageType {
+		if v.Len() == 0 {
+			return fmt.Errorf("cannot encode empty RawMessage")
+		}
+		return w.WriteRaw(v.Bytes())
+	}
+
+	if m, ok := marshaler(v); ok {
+		data, err := m.MarshalBencode()
+		if err != nil {
+			return err
+		}
+		if len(data) == 0 {
+			return fmt.Errorf("MarshalBencode of %v returned no data", v.Type())
+		}
+		return w.WriteRaw(data)
+	}
+
 	switch v.Kind() {
 	case reflect.String:
-		e.encodeString(buf, v.String())
+		return w.WriteString(v.String())
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		e.encodeInt(buf, v.Int())
+		return w.WriteInt(v.Int())
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		e.encodeUint(buf, v.Uint())
+		return w.WriteUint(v.Uint())
 	case reflect.Array, reflect.Slice:
-		return e.encodeList(buf, v)
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return e.encodeBytes(w, v)
+		}
+		return e.encodeList(w, v)
 	case reflect.Map:
-		return e.encodeDict(buf, v)
+		return e.encodeDict(w, v)
 	case reflect.Struct:
-		return e.encodeStruct(buf, v)
+		return e.encodeStruct(w, v)
 	case reflect.Interface, reflect.Ptr:
 		if v.IsNil() {
 			return fmt.Errorf("cannot encode nil value")
 		}
-		return e.bencode(buf, v.Elem())
+		return e.bencode(w, v.Elem())
 	default:
 		return fmt.Errorf("incompatible type: %T", v.Type())
 	}
-	return nil
-}
-
-func (e *Encoder) encodeString(buf *bytes.Buffer, s string) {
-	buf.WriteString(strconv.Itoa(len(s)))
-	buf.WriteByte(':')
-	buf.WriteString(s)
-}
-
-func (e *Encoder) encodeInt(buf *bytes.Buffer, i int64) {
-	buf.WriteByte('i')
-	buf.WriteString(strconv.FormatInt(i, 10))
-	buf.WriteByte('e')
 }
 
-func (e *Encoder) encodeUint(buf *bytes.Buffer, u uint64) {
-	buf.WriteByte('i')
-	buf.WriteString(strconv.FormatUint(u, 10))
-	buf.WriteByte('e')
+// encodeBytes writes byte slices and arrays as strings
+func (e *Encoder) encodeBytes(w *Writer, v reflect.Value) error {
+	data := make([]byte, v.Len())
+	reflect.Copy(reflect.ValueOf(data), v)
+	return w.WriteBytes(data)
 }
 
-func (e *Encoder) encodeList(buf *bytes.Buffer, v reflect.Value) error {
-	buf.WriteByte('l')
+func (e *Encoder) encodeList(w *Writer, v reflect.Value) error {
+	w.StartList()
 	for i := 0; i < v.Len(); i++ {
-		if err := e.bencode(buf, v.Index(i)); err != nil {
+		if err := e.bencode(w, v.Index(i)); err != nil {
 			return err
 		}
 	}
-	buf.WriteByte('e')
-	return nil
+	return w.End()
 }
 
-func (e *Encoder) encodeDict(buf *bytes.Buffer, v reflect.Value) error {
+func (e *Encoder) encodeDict(w *Writer, v reflect.Value) error {
 
-	buf.WriteByte('d')
+	w.StartDict()
 	keys := v.MapKeys()
 
 	sort.Slice(keys, func(i, j int) bool {
@@ -93,26 +108,30 @@ func (e *Encoder) encodeDict(buf *bytes.Buffer, v reflect.Value) error {
 	})
 
 	for _, key := range keys {
-		e.encodeString(buf, key.String())
-		if err := e.bencode(buf, v.MapIndex(key)); err != nil {
+		w.WriteString(key.String())
+		if err := e.bencode(w, v.MapIndex(key)); err != nil {
 			return err
 		}
 	}
-	buf.WriteByte('e')
-	return nil
+	return w.End()
 }
 
-func (e *Encoder) encodeStruct(buf *bytes.Buffer, v reflect.Value) error {
-	buf.WriteByte('d')
+func (e *Encoder) encodeStruct(w *Writer, v reflect.Value) error {
+	type field struct {
+		key   string
+		value reflect.Value
+	}
+	var fields []field
+
 	t := v.Type()
 	for i := 0; i < v.NumField(); i++ {
-		field := t.Field(i)
-		if field.PkgPath != "" {
+		f := t.Field(i)
+		if f.PkgPath != "" {
 			continue
 		}
 		fieldValue := v.Field(i)
-		key := field.Name
-		tag := field.Tag.Get("bencode")
+		key := f.Name
+		tag := f.Tag.Get("bencode")
 		if tag != "" {
 			if tag == "-" {
 				continue
@@ -125,13 +144,43 @@ func (e *Encoder) encodeStruct(buf *bytes.Buffer, v reflect.Value) error {
 				}
 			}
 		}
-		e.encodeString(buf, key)
-		if err := e.bencode(buf, fieldValue); err != nil {
+		fields = append(fields, field{key, fieldValue})
+	}
+
+	// dict keys must be sorted, whatever the order of the struct fields
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].key < fields[j].key
+	})
+
+	w.StartDict()
+	for _, f := range fields {
+		w.WriteString(f.key)
+		if err := e.bencode(w, f.value); err != nil {
 			return err
 		}
 	}
-	buf.WriteByte('e')
-	return nil
+	return w.End()
+}
+
+// marshaler returns the Marshaler implemented by v, either with a value or
+// a pointer receiver
+func marshaler(v reflect.Value) (Marshaler, bool) {
+	if !v.IsValid() || (v.Kind() == reflect.Ptr && v.IsNil()) || !v.CanInterface() {
+		return nil, false
+	}
+	if m, ok := v.Interface().(Marshaler); ok {
+		return m, true
+	}
+	if v.Kind() == reflect.Ptr || !reflect.PointerTo(v.Type()).Implements(marshalerType) {
+		return nil, false
+	}
+	if !v.CanAddr() {
+		// map values are not addressable, so a copy is needed for pointer receivers
+		ptr := reflect.New(v.Type())
+		ptr.Elem().Set(v)
+		v = ptr.Elem()
+	}
+	return v.Addr().Interface().(Marshaler), true
 }
 
 func isEmptyValue(v reflect.Value) bool {
@@ -148,6 +197,10 @@ func isEmptyValue(v reflect.Value) bool {
 		return v.Float() == 0
 	case reflect.Interface, reflect.Ptr:
 		return v.IsNil()
+	case reflect.Struct:
+		if z, ok := v.Interface().(interface{ IsZero() bool }); ok {
+			return z.IsZero()
+		}
 	}
 	return false
 }
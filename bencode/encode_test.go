@@ -2,9 +2,19 @@ package bencode
 
 import (
 	"bytes"
+	"strconv"
 	"testing"
 )
 
+// point encodes itself as a list of its coordinates
+type point struct {
+	X, Y int
+}
+
+func (p *point) MarshalBencode() ([]byte, error) {
+	return []byte("li" + strconv.Itoa(p.X) + "ei" + strconv.Itoa(p.Y) + "ee"), nil
+}
+
 func TestEncoder_Encode(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -63,6 +73,41 @@ func TestEncoder_Encode(t *testing.T) {
 			},
 			want: "d8:announcel4:http3:udpe6:lengthi2412e4:name4:teste",
 		},
+		{
+			name: "Encode Struct With Unsorted Fields",
+			data: struct {
+				Name   string   `bencode:"name"`
+				Length int      `bencode:"length"`
+				Files  []string `bencode:"files,omitempty"`
+			}{
+				Name:   "test",
+				Length: 1,
+			},
+			want: "d6:lengthi1e4:name4:teste",
+		},
+		{
+			name: "Encode RawMessage",
+			data: map[string]interface{}{"info": RawMessage("d6:lengthi1e7:privatei1ee")},
+			want: "d4:infod6:lengthi1e7:privatei1eee",
+		},
+		{
+			name: "Encode Marshaler In Map And List",
+			data: map[string]interface{}{
+				"p":    point{1, 2},
+				"list": []point{{3, 4}},
+			},
+			want: "d4:listlli3ei4eee1:pli1ei2eee",
+		},
+		{
+			name: "Encode Byte Slice And Array",
+			data: map[string]interface{}{"a": []byte("abc"), "b": [2]byte{'x', 'y'}},
+			want: "d1:a3:abc1:b2:xye",
+		},
+		{
+			name:    "Encode Empty RawMessage",
+			data:    RawMessage{},
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -0,0 +1,451 @@
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+type TokenKind int
+
+const (
+	IntToken TokenKind = iota
+	StringToken
+	ListStartToken
+	DictStartToken
+	EndToken
+)
+
+const (
+	// maxNumberLen bounds the digits of an integer or a string length,
+	// an int64 has at most 19 digits plus the sign
+	maxNumberLen = 20
+	// strings longer than this are read incrementally, so a bogus length
+	// can't allocate more memory than the input really holds
+	readChunk = 1 << 16
+)
+
+func (k TokenKind) String() string {
+	switch k {
+	case IntToken:
+		return "int"
+	case StringToken:
+		return "string"
+	case ListStartToken:
+		return "list start"
+	case DictStartToken:
+		return "dict start"
+	case EndToken:
+		return "end"
+	default:
+		return "unknown token"
+	}
+}
+
+// Token is a single element of a bencoded document. Lists and dicts are
+// reported as a start token followed by their elements and an EndToken.
+type Token struct {
+	Kind   TokenKind
+	Offset int64  // byte offset of the first byte of the token
+	Int    int64  // value of an IntToken
+	Bytes  []byte // value of a StringToken
+}
+
+// SyntaxError reports malformed input and the offset where it was detected
+type SyntaxError struct {
+	Offset int64
+	Msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("bencode: %s at offset %d", e.Msg, e.Offset)
+}
+
+// CanonicalError reports input that is valid bencode but not in the
+// canonical form required in strict mode
+type CanonicalError struct {
+	Offset int64
+	Msg    string
+}
+
+func (e *CanonicalError) Error() string {
+	return fmt.Sprintf("bencode: non-canonical input, %s at offset %d", e.Msg, e.Offset)
+}
+
+// LimitError reports input exceeding one of the limits set in Options
+type LimitError struct {
+	Offset int64
+	Limit  string
+	Max    int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("bencode: %s limit of %d exceeded at offset %d", e.Limit, e.Max, e.Offset)
+}
+
+// Options restricts the input accepted by a Reader or a Decoder, which is
+// needed for anything received from the network. Zero limits are unbounded.
+type Options struct {
+	// Strict rejects leading zeros, negative zero, unsorted or duplicate
+	// dict keys and, for a Decoder, trailing data after the value
+	Strict       bool
+	MaxStringLen int64
+	MaxDepth     int
+	MaxBytes     int64
+}
+
+// frame is an open list or dict
+type frame struct {
+	dict      bool
+	expectKey bool
+	lastKey   []byte // only kept in strict mode
+	hasKey    bool
+}
+
+// Reader is a pull parser returning one Token at a time, so documents can be
+// walked without materializing them
+type Reader struct {
+	r       *bufio.Reader
+	offset  int64
+	stack   []frame
+	capture *bytes.Buffer // receives every consumed byte while set
+	opts    Options
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+func NewReaderWithOptions(r io.Reader, opts Options) *Reader {
+	return &Reader{r: bufio.NewReader(r), opts: opts}
+}
+
+// Offset returns the number of bytes consumed so far
+func (r *Reader) Offset() int64 {
+	return r.offset
+}
+
+// Depth returns the number of lists and dicts currently open
+func (r *Reader) Depth() int {
+	return len(r.stack)
+}
+
+// Next reads the next token. It returns io.EOF only when the input ends
+// between two top level values.
+func (r *Reader) Next() (Token, error) {
+	return r.next(false)
+}
+
+// PeekKind returns the kind of the next token without consuming it
+func (r *Reader) PeekKind() (TokenKind, error) {
+	c, err := r.peekByte()
+	if err != nil {
+		if err == io.EOF && len(r.stack) > 0 {
+			return 0, r.syntaxError(r.offset, "unexpected end of input")
+		}
+		return 0, err
+	}
+	switch {
+	case c == 'i':
+		return IntToken, nil
+	case c == 'l':
+		return ListStartToken, nil
+	case c == 'd':
+		return DictStartToken, nil
+	case c == 'e':
+		return EndToken, nil
+	case c >= '0' && c <= '9':
+		return StringToken, nil
+	default:
+		return 0, r.syntaxError(r.offset, fmt.Sprintf("invalid character %q", c))
+	}
+}
+
+// Skip consumes the next complete value
+func (r *Reader) Skip() error {
+	depth := 0
+	for {
+		tok, err := r.next(true)
+		if err != nil {
+			return err
+		}
+		switch tok.Kind {
+		case ListStartToken, DictStartToken:
+			depth++
+		case EndToken:
+			if depth == 0 {
+				return r.syntaxError(tok.Offset, "expected a value, found end")
+			}
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+// ReadValue consumes the next complete value and returns its raw bytes
+func (r *Reader) ReadValue() ([]byte, error) {
+	var buf bytes.Buffer
+	r.capture = &buf
+	defer func() { r.capture = nil }()
+	if err := r.Skip(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// next reads a token, when discard is set string contents are not kept
+func (r *Reader) next(discard bool) (Token, error) {
+	offset := r.offset
+	c, err := r.peekByte()
+	if err != nil {
+		if err == io.EOF && len(r.stack) > 0 {
+			return Token{}, r.syntaxError(offset, "unexpected end of input")
+		}
+		return Token{}, err
+	}
+
+	top := len(r.stack) - 1
+	isKey := top >= 0 && r.stack[top].dict && r.stack[top].expectKey
+	if isKey && c != 'e' && (c < '0' || c > '9') {
+		return Token{}, r.syntaxError(offset, "dict key must be a string")
+	}
+
+	tok := Token{Offset: offset}
+	switch {
+	case c == 'i':
+		if _, err := r.readByte(); err != nil {
+			return Token{}, err
+		}
+		num, err := r.readNumber('e')
+		if err != nil {
+			return Token{}, err
+		}
+		tok.Kind = IntToken
+		tok.Int, err = strconv.ParseInt(string(num), 10, 64)
+		// ParseInt accepts a plus sign, bencode doesn't
+		if err != nil || num[0] == '+' {
+			return Token{}, r.syntaxError(offset, fmt.Sprintf("invalid integer %q", num))
+		}
+		if err := r.checkCanonicalInt(offset, num); err != nil {
+			return Token{}, err
+		}
+	case c == 'l' || c == 'd':
+		if r.opts.MaxDepth > 0 && len(r.stack) >= r.opts.MaxDepth {
+			return Token{}, &LimitError{Offset: offset, Limit: "depth", Max: int64(r.opts.MaxDepth)}
+		}
+		if _, err := r.readByte(); err != nil {
+			return Token{}, err
+		}
+		tok.Kind = ListStartToken
+		if c == 'd' {
+			tok.Kind = DictStartToken
+		}
+		r.stack = append(r.stack, frame{dict: c == 'd', expectKey: true})
+		// the value is complete once the matching end is read
+		return tok, nil
+	case c == 'e':
+		if top < 0 {
+			return Token{}, r.syntaxError(offset, "unexpected end")
+		}
+		if r.stack[top].dict && !r.stack[top].expectKey {
+			return Token{}, r.syntaxError(offset, "missing value for dict key")
+		}
+		if _, err := r.readByte(); err != nil {
+			return Token{}, err
+		}
+		r.stack = r.stack[:top]
+		tok.Kind = EndToken
+	case c >= '0' && c <= '9':
+		num, err := r.readNumber(':')
+		if err != nil {
+			return Token{}, err
+		}
+		length, err := strconv.ParseInt(string(num), 10, 64)
+		if err != nil {
+			return Token{}, r.syntaxError(offset, fmt.Sprintf("invalid string length %q", num))
+		}
+		if r.opts.Strict && len(num) > 1 && num[0] == '0' {
+			return Token{}, &CanonicalError{Offset: offset, Msg: "string length with leading zero"}
+		}
+		if r.opts.MaxStringLen > 0 && length > r.opts.MaxStringLen {
+			return Token{}, &LimitError{Offset: offset, Limit: "string length", Max: r.opts.MaxStringLen}
+		}
+		if r.opts.MaxBytes > 0 && r.offset+length > r.opts.MaxBytes {
+			return Token{}, &LimitError{Offset: offset, Limit: "total bytes", Max: r.opts.MaxBytes}
+		}
+		tok.Kind = StringToken
+		// keys are needed to check their order even when skipping
+		if discard && !(isKey && r.opts.Strict) {
+			err = r.discard(length)
+		} else {
+			tok.Bytes, err = r.readFull(length)
+		}
+		if err != nil {
+			return Token{}, err
+		}
+		if isKey && r.opts.Strict {
+			if err := r.checkKeyOrder(offset, tok.Bytes); err != nil {
+				return Token{}, err
+			}
+		}
+	default:
+		return Token{}, r.syntaxError(offset, fmt.Sprintf("invalid character %q", c))
+	}
+
+	r.valueDone()
+	return tok, nil
+}
+
+// valueDone flips the key/value expectation of the enclosing dict
+func (r *Reader) valueDone() {
+	if top := len(r.stack) - 1; top >= 0 && r.stack[top].dict {
+		r.stack[top].expectKey = !r.stack[top].expectKey
+	}
+}
+
+func (r *Reader) checkCanonicalInt(offset int64, num []byte) error {
+	if !r.opts.Strict {
+		return nil
+	}
+	digits := num
+	if len(digits) > 0 && digits[0] == '-' {
+		digits = digits[1:]
+		if len(digits) > 0 && digits[0] == '0' {
+			return &CanonicalError{Offset: offset, Msg: "negative zero or leading zero"}
+		}
+	}
+	if len(digits) == 0 || digits[0] < '0' || digits[0] > '9' {
+		return &CanonicalError{Offset: offset, Msg: "integer must start with a digit"}
+	}
+	if len(digits) > 1 && digits[0] == '0' {
+		return &CanonicalError{Offset: offset, Msg: "integer with leading zero"}
+	}
+	return nil
+}
+
+func (r *Reader) checkKeyOrder(offset int64, key []byte) error {
+	f := &r.stack[len(r.stack)-1]
+	if f.hasKey {
+		switch cmp := bytes.Compare(key, f.lastKey); {
+		case cmp == 0:
+			return &CanonicalError{Offset: offset, Msg: fmt.Sprintf("duplicate dict key %q", key)}
+		case cmp < 0:
+			return &CanonicalError{Offset: offset, Msg: fmt.Sprintf("dict key %q out of order", key)}
+		}
+	}
+	f.lastKey = key
+	f.hasKey = true
+	return nil
+}
+
+// checkBytes fails if reading n more bytes would exceed MaxBytes
+func (r *Reader) checkBytes(n int64) error {
+	if r.opts.MaxBytes > 0 && r.offset+n > r.opts.MaxBytes {
+		return &LimitError{Offset: r.offset, Limit: "total bytes", Max: r.opts.MaxBytes}
+	}
+	return nil
+}
+
+func (r *Reader) peekByte() (byte, error) {
+	b, err := r.r.Peek(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// readByte consumes a single byte, every byte but the contents of strings
+// is read here and counts towards MaxBytes
+func (r *Reader) readByte() (byte, error) {
+	if err := r.checkBytes(1); err != nil {
+		return 0, err
+	}
+	c, err := r.r.ReadByte()
+	if err != nil {
+		return 0, r.eofError(err)
+	}
+	r.consumed([]byte{c})
+	return c, nil
+}
+
+// readNumber reads the digits of a number up to and excluding delim
+func (r *Reader) readNumber(delim byte) ([]byte, error) {
+	start := r.offset
+	var num []byte
+	for {
+		c, err := r.readByte()
+		if err != nil {
+			return nil, err
+		}
+		if c == delim {
+			return num, nil
+		}
+		if len(num) == maxNumberLen {
+			return nil, r.syntaxError(start, "number too long")
+		}
+		num = append(num, c)
+	}
+}
+
+func (r *Reader) readFull(n int64) ([]byte, error) {
+	if n > readChunk {
+		var buf bytes.Buffer
+		read, err := io.CopyN(&buf, r.r, n)
+		r.consumed(buf.Bytes()[:read])
+		if err != nil {
+			return nil, r.eofError(err)
+		}
+		return buf.Bytes(), nil
+	}
+	data := make([]byte, n)
+	read, err := io.ReadFull(r.r, data)
+	r.consumed(data[:read])
+	if err != nil {
+		return nil, r.eofError(err)
+	}
+	return data, nil
+}
+
+func (r *Reader) discard(n int64) error {
+	if r.capture != nil {
+		read, err := io.CopyN(r.capture, r.r, n)
+		r.offset += read
+		return r.eofError(err)
+	}
+	for n > 0 {
+		chunk := n
+		if chunk > int64(r.r.Size()) {
+			chunk = int64(r.r.Size())
+		}
+		read, err := r.r.Discard(int(chunk))
+		r.offset += int64(read)
+		if err != nil {
+			return r.eofError(err)
+		}
+		n -= int64(read)
+	}
+	return nil
+}
+
+func (r *Reader) consumed(data []byte) {
+	r.offset += int64(len(data))
+	if r.capture != nil {
+		r.capture.Write(data)
+	}
+}
+
+// eofError turns an EOF inside a value into a syntax error
+func (r *Reader) eofError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return r.syntaxError(r.offset, "unexpected end of input")
+	}
+	return err
+}
+
+func (r *Reader) syntaxError(offset int64, msg string) error {
+	return &SyntaxError{Offset: offset, Msg: msg}
+}
@@ -0,0 +1,144 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReaderNext(t *testing.T) {
+	input := "d4:listli1e2:abe3:numi-7ee"
+	expected := []Token{
+		{Kind: DictStartToken, Offset: 0},
+		{Kind: StringToken, Offset: 1, Bytes: []byte("list")},
+		{Kind: ListStartToken, Offset: 7},
+		{Kind: IntToken, Offset: 8, Int: 1},
+		{Kind: StringToken, Offset: 11, Bytes: []byte("ab")},
+		{Kind: EndToken, Offset: 15},
+		{Kind: StringToken, Offset: 16, Bytes: []byte("num")},
+		{Kind: IntToken, Offset: 21, Int: -7},
+		{Kind: EndToken, Offset: 25},
+	}
+
+	r := NewReader(bytes.NewReader([]byte(input)))
+	var tokens []Token
+	for {
+		tok, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		tokens = append(tokens, tok)
+	}
+
+	if !reflect.DeepEqual(tokens, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, tokens)
+	}
+}
+
+func TestReaderSyntaxErrors(t *testing.T) {
+	tests := []struct {
+		input  string
+		offset int64
+	}{
+		{"di1ei2ee", 1},
+		{"d1:ae", 4},
+		{"li1e", 4},
+		{"e", 0},
+		{"5:abc", 5},
+		{"x", 0},
+		{"iabce", 0},
+		{"i+5e", 0},
+		{"li+0ee", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			r := NewReader(bytes.NewReader([]byte(tt.input)))
+			var err error
+			for err == nil {
+				_, err = r.Next()
+			}
+
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("Expected a SyntaxError, got %v", err)
+			}
+			if syntaxErr.Offset != tt.offset {
+				t.Errorf("Expected offset %d, got %d", tt.offset, syntaxErr.Offset)
+			}
+		})
+	}
+}
+
+func TestReaderReadValue(t *testing.T) {
+	r := NewReader(bytes.NewReader([]byte("ld1:ai1ee3:xyze")))
+	if _, err := r.Next(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	raw, err := r.ReadValue()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if string(raw) != "d1:ai1ee" {
+		t.Errorf("Expected d1:ai1ee, got %s", raw)
+	}
+
+	if err := r.Skip(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if r.Offset() != 14 {
+		t.Errorf("Expected offset 14, got %d", r.Offset())
+	}
+}
+
+func TestWriterCopiesTokens(t *testing.T) {
+	input := "d4:infod6:lengthi10e4:name1:xe4:listli-1e0:ee"
+
+	r := NewReader(bytes.NewReader([]byte(input)))
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	for {
+		tok, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if err := w.WriteToken(tok); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	if buf.String() != input {
+		t.Errorf("Expected %s, got %s", input, buf.String())
+	}
+	if err := w.End(); err == nil {
+		t.Errorf("Expected an error for End without an open container")
+	}
+}
+
+func TestReaderMaxBytes(t *testing.T) {
+	input := "l" + strings.Repeat("i1e", 100) + "1:ae"
+	for _, max := range []int64{int64(len(input)), int64(len(input)) - 1} {
+		r := NewReaderWithOptions(bytes.NewReader([]byte(input)), Options{MaxBytes: max})
+		err := r.Skip()
+		if max == int64(len(input)) {
+			if err != nil {
+				t.Errorf("Skip() error = %v with a limit of the input length", err)
+			}
+			continue
+		}
+		var limitErr *LimitError
+		if !errors.As(err, &limitErr) {
+			t.Errorf("Skip() error = %v with a limit of %d bytes, want a LimitError", err, max)
+		}
+	}
+}
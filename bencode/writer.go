@@ -0,0 +1,105 @@
+package bencode
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Writer writes a bencoded document one token at a time. It is the
+// counterpart of Reader and does no buffering of its own.
+type Writer struct {
+	w     io.Writer
+	depth int
+	num   []byte
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+func (w *Writer) WriteInt(i int64) error {
+	w.num = append(w.num[:0], 'i')
+	w.num = strconv.AppendInt(w.num, i, 10)
+	w.num = append(w.num, 'e')
+	_, err := w.w.Write(w.num)
+	return err
+}
+
+func (w *Writer) WriteUint(u uint64) error {
+	w.num = append(w.num[:0], 'i')
+	w.num = strconv.AppendUint(w.num, u, 10)
+	w.num = append(w.num, 'e')
+	_, err := w.w.Write(w.num)
+	return err
+}
+
+func (w *Writer) WriteString(s string) error {
+	if err := w.writeLength(len(s)); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w.w, s)
+	return err
+}
+
+func (w *Writer) WriteBytes(b []byte) error {
+	if err := w.writeLength(len(b)); err != nil {
+		return err
+	}
+	_, err := w.w.Write(b)
+	return err
+}
+
+// WriteRaw writes an already encoded value as is
+func (w *Writer) WriteRaw(b []byte) error {
+	_, err := w.w.Write(b)
+	return err
+}
+
+func (w *Writer) StartList() error {
+	w.depth++
+	_, err := w.w.Write([]byte{'l'})
+	return err
+}
+
+func (w *Writer) StartDict() error {
+	w.depth++
+	_, err := w.w.Write([]byte{'d'})
+	return err
+}
+
+// End closes the innermost open list or dict
+func (w *Writer) End() error {
+	if w.depth == 0 {
+		return fmt.Errorf("bencode: End without an open list or dict")
+	}
+	w.depth--
+	_, err := w.w.Write([]byte{'e'})
+	return err
+}
+
+// WriteToken writes a token as returned by Reader.Next, so documents can be
+// copied or filtered as a stream
+func (w *Writer) WriteToken(tok Token) error {
+	switch tok.Kind {
+	case IntToken:
+		return w.WriteInt(tok.Int)
+	case StringToken:
+		return w.WriteBytes(tok.Bytes)
+	case ListStartToken:
+		return w.StartList()
+	case DictStartToken:
+		return w.StartDict()
+	case EndToken:
+		return w.End()
+	default:
+		return fmt.Errorf("bencode: cannot write %v", tok.Kind)
+	}
+}
+
+func (w *Writer) writeLength(n int) error {
+	w.num = strconv.AppendInt(w.num[:0], int64(n), 10)
+	w.num = append(w.num, ':')
+	_, err := w.w.Write(w.num)
+	return err
+}
@@ -3,6 +3,11 @@ package bitfield
 // A Bitfield represents the pieces that a peer has
 type Bitfield []byte
 
+// New returns an empty bitfield for numPieces pieces
+func New(numPieces int) Bitfield {
+	return make(Bitfield, (numPieces+7)/8)
+}
+
 // pieceNo = 9 => byteIdx = 9 / 8 = 1 and  offset = 1
 // mask = 00000010 => mask = byte(1 <<7 - 1)
 // bf = 11111111.11111111
@@ -34,3 +39,13 @@ func (bf Bitfield) SetPiece(pieceNo int) {
 	bf[byteIdx] = bf[byteIdx] | mask
 
 }
+
+func (bf Bitfield) ClearPiece(pieceNo int) {
+	byteIdx := pieceNo / 8
+	bitOffset := pieceNo % 8
+	mask := byte(1 << (7 - bitOffset))
+	if byteIdx < 0 || byteIdx >= len(bf) {
+		return
+	}
+	bf[byteIdx] = bf[byteIdx] &^ mask
+}
@@ -0,0 +1,161 @@
+package choker
+
+import (
+	"math/rand"
+	"sort"
+	"swiftpeer/client/peerconn"
+	"sync"
+	"time"
+)
+
+const (
+	// Interval is how often peers are rechoked
+	Interval = 10 * time.Second
+	// optimisticRounds is the number of rechokes the optimistic unchoke
+	// lasts, 30 seconds
+	optimisticRounds = 3
+	// DefaultSlots is the number of peers unchoked for their rate
+	DefaultSlots = 4
+	// newPeerAge and newPeerWeight make recently connected peers more
+	// likely to be unchoked optimistically, they have nothing to offer yet
+	newPeerAge    = time.Minute
+	newPeerWeight = 3
+)
+
+// Choker implements tit-for-tat: the interested peers giving us the best
+// download rate are unchoked, or when seeding those we upload to the fastest,
+// and one more peer is unchoked at random to discover better ones.
+type Choker struct {
+	slots int
+
+	mu         sync.Mutex
+	round      int
+	optimistic *peerconn.PeerConn
+	unchoked   map[*peerconn.PeerConn]struct{} // regular slots
+	last       map[*peerconn.PeerConn]peerconn.Stats
+	lastTime   time.Time
+}
+
+func New(slots int) *Choker {
+	return &Choker{
+		slots:    slots,
+		unchoked: make(map[*peerconn.PeerConn]struct{}),
+		last:     make(map[*peerconn.PeerConn]peerconn.Stats),
+		lastTime: time.Now(),
+	}
+}
+
+// Admit unchokes an interested peer right away when a regular slot is free,
+// rather than making it wait for the next rechoke
+func (c *Choker) Admit(pc *peerconn.PeerConn) error {
+	c.mu.Lock()
+	_, unchoked := c.unchoked[pc]
+	if unchoked || pc == c.optimistic || len(c.unchoked) >= c.slots {
+		c.mu.Unlock()
+		return nil
+	}
+	c.unchoked[pc] = struct{}{}
+	c.mu.Unlock()
+	return pc.SendUnchoke()
+}
+
+// Forget releases the slot of a closed connection
+func (c *Choker) Forget(pc *peerconn.PeerConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.unchoked, pc)
+	delete(c.last, pc)
+	if c.optimistic == pc {
+		c.optimistic = nil
+	}
+}
+
+// Rechoke ranks the connected peers and sends chokes and unchokes where
+// their state changes. Peers are ranked by the rate they send to us, or by
+// the rate we send to them when seeding.
+func (c *Choker) Rechoke(conns []*peerconn.PeerConn, seeding bool) {
+	c.mu.Lock()
+	elapsed := time.Since(c.lastTime).Seconds()
+	c.lastTime = time.Now()
+
+	rates := make(map[*peerconn.PeerConn]float64, len(conns))
+	var interested []*peerconn.PeerConn
+	for _, pc := range conns {
+		stats := pc.Stats()
+		prev := c.last[pc]
+		c.last[pc] = stats
+		if seeding {
+			rates[pc] = float64(stats.Uploaded-prev.Uploaded) / elapsed
+		} else {
+			rates[pc] = float64(stats.Downloaded-prev.Downloaded) / elapsed
+		}
+		if pc.PeerInterested() {
+			interested = append(interested, pc)
+		}
+	}
+
+	// shuffle first so that peers with equal rates take turns
+	rand.Shuffle(len(interested), func(i, j int) {
+		interested[i], interested[j] = interested[j], interested[i]
+	})
+	sort.SliceStable(interested, func(i, j int) bool {
+		return rates[interested[i]] > rates[interested[j]]
+	})
+
+	c.unchoked = make(map[*peerconn.PeerConn]struct{}, c.slots)
+	for _, pc := range interested {
+		if len(c.unchoked) == c.slots {
+			break
+		}
+		c.unchoked[pc] = struct{}{}
+	}
+
+	c.round++
+	if c.optimistic == nil || c.round%optimisticRounds == 0 || !c.optimistic.PeerInterested() {
+		c.optimistic = c.pickOptimistic(interested)
+	}
+	if _, ok := c.unchoked[c.optimistic]; ok {
+		// the optimistic peer earned a regular slot
+		c.optimistic = c.pickOptimistic(interested)
+	}
+
+	unchoke := make(map[*peerconn.PeerConn]bool, len(conns))
+	for pc := range c.unchoked {
+		unchoke[pc] = true
+	}
+	if c.optimistic != nil {
+		unchoke[c.optimistic] = true
+	}
+	c.mu.Unlock()
+
+	for _, pc := range conns {
+		switch {
+		case unchoke[pc] && pc.AmChoking():
+			pc.SendUnchoke()
+		case !unchoke[pc] && !pc.AmChoking():
+			pc.SendChoke()
+		}
+	}
+}
+
+// pickOptimistic chooses an interested peer without a regular slot at random,
+// new connections having a higher chance
+func (c *Choker) pickOptimistic(interested []*peerconn.PeerConn) *peerconn.PeerConn {
+	var candidates []*peerconn.PeerConn
+	for _, pc := range interested {
+		if _, ok := c.unchoked[pc]; ok {
+			continue
+		}
+		weight := 1
+		if time.Since(pc.ConnectedAt) < newPeerAge {
+			weight = newPeerWeight
+		}
+		for i := 0; i < weight; i++ {
+			candidates = append(candidates, pc)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	return candidates[rand.Intn(len(candidates))]
+}
@@ -0,0 +1,163 @@
+package choker
+
+import (
+	"io"
+	"net"
+	"swiftpeer/client/handshake"
+	"swiftpeer/client/peerconn"
+	"testing"
+	"time"
+)
+
+// newPeer returns a connection to a peer that reads and ignores everything
+// we send
+func newPeer(t *testing.T) *peerconn.PeerConn {
+	local, remote := net.Pipe()
+	go io.Copy(io.Discard, remote)
+	pc, err := peerconn.Accept(local, &handshake.Handshake{}, nil, nil)
+	if err != nil {
+		t.Fatalf("Accept() error = %v", err)
+	}
+	t.Cleanup(func() {
+		pc.Close()
+		remote.Close()
+	})
+	return pc
+}
+
+func TestRechoke(t *testing.T) {
+	tests := []struct {
+		name         string
+		downloaded   []int
+		uploaded     []int
+		interested   []bool
+		seeding      bool
+		wantUnchoked []int
+	}{
+		{
+			name:         "Fastest uploaders to us",
+			downloaded:   []int{100, 500, 300, 0, 200},
+			uploaded:     []int{0, 0, 0, 900, 0},
+			interested:   []bool{true, true, true, true, true},
+			wantUnchoked: []int{1, 2},
+		},
+		{
+			name:         "Fastest downloaders from us when seeding",
+			downloaded:   []int{100, 500, 300, 0, 200},
+			uploaded:     []int{0, 10, 0, 900, 400},
+			interested:   []bool{true, true, true, true, true},
+			seeding:      true,
+			wantUnchoked: []int{3, 4},
+		},
+		{
+			name:         "Only interested peers",
+			downloaded:   []int{100, 500, 300, 0, 200},
+			uploaded:     []int{0, 0, 0, 0, 0},
+			interested:   []bool{true, false, true, false, false},
+			wantUnchoked: []int{0, 2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(2)
+			conns := make([]*peerconn.PeerConn, len(tt.downloaded))
+			for i := range conns {
+				pc := newPeer(t)
+				pc.BlockReceived(0, 0, tt.downloaded[i])
+				if tt.uploaded[i] > 0 {
+					pc.SendPiece(0, 0, make([]byte, tt.uploaded[i]))
+				}
+				pc.SetPeerInterested(tt.interested[i])
+				conns[i] = pc
+			}
+
+			c.Rechoke(conns, tt.seeding)
+
+			if len(c.unchoked) != len(tt.wantUnchoked) {
+				t.Fatalf("%d peers unchoked for their rate, want %d", len(c.unchoked), len(tt.wantUnchoked))
+			}
+			for _, i := range tt.wantUnchoked {
+				if _, ok := c.unchoked[conns[i]]; !ok {
+					t.Errorf("peer %d not unchoked for its rate", i)
+				}
+			}
+			if c.optimistic != nil {
+				if _, ok := c.unchoked[c.optimistic]; ok {
+					t.Errorf("the optimistic unchoke took a regular slot")
+				}
+				if !c.optimistic.PeerInterested() {
+					t.Errorf("the optimistic unchoke went to an uninterested peer")
+				}
+			}
+			for i, pc := range conns {
+				_, regular := c.unchoked[pc]
+				if want := !regular && pc != c.optimistic; pc.AmChoking() != want {
+					t.Errorf("peer %d choked = %v, want %v", i, pc.AmChoking(), want)
+				}
+			}
+		})
+	}
+}
+
+func TestOptimisticRotation(t *testing.T) {
+	c := New(1)
+	conns := make([]*peerconn.PeerConn, 4)
+	for i := range conns {
+		conns[i] = newPeer(t)
+		conns[i].SetPeerInterested(true)
+	}
+
+	changed := false
+	var prev *peerconn.PeerConn
+	for round := 1; round <= 60; round++ {
+		// the first peer keeps the regular slot
+		conns[0].BlockReceived(0, 0, 1000)
+		c.Rechoke(conns, false)
+		if c.optimistic == nil || c.optimistic == conns[0] {
+			t.Fatalf("round %d: optimistic unchoke = %v", round, c.optimistic)
+		}
+		if prev != nil && c.optimistic != prev {
+			if round%optimisticRounds != 0 {
+				t.Fatalf("round %d: the optimistic unchoke changed before %d rounds", round, optimisticRounds)
+			}
+			changed = true
+		}
+		prev = c.optimistic
+	}
+	if !changed {
+		t.Errorf("the optimistic unchoke never rotated")
+	}
+
+	// a peer losing interest gives up the optimistic unchoke right away
+	prev.SetPeerInterested(false)
+	c.Rechoke(conns, false)
+	if c.optimistic == prev {
+		t.Errorf("the optimistic unchoke stayed with an uninterested peer")
+	}
+}
+
+func TestPickOptimistic(t *testing.T) {
+	c := New(1)
+	regular, old, recent := newPeer(t), newPeer(t), newPeer(t)
+	old.ConnectedAt = time.Now().Add(-2 * newPeerAge)
+	c.unchoked[regular] = struct{}{}
+
+	if got := c.pickOptimistic([]*peerconn.PeerConn{regular}); got != nil {
+		t.Errorf("pickOptimistic() = %v with every peer unchoked, want nil", got)
+	}
+
+	const picks = 4000
+	count := make(map[*peerconn.PeerConn]int)
+	for i := 0; i < picks; i++ {
+		count[c.pickOptimistic([]*peerconn.PeerConn{regular, old, recent})]++
+	}
+	if count[regular] != 0 {
+		t.Errorf("pickOptimistic() picked a peer holding a regular slot")
+	}
+	// recent peers are newPeerWeight times as likely, 3/4 of the picks
+	share := float64(count[recent]) / picks
+	if want := float64(newPeerWeight) / (newPeerWeight + 1); share < want-0.05 || share > want+0.05 {
+		t.Errorf("recent peer picked %.2f of the time, want about %.2f", share, want)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"swiftpeer/client/torrent/metadata"
+)
+
+// listFlag collects every occurrence of a repeatable flag
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func runCreate(args []string) error {
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	var trackers, webSeeds listFlag
+	fs.Var(&trackers, "a", "Announce tier, comma separated tracker urls (repeat for more tiers)")
+	fs.Var(&webSeeds, "w", "Web seed url (repeatable)")
+	outPath := fs.String("o", "", "Path of the torrent file to write")
+	pieceLength := fs.Int("l", 0, "Piece length in bytes, chosen from the total size by default")
+	comment := fs.String("c", "", "Comment")
+	createdBy := fs.String("b", "swiftpeer", "Created by")
+	private := fs.Bool("p", false, "Set the private flag")
+	source := fs.String("s", "", "Source tag")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 || *outPath == "" {
+		return fmt.Errorf("usage: program create -o <torrent-file> [-a <trackers>] [-w <web-seed>] [-l <piece-length>] [-c <comment>] [-p] [-s <source>] <path>")
+	}
+
+	b := &metadata.Builder{
+		Path:        fs.Arg(0),
+		PieceLength: *pieceLength,
+		Comment:     *comment,
+		CreatedBy:   *createdBy,
+		Private:     *private,
+		Source:      *source,
+		WebSeeds:    webSeeds,
+	}
+	for _, tier := range trackers {
+		b.AnnounceList = append(b.AnnounceList, strings.Split(tier, ","))
+	}
+
+	md, err := b.Build()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(*outPath)
+	if err != nil {
+		return err
+	}
+	if err := md.Write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Created %s, info hash %x\n", *outPath, md.InfoHash)
+	return nil
+}
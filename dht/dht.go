@@ -0,0 +1,555 @@
+package dht
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"swiftpeer/client/common"
+	"swiftpeer/client/peer"
+	"sync"
+	"time"
+)
+
+const (
+	// maxPacketSize is the largest packet read, the messages we build stay
+	// well under an MTU but others may not
+	maxPacketSize = 1 << 12
+	queryTimeout  = 2 * time.Second
+	// alpha is the number of queries in flight during a lookup
+	alpha           = 3
+	maxLookupRounds = 32
+	// refreshAfter is how long a bucket can go unchanged before we look up
+	// a random id in its range
+	refreshAfter      = 15 * time.Minute
+	maintainInterval  = time.Minute
+	maxRefreshPerTick = 4
+	// maxPings bounds the pings in flight to questionable nodes
+	maxPings = 16
+)
+
+// DefaultBootstrapNodes are well known routers of the mainline DHT
+var DefaultBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+var errClosed = errors.New("dht server closed")
+
+type Config struct {
+	Addr           string   // UDP address to listen on, e.g. ":6881"
+	BootstrapNodes []string // host:port of nodes used to join the network
+	StatePath      string   // file the routing table is saved to, empty to disable
+}
+
+// Server is a node of the mainline DHT (BEP 5). It answers queries from other
+// nodes and looks up peers of torrents for us.
+type Server struct {
+	ID ID
+
+	cfg    Config
+	conn   *net.UDPConn
+	table  *table
+	tokens *tokens
+	peers  *peerStore
+	pings  chan struct{}
+
+	mu      sync.Mutex
+	pending map[string]*transaction
+	nextTx  uint16
+
+	closed chan struct{}
+	wg     sync.WaitGroup
+}
+
+// transaction is a query waiting for its response
+type transaction struct {
+	addr *net.UDPAddr
+	resp chan *msg
+}
+
+// NewServer listens on cfg.Addr and restores the routing table saved at
+// cfg.StatePath, Bootstrap must be called before looking up peers
+func NewServer(cfg Config) (*Server, error) {
+	addr, err := net.ResolveUDPAddr("udp4", cfg.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DHT address %q: %w", cfg.Addr, err)
+	}
+
+	id := RandomID()
+	var saved []node
+	if cfg.StatePath != "" {
+		st, err := loadState(cfg.StatePath)
+		if err != nil {
+			fmt.Printf("[INFO] ignoring DHT state: %v\n", err)
+		} else if st != nil {
+			id = st.ID
+			saved, _ = decodeNodes(st.Nodes)
+		}
+	}
+
+	conn, err := net.ListenUDP("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		ID:      id,
+		cfg:     cfg,
+		conn:    conn,
+		table:   newTable(id),
+		tokens:  newTokens(),
+		peers:   newPeerStore(),
+		pings:   make(chan struct{}, maxPings),
+		pending: make(map[string]*transaction),
+		closed:  make(chan struct{}),
+	}
+	for _, n := range saved {
+		s.table.add(n.id, n.addr)
+	}
+
+	s.wg.Add(2)
+	go s.readLoop()
+	go s.maintain()
+	return s, nil
+}
+
+func (s *Server) Addr() *net.UDPAddr {
+	return s.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Nodes returns the number of nodes in the routing table
+func (s *Server) Nodes() int {
+	return s.table.size()
+}
+
+// Close stops the server and saves the routing table
+func (s *Server) Close() error {
+	select {
+	case <-s.closed:
+		return nil
+	default:
+	}
+	close(s.closed)
+	err := s.conn.Close()
+	s.wg.Wait()
+	if s.cfg.StatePath != "" {
+		if err := s.save(); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// Bootstrap joins the network by looking up our own id, starting from the
+// saved nodes and the bootstrap nodes
+func (s *Server) Bootstrap() error {
+	if s.table.size() < K {
+		var wg sync.WaitGroup
+		for _, hostport := range s.cfg.BootstrapNodes {
+			addr, err := net.ResolveUDPAddr("udp4", hostport)
+			if err != nil {
+				fmt.Printf("[INFO] failed to resolve DHT bootstrap node %v: %v\n", hostport, err)
+				continue
+			}
+			wg.Add(1)
+			go func(addr *net.UDPAddr) {
+				defer wg.Done()
+				m, err := s.query(addr, "find_node", &queryArgs{Target: s.ID[:]})
+				if err != nil {
+					return
+				}
+				nodes, _ := decodeNodes(m.R.Nodes)
+				for _, n := range nodes {
+					s.table.add(n.id, n.addr)
+				}
+			}(addr)
+		}
+		wg.Wait()
+	}
+
+	s.lookup(s.ID, false)
+	if s.table.size() == 0 {
+		return fmt.Errorf("no DHT node answered")
+	}
+	return nil
+}
+
+// GetPeers looks up the peers of infoHash, returned as host:port addresses
+func (s *Server) GetPeers(infoHash [20]byte) ([]string, error) {
+	if s.table.size() == 0 {
+		return nil, fmt.Errorf("DHT routing table is empty")
+	}
+	_, peers := s.lookup(infoHash, true)
+	return peers, nil
+}
+
+// Announce looks up the peers of infoHash and announces that we accept
+// connections on port to the closest nodes
+func (s *Server) Announce(infoHash [20]byte, port int) ([]string, error) {
+	if s.table.size() == 0 {
+		return nil, fmt.Errorf("DHT routing table is empty")
+	}
+	closest, peers := s.lookup(infoHash, true)
+
+	var wg sync.WaitGroup
+	for _, c := range closest {
+		if c.token == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(c *candidate) {
+			defer wg.Done()
+			s.query(c.addr, "announce_peer", &queryArgs{InfoHash: infoHash[:], Port: port, Token: c.token})
+		}(c)
+	}
+	wg.Wait()
+	return peers, nil
+}
+
+// Ping adds the node at addr to the routing table if it answers, it is used
+// for the nodes peers tell us about in a port message
+func (s *Server) Ping(addr string) error {
+	udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return err
+	}
+	_, err = s.query(udpAddr, "ping", &queryArgs{})
+	return err
+}
+
+func (s *Server) readLoop() {
+	defer s.wg.Done()
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-s.closed:
+				return
+			default:
+				continue
+			}
+		}
+
+		m, err := decodeMsg(buf[:n])
+		if err != nil {
+			continue
+		}
+		if m.Y == "q" {
+			s.handleQuery(m, addr)
+			continue
+		}
+
+		s.mu.Lock()
+		tx, ok := s.pending[m.T]
+		s.mu.Unlock()
+		// a response must come from the node we queried
+		if ok && tx.addr.IP.Equal(addr.IP) && tx.addr.Port == addr.Port {
+			select {
+			case tx.resp <- m:
+			default:
+			}
+		}
+	}
+}
+
+func (s *Server) maintain() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(maintainInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+		}
+
+		s.tokens.rotate()
+		s.peers.expire()
+
+		if s.table.size() == 0 {
+			s.Bootstrap()
+			continue
+		}
+		for i, idx := range s.table.staleBuckets(refreshAfter) {
+			if i == maxRefreshPerTick {
+				break
+			}
+			s.table.touchBucket(idx)
+			s.lookup(s.table.randomIDInBucket(idx), false)
+		}
+
+		if s.cfg.StatePath != "" {
+			if err := s.save(); err != nil {
+				fmt.Printf("[INFO] failed to save DHT state: %v\n", err)
+			}
+		}
+	}
+}
+
+func (s *Server) send(addr *net.UDPAddr, m *msg) error {
+	data, err := encodeMsg(m)
+	if err != nil {
+		return err
+	}
+	_, err = s.conn.WriteToUDP(data, addr)
+	return err
+}
+
+func (s *Server) sendError(t string, addr *net.UDPAddr, code int, text string) {
+	s.send(addr, &msg{T: t, Y: "e", E: []interface{}{code, text}})
+}
+
+// query sends a query to addr and waits for the response
+func (s *Server) query(addr *net.UDPAddr, method string, args *queryArgs) (*msg, error) {
+	tx := &transaction{addr: addr, resp: make(chan *msg, 1)}
+
+	s.mu.Lock()
+	s.nextTx++
+	t := string(binary.BigEndian.AppendUint16(nil, s.nextTx))
+	s.pending[t] = tx
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, t)
+		s.mu.Unlock()
+	}()
+
+	args.ID = s.ID
+	if err := s.send(addr, &msg{T: t, Y: "q", Q: method, A: args, V: version()}); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(queryTimeout)
+	defer timer.Stop()
+	select {
+	case m := <-tx.resp:
+		if m.Y == "e" {
+			return nil, krpcError(m.E)
+		}
+		s.onSeen(m.R.ID, addr)
+		return m, nil
+	case <-timer.C:
+		s.table.failed(addr)
+		return nil, fmt.Errorf("%s query to %v timed out", method, addr)
+	case <-s.closed:
+		return nil, errClosed
+	}
+}
+
+// onSeen records a message from a node, pinging a questionable node of a
+// full bucket so that it is replaced if it has gone away
+func (s *Server) onSeen(id ID, addr *net.UDPAddr) {
+	if addr.IP.To4() == nil || addr.Port == 0 {
+		return
+	}
+	stale := s.table.seen(id, addr)
+	if stale == nil {
+		return
+	}
+	select {
+	case s.pings <- struct{}{}:
+		go func(addr *net.UDPAddr) {
+			defer func() { <-s.pings }()
+			s.query(addr, "ping", &queryArgs{})
+		}(stale.addr)
+	default:
+	}
+}
+
+func (s *Server) handleQuery(m *msg, addr *net.UDPAddr) {
+	a := m.A
+	r := &response{ID: s.ID}
+
+	switch m.Q {
+	case "ping":
+	case "find_node":
+		target, err := toID(a.Target)
+		if err != nil {
+			s.sendError(m.T, addr, errProtocol, "invalid target")
+			return
+		}
+		r.Nodes = encodeNodes(s.table.closest(target, K))
+	case "get_peers":
+		infoHash, err := toID(a.InfoHash)
+		if err != nil {
+			s.sendError(m.T, addr, errProtocol, "invalid info_hash")
+			return
+		}
+		r.Token = s.tokens.create(addr.IP)
+		if r.Values = s.peers.get(infoHash); len(r.Values) == 0 {
+			r.Nodes = encodeNodes(s.table.closest(infoHash, K))
+		}
+	case "announce_peer":
+		infoHash, err := toID(a.InfoHash)
+		if err != nil {
+			s.sendError(m.T, addr, errProtocol, "invalid info_hash")
+			return
+		}
+		if !s.tokens.valid(a.Token, addr.IP) {
+			s.sendError(m.T, addr, errProtocol, "bad token")
+			return
+		}
+		port := a.Port
+		if a.ImpliedPort != 0 {
+			port = addr.Port
+		}
+		p := peer.Peer{IP: addr.IP.String(), Port: port}
+		compact, ok := peer.AppendCompact(nil, p, net.IPv4len)
+		if port <= 0 || port > 65535 || !ok {
+			s.sendError(m.T, addr, errProtocol, "invalid port")
+			return
+		}
+		s.peers.add(infoHash, compact)
+	default:
+		s.sendError(m.T, addr, errMethodUnknown, "method unknown")
+		return
+	}
+
+	s.onSeen(a.ID, addr)
+	s.send(addr, &msg{T: m.T, Y: "r", R: r, V: version(), IP: compactAddr(addr)})
+}
+
+// candidate is a node considered during a lookup
+type candidate struct {
+	node
+	queried   bool
+	responded bool
+	token     []byte
+}
+
+// lookup runs an iterative search for target, querying the closest nodes it
+// learns about until the K closest ones have been asked. It returns the
+// closest nodes that answered and, for get_peers, the peers found.
+func (s *Server) lookup(target ID, getPeers bool) ([]*candidate, []string) {
+	known := make(map[string]bool)
+	var shortlist []*candidate
+	addCandidate := func(n node) {
+		key := n.addr.String()
+		if known[key] || n.id == s.ID {
+			return
+		}
+		known[key] = true
+		shortlist = append(shortlist, &candidate{node: n})
+	}
+	for _, n := range s.table.closest(target, K) {
+		addCandidate(n)
+	}
+
+	peersFound := make(map[string]bool)
+	var peers []string
+
+	type result struct {
+		c *candidate
+		r *response
+	}
+
+	for round := 0; round < maxLookupRounds; round++ {
+		sort.Slice(shortlist, func(i, j int) bool {
+			return closer(shortlist[i].id, shortlist[j].id, target)
+		})
+
+		var batch []*candidate
+		considered := 0
+		for _, c := range shortlist {
+			if considered == K || len(batch) == alpha {
+				break
+			}
+			if c.queried && !c.responded {
+				continue
+			}
+			considered++
+			if !c.queried {
+				batch = append(batch, c)
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		results := make(chan result, len(batch))
+		for _, c := range batch {
+			c.queried = true
+			go func(c *candidate) {
+				args := &queryArgs{}
+				method := "find_node"
+				if getPeers {
+					method = "get_peers"
+					args.InfoHash = target[:]
+				} else {
+					args.Target = target[:]
+				}
+				m, err := s.query(c.addr, method, args)
+				if err != nil {
+					results <- result{c, nil}
+					return
+				}
+				results <- result{c, m.R}
+			}(c)
+		}
+
+		for range batch {
+			res := <-results
+			if res.r == nil {
+				continue
+			}
+			res.c.responded = true
+			res.c.token = res.r.Token
+			nodes, err := decodeNodes(res.r.Nodes)
+			if err == nil {
+				for _, n := range nodes {
+					addCandidate(n)
+				}
+			}
+			for _, v := range res.r.Values {
+				addr, ok := parseValue(v)
+				if ok && !peersFound[addr] {
+					peersFound[addr] = true
+					peers = append(peers, addr)
+				}
+			}
+		}
+	}
+
+	var closest []*candidate
+	for _, c := range shortlist {
+		if len(closest) == K {
+			break
+		}
+		if c.responded {
+			closest = append(closest, c)
+		}
+	}
+	return closest, peers
+}
+
+// parseValue formats a compact peer of a get_peers response
+func parseValue(v []byte) (string, bool) {
+	ipLen := net.IPv4len
+	if len(v) == net.IPv6len+2 {
+		ipLen = net.IPv6len
+	}
+	peers, err := peer.ParseCompact(v, ipLen)
+	if err != nil || len(peers) != 1 || peers[0].Port == 0 {
+		return "", false
+	}
+	addr, err := peers[0].FormatAddress()
+	return addr, err == nil
+}
+
+func compactAddr(addr *net.UDPAddr) []byte {
+	ip := addr.IP.To4()
+	if ip == nil {
+		ip = addr.IP.To16()
+	}
+	return binary.BigEndian.AppendUint16(append([]byte(nil), ip...), uint16(addr.Port))
+}
+
+// version is the v key of our messages, a client id and a version
+func version() string {
+	return common.ClientVersion + "\x00\x01"
+}
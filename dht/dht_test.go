@@ -0,0 +1,124 @@
+package dht
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// startNetwork starts count nodes on the loopback interface, all joining
+// through the first one
+func startNetwork(t *testing.T, count int) []*Server {
+	t.Helper()
+	var servers []*Server
+	for i := 0; i < count; i++ {
+		cfg := Config{Addr: "127.0.0.1:0"}
+		if i > 0 {
+			cfg.BootstrapNodes = []string{servers[0].Addr().String()}
+		}
+		s, err := NewServer(cfg)
+		if err != nil {
+			t.Fatalf("NewServer() error = %v", err)
+		}
+		t.Cleanup(func() { s.Close() })
+		servers = append(servers, s)
+	}
+	for _, s := range servers[1:] {
+		if err := s.Bootstrap(); err != nil {
+			t.Fatalf("Bootstrap() error = %v", err)
+		}
+	}
+	return servers
+}
+
+func TestAnnounceAndGetPeers(t *testing.T) {
+	servers := startNetwork(t, 20)
+	infoHash := [20]byte(RandomID())
+
+	if _, err := servers[3].Announce(infoHash, 51413); err != nil {
+		t.Fatalf("Announce() error = %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		server *Server
+	}{
+		{"Bootstrap node", servers[0]},
+		{"Other node", servers[17]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peers, err := tt.server.GetPeers(infoHash)
+			if err != nil {
+				t.Fatalf("GetPeers() error = %v", err)
+			}
+			found := false
+			for _, p := range peers {
+				if p == "127.0.0.1:51413" {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("GetPeers() = %v, want the announced peer", peers)
+			}
+		})
+	}
+}
+
+func TestAnnounceBadToken(t *testing.T) {
+	servers := startNetwork(t, 2)
+	infoHash := RandomID()
+
+	_, err := servers[1].query(servers[0].Addr(), "announce_peer", &queryArgs{InfoHash: infoHash[:], Port: 1, Token: []byte("forged")})
+	if err == nil {
+		t.Fatalf("announce_peer with a forged token succeeded")
+	}
+	if peers := servers[0].peers.get(infoHash); len(peers) != 0 {
+		t.Errorf("peers stored with a forged token: %v", peers)
+	}
+}
+
+func TestStatePersistence(t *testing.T) {
+	servers := startNetwork(t, 5)
+	path := filepath.Join(t.TempDir(), "dht.dat")
+
+	s, err := NewServer(Config{Addr: "127.0.0.1:0", StatePath: path, BootstrapNodes: []string{servers[0].Addr().String()}})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	if err := s.Bootstrap(); err != nil {
+		t.Fatalf("Bootstrap() error = %v", err)
+	}
+	id, nodes := s.ID, s.Nodes()
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	restored, err := NewServer(Config{Addr: "127.0.0.1:0", StatePath: path})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	defer restored.Close()
+	if restored.ID != id {
+		t.Errorf("restored id = %x, want %x", restored.ID, id)
+	}
+	if restored.Nodes() != nodes {
+		t.Errorf("restored %d nodes, want %d", restored.Nodes(), nodes)
+	}
+	// no bootstrap nodes are configured, the saved ones must be enough
+	if err := restored.Bootstrap(); err != nil {
+		t.Fatalf("Bootstrap() from saved nodes error = %v", err)
+	}
+}
+
+func TestRandomIDInBucket(t *testing.T) {
+	tbl := newTable(RandomID())
+	for _, idx := range []int{0, 1, 7, 8, 63, 159} {
+		id := tbl.randomIDInBucket(idx)
+		if got := tbl.bucketIndex(id); got != idx {
+			t.Errorf("randomIDInBucket(%d) falls in bucket %d", idx, got)
+		}
+	}
+	if got := tbl.bucketIndex(tbl.self); got != -1 {
+		t.Errorf("bucketIndex(self) = %d, want -1", got)
+	}
+}
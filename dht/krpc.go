@@ -0,0 +1,133 @@
+package dht
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"swiftpeer/client/bencode"
+)
+
+// KRPC error codes
+const (
+	errGeneric       = 201
+	errServer        = 202
+	errProtocol      = 203
+	errMethodUnknown = 204
+)
+
+// compactNodeSize is a 20 byte id followed by a compact IPv4 address
+const compactNodeSize = 26
+
+// packetLimits guards the decoder against hostile packets, a valid message
+// never nests deeper than a list of values in a dictionary
+var packetLimits = bencode.Options{MaxDepth: 4, MaxStringLen: 1 << 11, MaxBytes: maxPacketSize}
+
+// msg is a KRPC message, y selects a query, a response or an error
+type msg struct {
+	T  string        `bencode:"t"`
+	Y  string        `bencode:"y"`
+	Q  string        `bencode:"q,omitempty"`
+	A  *queryArgs    `bencode:"a,omitempty"`
+	R  *response     `bencode:"r,omitempty"`
+	E  []interface{} `bencode:"e,omitempty"`
+	V  string        `bencode:"v,omitempty"`
+	IP []byte        `bencode:"ip,omitempty"` // BEP 42, the address the message was sent to
+}
+
+type queryArgs struct {
+	ID          ID     `bencode:"id"`
+	Target      []byte `bencode:"target,omitempty"`
+	InfoHash    []byte `bencode:"info_hash,omitempty"`
+	Token       []byte `bencode:"token,omitempty"`
+	Port        int    `bencode:"port,omitempty"`
+	ImpliedPort int    `bencode:"implied_port,omitempty"`
+}
+
+type response struct {
+	ID     ID       `bencode:"id"`
+	Nodes  []byte   `bencode:"nodes,omitempty"`
+	Token  []byte   `bencode:"token,omitempty"`
+	Values [][]byte `bencode:"values,omitempty"` // compact peers
+}
+
+func encodeMsg(m *msg) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := bencode.NewEncoder(&buf).Encode(m); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeMsg(data []byte) (*msg, error) {
+	m := new(msg)
+	if err := bencode.NewDecoderWithOptions(bytes.NewReader(data), packetLimits).Decode(m); err != nil {
+		return nil, err
+	}
+	switch m.Y {
+	case "q":
+		if m.Q == "" || m.A == nil {
+			return nil, fmt.Errorf("query without method or arguments")
+		}
+	case "r":
+		if m.R == nil {
+			return nil, fmt.Errorf("response without values")
+		}
+	case "e":
+	default:
+		return nil, fmt.Errorf("unknown message type %q", m.Y)
+	}
+	return m, nil
+}
+
+// krpcError formats the e list of an error message
+func krpcError(e []interface{}) error {
+	if len(e) != 2 {
+		return fmt.Errorf("malformed KRPC error")
+	}
+	return fmt.Errorf("KRPC error %v: %v", e[0], e[1])
+}
+
+// toID validates a 20 byte id received as a plain string
+func toID(b []byte) (ID, error) {
+	var id ID
+	if len(b) != len(id) {
+		return id, fmt.Errorf("invalid id length %d", len(b))
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
+func encodeNodes(nodes []node) []byte {
+	buf := make([]byte, 0, len(nodes)*compactNodeSize)
+	for _, n := range nodes {
+		ip := n.addr.IP.To4()
+		if ip == nil {
+			continue
+		}
+		buf = append(buf, n.id[:]...)
+		buf = append(buf, ip...)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n.addr.Port))
+	}
+	return buf
+}
+
+func decodeNodes(data []byte) ([]node, error) {
+	if len(data)%compactNodeSize != 0 {
+		return nil, fmt.Errorf("malformed compact node list, length %d is not a multiple of %d", len(data), compactNodeSize)
+	}
+	nodes := make([]node, 0, len(data)/compactNodeSize)
+	for i := 0; i < len(data); i += compactNodeSize {
+		var n node
+		copy(n.id[:], data[i:i+20])
+		n.addr = &net.UDPAddr{
+			IP:   net.IP(append([]byte(nil), data[i+20:i+24]...)),
+			Port: int(binary.BigEndian.Uint16(data[i+24 : i+26])),
+		}
+		if n.addr.Port == 0 {
+			continue
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
@@ -0,0 +1,59 @@
+package dht
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"swiftpeer/client/bencode"
+)
+
+// stateLimits fits a full routing table, 160 buckets of K compact nodes
+var stateLimits = bencode.Options{MaxDepth: 2, MaxStringLen: 1 << 16, MaxBytes: 1 << 17}
+
+// state is what we save of the routing table, keeping our id lets other
+// nodes find us where they left us
+type state struct {
+	ID    ID     `bencode:"id"`
+	Nodes []byte `bencode:"nodes"`
+}
+
+// loadState returns nil without error when nothing was saved yet
+func loadState(path string) (*state, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	st := new(state)
+	if err := bencode.NewDecoderWithOptions(bytes.NewReader(data), stateLimits).Decode(st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// save writes the routing table to a temporary file renamed over the state
+// file, so that a crash never leaves a truncated one
+func (s *Server) save() error {
+	st := state{ID: s.ID, Nodes: encodeNodes(s.table.all())}
+
+	if err := os.MkdirAll(filepath.Dir(s.cfg.StatePath), os.ModePerm); err != nil {
+		return err
+	}
+	tmp := s.cfg.StatePath + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := bencode.NewEncoder(f).Encode(st); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, s.cfg.StatePath)
+}
@@ -0,0 +1,125 @@
+package dht
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// tokenRotation is how often the token secret changes, tokens stay
+	// valid for up to two rotations
+	tokenRotation = 5 * time.Minute
+	tokenSize     = 8
+	// peerTTL is how long an announced peer is kept without a new announce
+	peerTTL = 30 * time.Minute
+	// maxPeersPerHash and maxInfoHashes bound the memory announces can use
+	maxPeersPerHash = 200
+	maxInfoHashes   = 2000
+	// maxValues is the most peers returned in a get_peers response, keeping
+	// it under a typical MTU
+	maxValues = 50
+)
+
+// tokens hands out and checks announce tokens, a token is bound to the ip
+// it was sent to
+type tokens struct {
+	mu       sync.Mutex
+	secret   [20]byte
+	previous [20]byte
+	rotated  time.Time
+}
+
+func newTokens() *tokens {
+	t := &tokens{rotated: time.Now()}
+	rand.Read(t.secret[:])
+	t.previous = t.secret
+	return t
+}
+
+func (t *tokens) rotate() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if time.Since(t.rotated) < tokenRotation {
+		return
+	}
+	t.previous = t.secret
+	rand.Read(t.secret[:])
+	t.rotated = time.Now()
+}
+
+func tokenFor(secret [20]byte, ip net.IP) []byte {
+	mac := hmac.New(sha1.New, secret[:])
+	mac.Write(ip)
+	return mac.Sum(nil)[:tokenSize]
+}
+
+func (t *tokens) create(ip net.IP) []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return tokenFor(t.secret, ip)
+}
+
+func (t *tokens) valid(token []byte, ip net.IP) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return hmac.Equal(token, tokenFor(t.secret, ip)) || hmac.Equal(token, tokenFor(t.previous, ip))
+}
+
+// peerStore keeps the peers announced to us, as compact addresses
+type peerStore struct {
+	mu    sync.Mutex
+	peers map[ID]map[string]time.Time
+}
+
+func newPeerStore() *peerStore {
+	return &peerStore{peers: make(map[ID]map[string]time.Time)}
+}
+
+func (s *peerStore) add(infoHash ID, compact []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	set, ok := s.peers[infoHash]
+	if !ok {
+		if len(s.peers) >= maxInfoHashes {
+			return
+		}
+		set = make(map[string]time.Time)
+		s.peers[infoHash] = set
+	}
+	if _, ok := set[string(compact)]; !ok && len(set) >= maxPeersPerHash {
+		return
+	}
+	set[string(compact)] = time.Now()
+}
+
+func (s *peerStore) get(infoHash ID) [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var values [][]byte
+	for compact := range s.peers[infoHash] {
+		if len(values) == maxValues {
+			break
+		}
+		values = append(values, []byte(compact))
+	}
+	return values
+}
+
+func (s *peerStore) expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for infoHash, set := range s.peers {
+		for compact, announced := range set {
+			if time.Since(announced) > peerTTL {
+				delete(set, compact)
+			}
+		}
+		if len(set) == 0 {
+			delete(s.peers, infoHash)
+		}
+	}
+}
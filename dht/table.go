@@ -0,0 +1,241 @@
+package dht
+
+import (
+	"crypto/rand"
+	"math/bits"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// K is the bucket size and the number of nodes returned by lookups
+	K = 8
+	// maxFailures is the number of unanswered queries after which a node is bad
+	maxFailures = 2
+	// questionableAfter is how long a node stays good without activity
+	questionableAfter = 15 * time.Minute
+)
+
+// ID is a node id or an info hash, they share the same 160 bit space
+type ID [20]byte
+
+func RandomID() ID {
+	var id ID
+	rand.Read(id[:])
+	return id
+}
+
+// commonPrefixLen returns the number of leading bits a and b share
+func commonPrefixLen(a, b ID) int {
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return len(a) * 8
+}
+
+// closer reports whether a is closer to target than b by the XOR metric
+func closer(a, b, target ID) bool {
+	for i := range target {
+		da, db := a[i]^target[i], b[i]^target[i]
+		if da != db {
+			return da < db
+		}
+	}
+	return false
+}
+
+// node is a contact in the routing table
+type node struct {
+	id       ID
+	addr     *net.UDPAddr
+	lastSeen time.Time
+	failures int
+}
+
+func (n *node) good() bool {
+	return n.failures == 0 && time.Since(n.lastSeen) < questionableAfter
+}
+
+type bucket struct {
+	nodes       []*node
+	lastChanged time.Time
+}
+
+// table is a Kademlia routing table with one bucket per shared prefix length
+// with our own id, bucket i holds nodes sharing exactly i leading bits
+type table struct {
+	mu      sync.Mutex
+	self    ID
+	buckets [160]bucket
+}
+
+func newTable(self ID) *table {
+	t := &table{self: self}
+	now := time.Now()
+	for i := range t.buckets {
+		t.buckets[i].lastChanged = now
+	}
+	return t
+}
+
+func (t *table) bucketIndex(id ID) int {
+	prefix := commonPrefixLen(t.self, id)
+	if prefix == 160 {
+		return -1
+	}
+	return prefix
+}
+
+// seen records activity from a node. It returns a questionable node the
+// caller should ping when the bucket is full, the new node being dropped.
+func (t *table) seen(id ID, addr *net.UDPAddr) *node {
+	idx := t.bucketIndex(id)
+	if idx < 0 {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := &t.buckets[idx]
+
+	for _, n := range b.nodes {
+		if n.id == id {
+			n.addr = addr
+			n.lastSeen = time.Now()
+			n.failures = 0
+			b.lastChanged = n.lastSeen
+			return nil
+		}
+	}
+
+	fresh := &node{id: id, addr: addr, lastSeen: time.Now()}
+	if len(b.nodes) < K {
+		b.nodes = append(b.nodes, fresh)
+		b.lastChanged = fresh.lastSeen
+		return nil
+	}
+
+	var stale *node
+	for i, n := range b.nodes {
+		if n.failures >= maxFailures {
+			b.nodes[i] = fresh
+			b.lastChanged = fresh.lastSeen
+			return nil
+		}
+		if !n.good() && (stale == nil || n.lastSeen.Before(stale.lastSeen)) {
+			stale = n
+		}
+	}
+	return stale
+}
+
+// add inserts a node we haven't talked to yet, e.g. loaded from disk
+func (t *table) add(id ID, addr *net.UDPAddr) {
+	idx := t.bucketIndex(id)
+	if idx < 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := &t.buckets[idx]
+	for _, n := range b.nodes {
+		if n.id == id {
+			return
+		}
+	}
+	if len(b.nodes) < K {
+		b.nodes = append(b.nodes, &node{id: id, addr: addr})
+	}
+}
+
+// failed records an unanswered query to the node at addr
+func (t *table) failed(addr *net.UDPAddr) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.buckets {
+		for _, n := range t.buckets[i].nodes {
+			if n.addr.IP.Equal(addr.IP) && n.addr.Port == addr.Port {
+				n.failures++
+			}
+		}
+	}
+}
+
+// closest returns up to count nodes closest to target, bad nodes excluded
+func (t *table) closest(target ID, count int) []node {
+	t.mu.Lock()
+	var nodes []node
+	for i := range t.buckets {
+		for _, n := range t.buckets[i].nodes {
+			if n.failures < maxFailures {
+				nodes = append(nodes, *n)
+			}
+		}
+	}
+	t.mu.Unlock()
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return closer(nodes[i].id, nodes[j].id, target)
+	})
+	if len(nodes) > count {
+		nodes = nodes[:count]
+	}
+	return nodes
+}
+
+func (t *table) all() []node {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var nodes []node
+	for i := range t.buckets {
+		for _, n := range t.buckets[i].nodes {
+			nodes = append(nodes, *n)
+		}
+	}
+	return nodes
+}
+
+func (t *table) size() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	count := 0
+	for i := range t.buckets {
+		count += len(t.buckets[i].nodes)
+	}
+	return count
+}
+
+// staleBuckets returns the indices of non empty buckets unchanged for longer than age
+func (t *table) staleBuckets(age time.Duration) []int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var stale []int
+	for i := range t.buckets {
+		if len(t.buckets[i].nodes) > 0 && time.Since(t.buckets[i].lastChanged) > age {
+			stale = append(stale, i)
+		}
+	}
+	return stale
+}
+
+// randomIDInBucket returns an id that falls into bucket idx, used to refresh it
+func (t *table) randomIDInBucket(idx int) ID {
+	id := RandomID()
+	for i := 0; i < idx; i++ {
+		mask := byte(1 << (7 - i%8))
+		id[i/8] = id[i/8]&^mask | t.self[i/8]&mask
+	}
+	mask := byte(1 << (7 - idx%8))
+	id[idx/8] = id[idx/8]&^mask | (^t.self[idx/8])&mask
+	return id
+}
+
+func (t *table) touchBucket(idx int) {
+	t.mu.Lock()
+	t.buckets[idx].lastChanged = time.Now()
+	t.mu.Unlock()
+}
@@ -2,48 +2,121 @@ package filewriter
 
 import (
 	"os"
+	"sync"
 	"syscall"
 )
 
+// windowSize is the size of the regions of a file mapped at once, it must be
+// a multiple of the page size
+var windowSize int64 = 64 << 20
+
+// maxWindows bounds the regions of a file mapped at once, the least recently
+// used one is unmapped to map another
+const maxWindows = 8
+
+// FileWriter maps a file to memory a window at a time, so that large files
+// don't exhaust the address space
 type FileWriter struct {
 	File *os.File
-	Data []byte
-	Size int
+	Size int64
+
+	mu      sync.Mutex
+	windows map[int64]*window // by offset / windowSize
+	uses    uint64
+}
+
+type window struct {
+	data    []byte
+	lastUse uint64
 }
 
-func New(path string, size int) (*FileWriter, error) {
+func New(path string, size int64) (*FileWriter, error) {
 	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
 	if err != nil {
 		return nil, err
 	}
-	if err = f.Truncate(int64(size)); err != nil {
-		f.Close()
-		return nil, err
+	if fi, err := f.Stat(); err != nil || fi.Size() != size {
+		if err = f.Truncate(size); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return &FileWriter{File: f, Size: size, windows: make(map[int64]*window)}, nil
+}
+
+// window returns the mapping of window i, fw.mu must be held
+func (fw *FileWriter) window(i int64) ([]byte, error) {
+	fw.uses++
+	if w, ok := fw.windows[i]; ok {
+		w.lastUse = fw.uses
+		return w.data, nil
+	}
+
+	if len(fw.windows) >= maxWindows {
+		oldest := int64(-1)
+		for j, w := range fw.windows {
+			if oldest < 0 || w.lastUse < fw.windows[oldest].lastUse {
+				oldest = j
+			}
+		}
+		if err := syscall.Munmap(fw.windows[oldest].data); err != nil {
+			return nil, err
+		}
+		delete(fw.windows, oldest)
 	}
 
-	data, err := syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	length := min(windowSize, fw.Size-i*windowSize)
+	data, err := syscall.Mmap(int(fw.File.Fd()), i*windowSize, int(length), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
 	if err != nil {
-		f.Close()
 		return nil, err
 	}
-	return &FileWriter{File: f, Data: data, Size: size}, nil
+	fw.windows[i] = &window{data: data, lastUse: fw.uses}
+	return data, nil
 }
 
-func (fw *FileWriter) WriteAt(data []byte, offset int) error {
-	if offset+len(data) > fw.Size {
+// copyAt copies between p and the file at offset, into the file when write
+// is set
+func (fw *FileWriter) copyAt(p []byte, offset int64, write bool) error {
+	if offset < 0 || offset+int64(len(p)) > fw.Size {
 		return syscall.EINVAL // Offset out of range
 	}
-	copy(fw.Data[offset:], data)
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	for done := 0; done < len(p); {
+		pos := offset + int64(done)
+		data, err := fw.window(pos / windowSize)
+		if err != nil {
+			return err
+		}
+		if write {
+			done += copy(data[pos%windowSize:], p[done:])
+		} else {
+			done += copy(p[done:], data[pos%windowSize:])
+		}
+	}
 	return nil
 }
 
+func (fw *FileWriter) WriteAt(data []byte, offset int64) error {
+	return fw.copyAt(data, offset, true)
+}
+
+func (fw *FileWriter) ReadAt(p []byte, offset int64) error {
+	return fw.copyAt(p, offset, false)
+}
+
 func (fw *FileWriter) Sync() error {
 	return fw.File.Sync()
 }
 
 func (fw *FileWriter) Close() error {
-	if err := syscall.Munmap(fw.Data); err != nil {
-		return err
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	for i, w := range fw.windows {
+		if err := syscall.Munmap(w.data); err != nil {
+			return err
+		}
+		delete(fw.windows, i)
 	}
 	return fw.File.Close()
 }
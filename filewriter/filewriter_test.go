@@ -0,0 +1,46 @@
+package filewriter
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWindows(t *testing.T) {
+	page := int64(os.Getpagesize())
+	defer func(size int64) { windowSize = size }(windowSize)
+	windowSize = page
+
+	path := filepath.Join(t.TempDir(), "f")
+	size := page*(maxWindows+2) + 100
+	fw, err := New(path, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every write crosses a window boundary, the first windows get unmapped
+	for i := int64(1); i*page < size; i++ {
+		if err := fw.WriteAt(bytes.Repeat([]byte{byte(i)}, 10), i*page-5); err != nil {
+			t.Fatalf("WriteAt(%d) error = %v", i*page-5, err)
+		}
+	}
+	if len(fw.windows) > maxWindows {
+		t.Errorf("%d windows mapped, want at most %d", len(fw.windows), maxWindows)
+	}
+	got := make([]byte, 10)
+	if err := fw.ReadAt(got, page-5); err != nil || !bytes.Equal(got, bytes.Repeat([]byte{1}, 10)) {
+		t.Errorf("ReadAt() = %v, %v", got, err)
+	}
+	if err := fw.WriteAt([]byte{1}, size); err == nil {
+		t.Error("WriteAt() past the end succeeded")
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := os.ReadFile(path)
+	if int64(len(data)) != size || data[2*page+4] != 2 || data[2*page-6] != 0 {
+		t.Errorf("file has %d bytes, want %d with the writes", len(data), size)
+	}
+}
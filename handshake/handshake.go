@@ -10,10 +10,21 @@ const (
 	handshakeLen = 49 + len(pstr) // hash_info + peer_id + 1(header byte for the length)
 )
 
+// Flag is a bit of the reserved bytes, numbered from the most significant
+// bit of the first byte like the pieces of a bitfield
+type Flag int
+
+const (
+	ExtensionProtocol Flag = 43 // BEP 10, reserved[5] & 0x10
+	FastExtension     Flag = 61 // BEP 6, reserved[7] & 0x04
+	DHT               Flag = 63 // BEP 5, reserved[7] & 0x01
+)
+
 type Handshake struct {
 	PeerId   [20]byte
 	Pstr     string
 	InfoHash [20]byte
+	Reserved [8]byte // extension bits
 }
 
 func NewHandshake(peerId, infoHash [20]byte) *Handshake {
@@ -24,13 +35,21 @@ func NewHandshake(peerId, infoHash [20]byte) *Handshake {
 	}
 }
 
+func (h *Handshake) SetFlag(f Flag) {
+	h.Reserved[f/8] |= 1 << (7 - f%8)
+}
+
+func (h *Handshake) HasFlag(f Flag) bool {
+	return h.Reserved[f/8]&(1<<(7-f%8)) != 0
+}
+
 func (h *Handshake) Serialize() []byte {
 
 	buff := make([]byte, handshakeLen)
 	buff[0] = byte(len(pstr))
 	idx := 1
 	idx += copy(buff[idx:], h.Pstr)
-	idx += copy(buff[idx:], make([]byte, 8)) //8 reserved bytes
+	idx += copy(buff[idx:], h.Reserved[:]) //8 reserved bytes
 	idx += copy(buff[idx:], h.InfoHash[:])
 	idx += copy(buff[idx:], h.PeerId[:])
 	return buff
@@ -54,8 +73,9 @@ func (h *Handshake) Deserialize(r io.Reader) (*Handshake, error) {
 		return nil, fmt.Errorf("failed to read handshake body: %v\n", err)
 	}
 
-	//reserved := bodyBuff[pstrLen : pstrLen+8]
+	var reserved [8]byte
 	var infoHash, peerId [20]byte
+	copy(reserved[:], bodyBuff[pstrLen:pstrLen+8])
 	copy(infoHash[:], bodyBuff[pstrLen+8:pstrLen+28])
 	copy(peerId[:], bodyBuff[pstrLen+28:])
 
@@ -63,5 +83,6 @@ func (h *Handshake) Deserialize(r io.Reader) (*Handshake, error) {
 		Pstr:     string(bodyBuff[0:pstrLen]),
 		InfoHash: infoHash,
 		PeerId:   peerId,
+		Reserved: reserved,
 	}, nil
 }
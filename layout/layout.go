@@ -0,0 +1,146 @@
+package layout
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// maxComponent is the longest file name most filesystems accept, 255
+	// bytes, less room for the ".part" suffix of skipped files
+	maxComponent = 250
+	// maxExt is the longest extension kept when a name is shortened
+	maxExt = 32
+	// maxPath bounds the path of a file relative to the output directory
+	maxPath = 4000
+)
+
+// reservedNames can't be used as file names on Windows, whatever the extension
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// Mapping is a file saved under another path than the torrent gives
+type Mapping struct {
+	Original string // the path in the torrent, components joined with "/"
+	Path     string // relative to the output directory
+}
+
+// Paths returns where each file of a torrent is saved relative to the output
+// directory. files holds the path components of each file under the name of
+// the torrent, or is nil for a single file torrent saved as name. Components
+// are sanitized so that no path leaves the output directory, and paths
+// colliding on a case insensitive filesystem are numbered. The mappings
+// report every path that differs from the torrent.
+func Paths(name string, files [][]string) ([]string, []Mapping, error) {
+	root := Component(name)
+	var raw, clean [][]string
+	if files == nil {
+		raw = [][]string{{name}}
+		clean = [][]string{{root}}
+	}
+	for _, file := range files {
+		raw = append(raw, append([]string{name}, file...))
+		components := []string{root}
+		for _, c := range file {
+			if c != "" && c != "." {
+				components = append(components, Component(c))
+			}
+		}
+		if len(components) == 1 {
+			// a file without a name, not the directory of the torrent
+			components = append(components, "_")
+		}
+		clean = append(clean, components)
+	}
+
+	dirs := make(map[string]bool)
+	for _, components := range clean {
+		for k := 1; k < len(components); k++ {
+			dirs[key(components[:k])] = true
+		}
+	}
+
+	paths := make([]string, len(clean))
+	used := make(map[string]bool)
+	var mappings []Mapping
+	for i, components := range clean {
+		last := len(components) - 1
+		leaf := components[last]
+		for n := 1; used[key(components)] || dirs[key(components)]; n++ {
+			components[last] = numbered(leaf, n)
+		}
+		used[key(components)] = true
+
+		paths[i] = filepath.Join(components...)
+		if len(paths[i]) > maxPath {
+			return nil, nil, fmt.Errorf("path of file %d is %d bytes long, at most %d are allowed", i, len(paths[i]), maxPath)
+		}
+		original := strings.Join(raw[i], "/")
+		if strings.Join(components, "/") != original {
+			mappings = append(mappings, Mapping{Original: original, Path: paths[i]})
+		}
+	}
+	return paths, mappings, nil
+}
+
+// Component returns c made safe to use as a file name. Separators, control
+// and reserved characters are replaced by underscores, trailing dots and
+// spaces dropped, reserved names prefixed and long names shortened.
+func Component(c string) string {
+	c = strings.ToValidUTF8(c, "_")
+	c = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(`/\<>:"|?*`, r) {
+			return '_'
+		}
+		return r
+	}, c)
+	// also turns "." and ".." into "_"
+	c = strings.TrimRight(c, ". ")
+	if c == "" {
+		return "_"
+	}
+	base, _, _ := strings.Cut(c, ".")
+	if reservedNames[strings.ToUpper(base)] {
+		c = "_" + c
+	}
+	return shorten(c, "")
+}
+
+// shorten appends suffix to c before its extension, cutting c so that the
+// result fits maxComponent
+func shorten(c, suffix string) string {
+	ext := path.Ext(c)
+	if len(ext) > maxExt {
+		ext = ""
+	}
+	stem := c[:len(c)-len(ext)]
+	if len(stem)+len(suffix)+len(ext) <= maxComponent {
+		return stem + suffix + ext
+	}
+	cut := maxComponent - len(suffix) - len(ext)
+	for cut > 0 && !utf8.RuneStart(stem[cut]) {
+		cut--
+	}
+	stem = strings.TrimRight(stem[:cut], ". ")
+	if stem == "" {
+		stem = "_"
+	}
+	return stem + suffix + ext
+}
+
+func numbered(leaf string, n int) string {
+	return shorten(leaf, fmt.Sprintf(" (%d)", n))
+}
+
+// key identifies a path on case insensitive filesystems
+func key(components []string) string {
+	return strings.ToLower(strings.Join(components, "/"))
+}
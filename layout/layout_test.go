@@ -0,0 +1,113 @@
+package layout
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPaths(t *testing.T) {
+	long := strings.Repeat("é", 200) + ".mkv"
+
+	tests := []struct {
+		name      string
+		torrent   string
+		files     [][]string
+		want      []string
+		wantMoved int
+	}{
+		{
+			name:    "Single file",
+			torrent: "movie.mkv",
+			want:    []string{"movie.mkv"},
+		},
+		{
+			name:    "Files kept as they are",
+			torrent: "pack",
+			files:   [][]string{{"a.txt"}, {"sub", "b.txt"}},
+			want:    []string{"pack/a.txt", "pack/sub/b.txt"},
+		},
+		{
+			name:      "Traversal",
+			torrent:   "..",
+			files:     [][]string{{"..", "..", "etc", "passwd"}, {".", "", "a"}},
+			want:      []string{"_/_/_/etc/passwd", "_/a"},
+			wantMoved: 2,
+		},
+		{
+			name:      "Separators in names",
+			torrent:   "../evil",
+			files:     [][]string{{"/etc/passwd"}, {`..\..\boot.ini`}},
+			want:      []string{".._evil/_etc_passwd", ".._evil/.._.._boot.ini"},
+			wantMoved: 2,
+		},
+		{
+			name:      "Reserved and control characters",
+			torrent:   "pack",
+			files:     [][]string{{"con.txt"}, {"a\x00b\nc"}, {"what?.txt "}, {"trailing..."}},
+			want:      []string{"pack/_con.txt", "pack/a_b_c", "pack/what_.txt", "pack/trailing"},
+			wantMoved: 4,
+		},
+		{
+			name:      "Overlong name",
+			torrent:   "pack",
+			files:     [][]string{{long}},
+			want:      []string{"pack/" + strings.Repeat("é", 123) + ".mkv"},
+			wantMoved: 1,
+		},
+		{
+			name:      "Case collisions",
+			torrent:   "pack",
+			files:     [][]string{{"A.txt"}, {"a.txt"}, {"a (1).txt"}},
+			want:      []string{"pack/A.txt", "pack/a (1).txt", "pack/a (1) (1).txt"},
+			wantMoved: 2,
+		},
+		{
+			name:      "File named like a directory",
+			torrent:   "pack",
+			files:     [][]string{{"dir"}, {"dir", "b"}},
+			want:      []string{"pack/dir (1)", "pack/dir/b"},
+			wantMoved: 1,
+		},
+		{
+			name:      "File without a name",
+			torrent:   "",
+			files:     [][]string{{}},
+			want:      []string{"_/_"},
+			wantMoved: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, moved, err := Paths(tt.torrent, tt.files)
+			if err != nil {
+				t.Fatalf("Paths() error = %v", err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("Paths() = %q, want %q", got, tt.want)
+			}
+			for i := range got {
+				if filepath.ToSlash(got[i]) != tt.want[i] {
+					t.Errorf("Paths()[%d] = %q, want %q", i, got[i], tt.want[i])
+				}
+				if !filepath.IsLocal(got[i]) {
+					t.Errorf("Paths()[%d] = %q leaves the output directory", i, got[i])
+				}
+			}
+			if len(moved) != tt.wantMoved {
+				t.Errorf("Paths() moved %v, want %d files", moved, tt.wantMoved)
+			}
+		})
+	}
+}
+
+func TestPathTooLong(t *testing.T) {
+	deep := make([]string, 100)
+	for i := range deep {
+		deep[i] = strings.Repeat("d", 100)
+	}
+	if _, _, err := Paths("pack", [][]string{deep}); err == nil {
+		t.Error("Paths() accepted a path of 10000 bytes")
+	}
+}
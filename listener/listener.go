@@ -0,0 +1,107 @@
+package listener
+
+import (
+	"fmt"
+	"net"
+	"swiftpeer/client/handshake"
+	"sync"
+	"time"
+)
+
+const (
+	handshakeTimeout = 10 * time.Second
+	// maxPendingHandshakes bounds the connections whose handshake we wait for
+	maxPendingHandshakes = 64
+)
+
+// Handler takes over the incoming connections of one torrent
+type Handler interface {
+	// HandleConn is called once the handshake of the peer has been read, it
+	// owns conn and must close it
+	HandleConn(conn net.Conn, hs *handshake.Handshake)
+}
+
+// Listener accepts peer connections and routes them to the torrent matching
+// the info hash of their handshake
+type Listener struct {
+	ln       net.Listener
+	pending  chan struct{}
+	mu       sync.Mutex
+	handlers map[[20]byte]Handler
+}
+
+func Listen(addr string) (*Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{
+		ln:       ln,
+		pending:  make(chan struct{}, maxPendingHandshakes),
+		handlers: make(map[[20]byte]Handler),
+	}, nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+func (l *Listener) Register(infoHash [20]byte, h Handler) {
+	l.mu.Lock()
+	l.handlers[infoHash] = h
+	l.mu.Unlock()
+}
+
+func (l *Listener) Unregister(infoHash [20]byte) {
+	l.mu.Lock()
+	delete(l.handlers, infoHash)
+	l.mu.Unlock()
+}
+
+// Serve accepts connections until the listener is closed
+func (l *Listener) Serve() error {
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		select {
+		case l.pending <- struct{}{}:
+			go l.handshake(conn)
+		default:
+			conn.Close()
+		}
+	}
+}
+
+func (l *Listener) Close() error {
+	return l.ln.Close()
+}
+
+func (l *Listener) handshake(conn net.Conn) {
+	defer func() { <-l.pending }()
+
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	hs, err := new(handshake.Handshake).Deserialize(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		fmt.Printf("[INFO] failed to read handshake from %v: %v\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	l.mu.Lock()
+	h, ok := l.handlers[hs.InfoHash]
+	l.mu.Unlock()
+	if !ok {
+		fmt.Printf("[INFO] %v asked for unknown info hash %x\n", conn.RemoteAddr(), hs.InfoHash)
+		conn.Close()
+		return
+	}
+
+	go h.HandleConn(conn, hs)
+}
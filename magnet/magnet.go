@@ -0,0 +1,117 @@
+package magnet
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	btihPrefix = "urn:btih:"
+	// maxRangeLen bounds a single range of the so parameter
+	maxRangeLen = 1 << 16
+)
+
+// Magnet holds the parameters of a magnet link
+type Magnet struct {
+	InfoHash    [20]byte
+	DisplayName string   // dn
+	Trackers    []string // tr
+	WebSeeds    []string // ws
+	Peers       []string // x.pe, host:port of peers to contact directly
+	SelectOnly  []int    // so, file indices to download (BEP 53)
+}
+
+func Parse(uri string) (*Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid magnet link: %w", err)
+	}
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("invalid magnet link: unexpected scheme %q", u.Scheme)
+	}
+
+	params, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("invalid magnet link: %w", err)
+	}
+
+	m := &Magnet{
+		DisplayName: params.Get("dn"),
+		Trackers:    params["tr"],
+		WebSeeds:    params["ws"],
+		Peers:       params["x.pe"],
+	}
+
+	found := false
+	for _, xt := range params["xt"] {
+		if !strings.HasPrefix(xt, btihPrefix) {
+			// e.g. urn:btmh: for v2 torrents, which we don't support
+			continue
+		}
+		if m.InfoHash, err = parseInfoHash(xt[len(btihPrefix):]); err != nil {
+			return nil, err
+		}
+		found = true
+		break
+	}
+	if !found {
+		return nil, fmt.Errorf("invalid magnet link: missing %s exact topic", btihPrefix)
+	}
+
+	if so := params.Get("so"); so != "" {
+		if m.SelectOnly, err = parseSelectOnly(so); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// parseInfoHash accepts the 40 character hex and the 32 character base32 forms
+func parseInfoHash(s string) ([20]byte, error) {
+	var hash [20]byte
+	var decoded []byte
+	var err error
+
+	switch len(s) {
+	case 40:
+		decoded, err = hex.DecodeString(s)
+	case 32:
+		decoded, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		return hash, fmt.Errorf("invalid info hash length %d", len(s))
+	}
+	if err != nil {
+		return hash, fmt.Errorf("invalid info hash %q: %w", s, err)
+	}
+
+	copy(hash[:], decoded)
+	return hash, nil
+}
+
+// parseSelectOnly parses a list like "0,2,4-6" into file indices
+func parseSelectOnly(s string) ([]int, error) {
+	var indices []int
+	for _, part := range strings.Split(s, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(first)
+		if err != nil || start < 0 {
+			return nil, fmt.Errorf("invalid file index %q in so", part)
+		}
+		end := start
+		if isRange {
+			end, err = strconv.Atoi(last)
+			if err != nil || end < start || end-start > maxRangeLen {
+				return nil, fmt.Errorf("invalid file range %q in so", part)
+			}
+		}
+		for i := start; i <= end; i++ {
+			indices = append(indices, i)
+		}
+	}
+	return indices, nil
+}
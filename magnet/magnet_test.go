@@ -0,0 +1,70 @@
+package magnet
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	hash := [20]byte{
+		0xc1, 0x2f, 0xe1, 0xc0, 0x6b, 0xba, 0x25, 0x4a, 0x9d, 0xc9,
+		0xf5, 0x19, 0xb3, 0x35, 0xaa, 0x7c, 0x13, 0x67, 0xa8, 0x8a,
+	}
+
+	tests := []struct {
+		name     string
+		input    string
+		expected *Magnet
+		wantErr  bool
+	}{
+		{
+			name:  "Hex info hash with all parameters",
+			input: "magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&dn=file.iso&tr=udp%3A%2F%2Ft1%3A80&tr=http%3A%2F%2Ft2%2Fannounce&ws=http%3A%2F%2Fws%2F&x.pe=10.0.0.1%3A6881&so=0,2,4-5",
+			expected: &Magnet{
+				InfoHash:    hash,
+				DisplayName: "file.iso",
+				Trackers:    []string{"udp://t1:80", "http://t2/announce"},
+				WebSeeds:    []string{"http://ws/"},
+				Peers:       []string{"10.0.0.1:6881"},
+				SelectOnly:  []int{0, 2, 4, 5},
+			},
+		},
+		{
+			name:     "Base32 info hash",
+			input:    "magnet:?xt=urn:btih:YEX6DQDLXISUVHOJ6UM3GNNKPQJWPKEK",
+			expected: &Magnet{InfoHash: hash},
+		},
+		{
+			name:    "Missing btih",
+			input:   "magnet:?xt=urn:btmh:1220abcd&dn=x",
+			wantErr: true,
+		},
+		{
+			name:    "Bad hash length",
+			input:   "magnet:?xt=urn:btih:abcd",
+			wantErr: true,
+		},
+		{
+			name:    "Bad select only range",
+			input:   "magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&so=5-2",
+			wantErr: true,
+		},
+		{
+			name:    "Not a magnet link",
+			input:   "http://example.com/?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := Parse(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(m, tt.expected) {
+				t.Errorf("Expected %+v, got %+v", tt.expected, m)
+			}
+		})
+	}
+}
@@ -3,35 +3,197 @@ package main
 import (
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
 	"swiftpeer/client/common"
+	"swiftpeer/client/dht"
+	"swiftpeer/client/listener"
+	"swiftpeer/client/storage"
 	"swiftpeer/client/torrent"
+	"syscall"
 )
 
 const Port int = 6881
 
 func main() {
 
+	if len(os.Args) > 1 && os.Args[1] == "create" {
+		if err := runCreate(os.Args[2:]); err != nil {
+			fmt.Println("Error creating torrent:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		if err := runVerify(os.Args[2:]); err != nil {
+			fmt.Println("Error verifying torrent:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	torrentFilePath := flag.String("t", "", "Path to the torrent file")
+	magnetURI := flag.String("m", "", "Magnet link to download instead of a torrent file")
 	outDir := flag.String("o", "", "Output directory for downloaded files")
+	port := flag.Int("port", Port, "TCP port to accept peers on, and UDP port of the DHT node")
+	seed := flag.Bool("seed", false, "Keep seeding once the download completes, until interrupted")
+	useDHT := flag.Bool("dht", true, "Find peers on the DHT, except for private torrents")
+	dhtNodes := flag.String("dht-nodes", strings.Join(dht.DefaultBootstrapNodes, ","), "Comma separated DHT bootstrap nodes")
+	dhtState := flag.String("dht-state", defaultDHTStatePath(), "File the DHT routing table is saved to")
+	var priorities listFlag
+	flag.Var(&priorities, "file-priority", "Priority of files as <skip|low|normal|high>:<file index or glob>, can be repeated, later ones win")
+	sequential := flag.Bool("sequential", false, "Download the pieces in order, e.g. to play a file while it downloads")
+	httpAddr := flag.String("http", "", "Address to serve the files over HTTP on while they download, e.g. localhost:8080")
+	storageKind := flag.String("storage", "mmap", "How files are written: mmap, or file for plain reads and writes")
 	flag.Parse()
 
-	if *torrentFilePath == "" || *outDir == "" {
+	if (*torrentFilePath == "") == (*magnetURI == "") || *outDir == "" {
 		fmt.Println("Usage: program -t <torrent-file-path> -o <output-directory>")
+		fmt.Println("       program -m <magnet-link> -o <output-directory>")
+		fmt.Println("       program create -o <torrent-file> [options] <path>")
+		fmt.Println("       program verify -t <torrent-file-path> -o <output-directory>")
+		os.Exit(1)
+	}
+
+	var store storage.Storage
+	switch *storageKind {
+	case "mmap":
+		store = storage.NewMmap(*outDir)
+	case "file":
+		store = storage.NewFile(*outDir)
+	default:
+		fmt.Printf("Unknown storage %q, expected mmap or file\n", *storageKind)
 		os.Exit(1)
 	}
 
 	peerId := common.GeneratePeerId()
 
-	t, err := torrent.NewTorrent(*torrentFilePath, peerId, Port, *outDir)
+	var node *dht.Server
+	if *useDHT {
+		node = startDHT(*port, *dhtNodes, *dhtState)
+		if node != nil {
+			defer node.Close()
+		}
+	}
+
+	l, err := listener.Listen(fmt.Sprintf(":%d", *port))
+	if err != nil {
+		fmt.Printf("[INFO] not accepting incoming peers: %v\n", err)
+	} else {
+		defer l.Close()
+		go l.Serve()
+	}
+
+	var t *torrent.Torrent
+	if *magnetURI != "" {
+		t, err = torrent.NewTorrentFromMagnet(*magnetURI, peerId, *port, *outDir, store, node)
+	} else {
+		t, err = torrent.NewTorrent(*torrentFilePath, peerId, *port, *outDir, store, node)
+	}
 	if err != nil {
 		fmt.Println("Error creating torrent:", err)
 		return
 	}
+	defer t.Close()
+	if err := setPriorities(t, priorities); err != nil {
+		fmt.Println("Error setting file priorities:", err)
+		return
+	}
+	if l != nil {
+		l.Register(t.InfoHash, t)
+	}
+	t.SetSequential(*sequential)
+	if *httpAddr != "" {
+		srv := &http.Server{Addr: *httpAddr, Handler: t}
+		go func() {
+			if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				fmt.Printf("[INFO] failed to serve HTTP: %v\n", err)
+			}
+		}()
+		defer srv.Close()
+		fmt.Printf("[INFO] serving the files on http://%v/\n", *httpAddr)
+	}
 
-	err = t.Download(*outDir)
+	// interrupting stops the download or the seeding, the progress is saved
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	stop := make(chan struct{})
+	go func() {
+		<-interrupt
+		close(stop)
+	}()
+
+	err = t.Download(stop)
 	if err != nil {
 		fmt.Println("Error downloading torrent:", err)
+		return
+	}
+
+	if *seed && l != nil {
+		fmt.Println("[INFO] seeding, press Ctrl+C to stop")
+		t.Seed(stop)
+	} else if *httpAddr != "" {
+		fmt.Println("[INFO] serving the files, press Ctrl+C to stop")
+		<-stop
+	}
+}
+
+// setPriorities applies the -file-priority rules in order, e.g. skip:* then
+// high:*.mkv to only download the videos
+func setPriorities(t *torrent.Torrent, rules []string) error {
+	for _, rule := range rules {
+		name, pattern, ok := strings.Cut(rule, ":")
+		if !ok {
+			return fmt.Errorf("invalid rule %q, expected <priority>:<file index or glob>", rule)
+		}
+		priority, err := torrent.ParsePriority(name)
+		if err != nil {
+			return err
+		}
+		files, err := t.MatchFiles(pattern)
+		if err != nil {
+			return err
+		}
+		for _, i := range files {
+			if err := t.SetFilePriority(i, priority); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// startDHT joins the DHT, the download goes on with trackers only when it fails
+func startDHT(port int, bootstrapNodes, statePath string) *dht.Server {
+	cfg := dht.Config{
+		Addr:      fmt.Sprintf(":%d", port),
+		StatePath: statePath,
+	}
+	for _, addr := range strings.Split(bootstrapNodes, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			cfg.BootstrapNodes = append(cfg.BootstrapNodes, addr)
+		}
 	}
 
+	node, err := dht.NewServer(cfg)
+	if err != nil {
+		fmt.Printf("[INFO] failed to start DHT node: %v\n", err)
+		return nil
+	}
+	if err := node.Bootstrap(); err != nil {
+		fmt.Printf("[INFO] failed to bootstrap DHT: %v\n", err)
+	}
+	fmt.Printf("[INFO] DHT routing table has %d nodes\n", node.Nodes())
+	return node
+}
+
+func defaultDHTStatePath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "swiftpeer", "dht.dat")
 }
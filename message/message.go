@@ -22,6 +22,18 @@ const (
 	PortMsg // only for DHT
 )
 
+// Messages of the fast extension (BEP 6)
+const (
+	SuggestPieceMsg = iota + 0x0D
+	HaveAllMsg
+	HaveNoneMsg
+	RejectRequestMsg
+	AllowedFastMsg
+)
+
+// ExtendedMsg carries the messages of the extension protocol (BEP 10)
+const ExtendedMsg = 20
+
 type Message struct {
 	Id      messageId
 	Payload []byte
@@ -53,35 +65,47 @@ func (m *Message) Serialize() []byte {
 // length prefix is a four byte big-endian value
 // message ID is a single decimal byte
 // payload is message dependent.
-func Read(r io.Reader) (*Message, error) {
+//
+// Read reads the next message, nil for a keep-alive. Messages longer than
+// maxLength are refused rather than allocated.
+func Read(r io.Reader, maxLength int) (*Message, error) {
 	lengthBuff := make([]byte, 4)
 	_, err := io.ReadFull(r, lengthBuff)
 	if err != nil {
-		fmt.Printf("Error while reading the prefix length in message: %v\n", err.Error())
 		return nil, err
 	}
-
 	length := binary.BigEndian.Uint32(lengthBuff)
-
 	if length == 0 {
 		return nil, nil
 	}
-
+	if uint64(length) > uint64(maxLength) {
+		return nil, fmt.Errorf("message of %d bytes exceeds the limit of %d", length, maxLength)
+	}
 	message := make([]byte, length)
 	_, err = io.ReadFull(r, message)
 	if err != nil {
-		fmt.Printf("Error while reading the message: %v\n", err.Error())
 		return nil, err
 	}
+	m := Message{Id: messageId(message[0]), Payload: message[1:]}
+	return &m, nil
+}
 
-	m := Message{
-		Id:      messageId(message[0]),
-		Payload: message[1:],
-	}
-
-	//fmt.Printf("received message type: %v\n", m.Name())
+const (
+	// blockOverhead leaves room for the header of a piece message or of an
+	// ut_metadata piece around a block
+	blockOverhead = 1 << 10
+	// maxBitfield bounds the bitfield of a torrent whose size is unknown yet
+	maxBitfield = 1 << 18
+)
 
-	return &m, nil
+// MaxLength is the longest message a peer sends for a torrent of numPieces
+// pieces, zero when unknown: a block with its header, or the bitfield
+func MaxLength(numPieces int) int {
+	bitfield := (numPieces + 7) / 8
+	if numPieces <= 0 {
+		bitfield = maxBitfield
+	}
+	return 1 + max(common.BlockSize+blockOverhead, bitfield)
 }
 
 // keep-alive is 0 length, the id is not serialized
@@ -155,6 +179,73 @@ func NewCancel(pieceIndex, offset, length int) *Message {
 	}
 }
 
+// NewExtended wraps an extension message, extId is the id the receiver
+// assigned to the extension, 0 being the extended handshake
+func NewExtended(extId byte, payload []byte) *Message {
+	return &Message{
+		Id:      ExtendedMsg,
+		Payload: append([]byte{extId}, payload...),
+	}
+}
+
+// NewPort announces the UDP port of our DHT node
+func NewPort(port int) *Message {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, uint16(port))
+	return &Message{
+		Id:      PortMsg,
+		Payload: payload,
+	}
+}
+
+// NewSuggest advises the peer to download a piece, it is only a hint
+func NewSuggest(pieceIndex int) *Message {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(pieceIndex))
+	return &Message{
+		Id:      SuggestPieceMsg,
+		Payload: payload,
+	}
+}
+
+// NewHaveAll replaces the bitfield when we have every piece
+func NewHaveAll() *Message {
+	return &Message{
+		Id:      HaveAllMsg,
+		Payload: nil,
+	}
+}
+
+// NewHaveNone replaces the bitfield when we have no piece
+func NewHaveNone() *Message {
+	return &Message{
+		Id:      HaveNoneMsg,
+		Payload: nil,
+	}
+}
+
+// NewReject tells the peer that its request won't be served
+func NewReject(pieceIndex, offset, length int) *Message {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(pieceIndex))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(offset))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(length))
+	return &Message{
+		Id:      RejectRequestMsg,
+		Payload: payload,
+	}
+}
+
+// NewAllowedFast lets the peer request a piece even while we choke it
+func NewAllowedFast(pieceIndex int) *Message {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(pieceIndex))
+	return &Message{
+		Id:      AllowedFastMsg,
+		Payload: payload,
+	}
+}
+
 func NewChoke() *Message {
 	return &Message{
 		Id:      ChokeMsg,
@@ -179,6 +270,57 @@ func (m *Message) ProcessHaveMsg() (int, error) {
 	return int(binary.BigEndian.Uint32(m.Payload)), nil
 }
 
+// ProcessIndexMsg parses a SUGGEST PIECE or ALLOWED FAST message, which carry
+// a piece index like HAVE
+func (m *Message) ProcessIndexMsg() (int, error) {
+	if m.Id != SuggestPieceMsg && m.Id != AllowedFastMsg {
+		return 0, fmt.Errorf("expected SUGGEST PIECE or ALLOWED FAST message, received Id %d", m.Id)
+	}
+	if len(m.Payload) != 4 {
+		return 0, fmt.Errorf("malformed paylod, length %v\n", len(m.Payload))
+	}
+	return int(binary.BigEndian.Uint32(m.Payload)), nil
+}
+
+// ProcessRequestMsg parses a REQUEST message, or a CANCEL or REJECT REQUEST
+// which have the same payload
+func (m *Message) ProcessRequestMsg() (index, begin, length int, err error) {
+	if m.Id != RequestMsg && m.Id != CancelMsg && m.Id != RejectRequestMsg {
+		return 0, 0, 0, fmt.Errorf("expected REQUEST, CANCEL or REJECT REQUEST message, received Id %d", m.Id)
+	}
+	if len(m.Payload) != 12 {
+		return 0, 0, 0, fmt.Errorf("malformed paylod, length %v\n", len(m.Payload))
+	}
+	index = int(binary.BigEndian.Uint32(m.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(m.Payload[4:8]))
+	length = int(binary.BigEndian.Uint32(m.Payload[8:12]))
+	return index, begin, length, nil
+}
+
+func (m *Message) ProcessPortMsg() (int, error) {
+	if m.Id != PortMsg {
+		return 0, fmt.Errorf("expected PORT message (Id %d), received Id %d", PortMsg, m.Id)
+	}
+	if len(m.Payload) != 2 {
+		return 0, fmt.Errorf("malformed paylod, length %v\n", len(m.Payload))
+	}
+	return int(binary.BigEndian.Uint16(m.Payload)), nil
+}
+
+// ParsePieceMsg returns the piece index, the offset and the data of a PIECE
+// message, block points into the payload
+func (m *Message) ParsePieceMsg() (index, begin int, block []byte, err error) {
+	if m.Id != PieceMsg {
+		return 0, 0, nil, fmt.Errorf("expected PIECE (Id %d), got Id %d", PieceMsg, m.Id)
+	}
+	if len(m.Payload) < 8 {
+		return 0, 0, nil, fmt.Errorf("invalid payload size\n")
+	}
+	index = int(binary.BigEndian.Uint32(m.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(m.Payload[4:8]))
+	return index, begin, m.Payload[8:], nil
+}
+
 func (m *Message) ProcessPieceMsg(index int, data []byte) (int, error) {
 	if m.Id != PieceMsg {
 		return 0, fmt.Errorf("expected PIECE (Id %d), got Id %d", PieceMsg, m.Id)
@@ -226,6 +368,18 @@ func (m *Message) Name() string {
 		return "CancelMsg"
 	case PortMsg:
 		return "PortMsg"
+	case SuggestPieceMsg:
+		return "SuggestPieceMsg"
+	case HaveAllMsg:
+		return "HaveAllMsg"
+	case HaveNoneMsg:
+		return "HaveNoneMsg"
+	case RejectRequestMsg:
+		return "RejectRequestMsg"
+	case AllowedFastMsg:
+		return "AllowedFastMsg"
+	case ExtendedMsg:
+		return "ExtendedMsg"
 	default:
 		return "UnknownMsg"
 	}
@@ -1,8 +1,12 @@
 package peer
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
 	"net"
+	"strconv"
+	"swiftpeer/client/bencode"
 )
 
 // AddrSet type that stores unique addresses
@@ -15,6 +19,13 @@ type Peer struct {
 	PeerId string
 }
 
+// List is the peer list of a tracker response. It decodes both the compact
+// form (6 bytes per peer) and the original list of dictionaries, and it is
+// always encoded in the compact form.
+type List []Peer
+
+const compactPeerSize = 6 // 4 bytes for IP, 2 for Port
+
 func (p Peer) FormatAddress() (string, error) {
 	ip := net.ParseIP(p.IP)
 	if ip == nil {
@@ -30,3 +41,95 @@ func (p Peer) FormatAddress() (string, error) {
 	}
 	return address, nil
 }
+
+// ParseAddress splits a host:port address into a Peer
+func ParseAddress(addr string) (Peer, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return Peer{}, err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p <= 0 || p > 65535 {
+		return Peer{}, fmt.Errorf("invalid port in %s", addr)
+	}
+	return Peer{IP: host, Port: p}, nil
+}
+
+// ParseCompact parses peers in the compact form, ipLen is 4 for IPv4 and
+// 16 for IPv6, each followed by a 2 byte port
+func ParseCompact(data []byte, ipLen int) ([]Peer, error) {
+	size := ipLen + 2
+	if len(data)%size != 0 {
+		return nil, fmt.Errorf("malformed compact peer list, length %d is not a multiple of %d", len(data), size)
+	}
+	peers := make([]Peer, 0, len(data)/size)
+	for i := 0; i < len(data); i += size {
+		peers = append(peers, Peer{
+			IP:   net.IP(data[i : i+ipLen]).String(),
+			Port: int(binary.BigEndian.Uint16(data[i+ipLen : i+size])),
+		})
+	}
+	return peers, nil
+}
+
+// AppendCompact appends p in the compact form of ipLen, it returns false
+// when the ip of the peer is of the other family
+func AppendCompact(dst []byte, p Peer, ipLen int) ([]byte, bool) {
+	ip := net.ParseIP(p.IP)
+	if ipLen == net.IPv4len {
+		ip = ip.To4()
+	} else if ip.To4() != nil {
+		ip = nil
+	}
+	if ip == nil {
+		return dst, false
+	}
+	dst = append(dst, ip...)
+	return binary.BigEndian.AppendUint16(dst, uint16(p.Port)), true
+}
+
+func (l *List) UnmarshalBencode(data []byte) error {
+	decoder := bencode.NewDecoder(bytes.NewReader(data))
+
+	if len(data) > 0 && data[0] == 'l' {
+		var peers []struct {
+			PeerId string `bencode:"peer id"`
+			IP     string `bencode:"ip"`
+			Port   int    `bencode:"port"`
+		}
+		if err := decoder.Decode(&peers); err != nil {
+			return fmt.Errorf("malformed peer list: %w", err)
+		}
+		*l = make(List, 0, len(peers))
+		for _, p := range peers {
+			*l = append(*l, Peer{IP: p.IP, Port: p.Port, PeerId: p.PeerId})
+		}
+		return nil
+	}
+
+	var compact []byte
+	if err := decoder.Decode(&compact); err != nil {
+		return fmt.Errorf("malformed compact peer list: %w", err)
+	}
+	peers, err := ParseCompact(compact, net.IPv4len)
+	if err != nil {
+		return err
+	}
+	*l = peers
+	return nil
+}
+
+func (l List) MarshalBencode() ([]byte, error) {
+	compact := make([]byte, 0, len(l)*compactPeerSize)
+	for _, p := range l {
+		var ok bool
+		if compact, ok = AppendCompact(compact, p, net.IPv4len); !ok {
+			return nil, fmt.Errorf("cannot encode %q in a compact peer list", p.IP)
+		}
+	}
+	var buf bytes.Buffer
+	if err := bencode.NewEncoder(&buf).Encode(compact); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,193 @@
+package peerconn
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"swiftpeer/client/bencode"
+	"swiftpeer/client/common"
+	"swiftpeer/client/message"
+)
+
+// defaultReqq is the number of outstanding requests we advertise to accept
+const defaultReqq = 250
+
+// extMessageLimits guards the decoder against hostile extension messages
+var extMessageLimits = bencode.Options{MaxDepth: 4, MaxStringLen: 1 << 12, MaxBytes: 1 << 16}
+
+// ExtendedHandshake is the dictionary exchanged by the extension protocol
+// (BEP 10) right after the BitTorrent handshake
+type ExtendedHandshake struct {
+	M            map[string]int `bencode:"m"`
+	Version      string         `bencode:"v,omitempty"`
+	Port         int            `bencode:"p,omitempty"`
+	Reqq         int            `bencode:"reqq,omitempty"`
+	YourIP       []byte         `bencode:"yourip,omitempty"`
+	MetadataSize int            `bencode:"metadata_size,omitempty"`
+}
+
+// ExtensionHandler implements one extension of the extension protocol
+type ExtensionHandler interface {
+	// OnHandshake is called once the extended handshake of the peer arrives
+	OnHandshake(pc *PeerConn, hs *ExtendedHandshake) error
+	// HandleExtended is called with the payload of every message the peer
+	// sends for the extension
+	HandleExtended(pc *PeerConn, payload []byte) error
+}
+
+// Extensions is a registry of extension handlers by name. The id we ask peers
+// to use for an extension is its position in registration order, starting at 1.
+type Extensions struct {
+	ListenPort   int // advertised as p, 0 to omit
+	MetadataSize int // size of the info dictionary we can serve, 0 if none
+	DHTPort      int // UDP port of our DHT node sent in a port message, 0 if none
+	NumPieces    int // pieces of the torrent, 0 while the metadata is unknown
+	names        []string
+	handlers     map[string]ExtensionHandler
+}
+
+func NewExtensions() *Extensions {
+	return &Extensions{handlers: make(map[string]ExtensionHandler)}
+}
+
+func (e *Extensions) Register(name string, h ExtensionHandler) {
+	if _, ok := e.handlers[name]; !ok {
+		e.names = append(e.names, name)
+	}
+	e.handlers[name] = h
+}
+
+func (e *Extensions) localId(name string) int {
+	for i, n := range e.names {
+		if n == name {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func (e *Extensions) handlerFor(id byte) (ExtensionHandler, bool) {
+	if id == 0 || int(id) > len(e.names) {
+		return nil, false
+	}
+	return e.handlers[e.names[id-1]], true
+}
+
+func (e *Extensions) handshake(remote net.Addr) *ExtendedHandshake {
+	hs := &ExtendedHandshake{
+		M:            make(map[string]int, len(e.names)),
+		Version:      "swiftpeer " + common.ClientVersion,
+		Port:         e.ListenPort,
+		Reqq:         defaultReqq,
+		MetadataSize: e.MetadataSize,
+	}
+	for _, name := range e.names {
+		hs.M[name] = e.localId(name)
+	}
+	if addr, ok := remote.(*net.TCPAddr); ok {
+		hs.YourIP = addr.IP.To4()
+		if hs.YourIP == nil {
+			hs.YourIP = addr.IP.To16()
+		}
+	}
+	return hs
+}
+
+func (pc *PeerConn) sendExtendedHandshake() error {
+	var buf bytes.Buffer
+	if err := bencode.NewEncoder(&buf).Encode(pc.extensions.handshake(pc.Conn.RemoteAddr())); err != nil {
+		return err
+	}
+	return pc.send(message.NewExtended(0, buf.Bytes()))
+}
+
+// RemoteExtension returns the id the peer assigned to the extension
+func (pc *PeerConn) RemoteExtension(name string) (byte, bool) {
+	pc.extMu.Lock()
+	defer pc.extMu.Unlock()
+	id, ok := pc.remoteExtensions[name]
+	return id, ok
+}
+
+// SupportsExtension reports whether the peer announced the extension
+func (pc *PeerConn) SupportsExtension(name string) bool {
+	_, ok := pc.RemoteExtension(name)
+	return ok
+}
+
+// ListenPort returns the port the peer announced it accepts connections on,
+// 0 when it didn't announce a valid one
+func (pc *PeerConn) ListenPort() int {
+	pc.extMu.Lock()
+	defer pc.extMu.Unlock()
+	if pc.extHandshake == nil || pc.extHandshake.Port <= 0 || pc.extHandshake.Port > 65535 {
+		return 0
+	}
+	return pc.extHandshake.Port
+}
+
+// remoteReqq returns the number of outstanding requests the peer accepts,
+// 0 when it didn't say
+func (pc *PeerConn) remoteReqq() int {
+	pc.extMu.Lock()
+	defer pc.extMu.Unlock()
+	if pc.extHandshake == nil {
+		return 0
+	}
+	return pc.extHandshake.Reqq
+}
+
+// SendExtended sends payload as a message of the named extension, using
+// the id the peer assigned to it
+func (pc *PeerConn) SendExtended(name string, payload []byte) error {
+	id, ok := pc.RemoteExtension(name)
+	if !ok {
+		return fmt.Errorf("peer %v does not support %s", pc.Addr, name)
+	}
+	return pc.send(message.NewExtended(id, payload))
+}
+
+// HandleExtended dispatches an ExtendedMsg to the registered handlers
+func (pc *PeerConn) HandleExtended(m *message.Message) error {
+	if m.Id != message.ExtendedMsg || len(m.Payload) == 0 {
+		return fmt.Errorf("malformed extended message")
+	}
+	id, payload := m.Payload[0], m.Payload[1:]
+
+	if id == 0 {
+		return pc.handleExtendedHandshake(payload)
+	}
+
+	h, ok := pc.extensions.handlerFor(id)
+	if !ok {
+		// not an extension we announced, ignore it
+		return nil
+	}
+	return h.HandleExtended(pc, payload)
+}
+
+func (pc *PeerConn) handleExtendedHandshake(payload []byte) error {
+	hs := new(ExtendedHandshake)
+	if err := bencode.NewDecoderWithOptions(bytes.NewReader(payload), extMessageLimits).Decode(hs); err != nil {
+		return fmt.Errorf("malformed extended handshake: %w", err)
+	}
+
+	// later handshakes may update the ids, 0 disables an extension
+	pc.extMu.Lock()
+	for name, id := range hs.M {
+		if id <= 0 || id > 255 {
+			delete(pc.remoteExtensions, name)
+			continue
+		}
+		pc.remoteExtensions[name] = byte(id)
+	}
+	pc.extHandshake = hs
+	pc.extMu.Unlock()
+
+	for _, name := range pc.extensions.names {
+		if err := pc.extensions.handlers[name].OnHandshake(pc, hs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package peerconn
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"swiftpeer/client/bencode"
+	"swiftpeer/client/message"
+	"sync"
+	"testing"
+)
+
+// recorder is an extension handler remembering what it was given
+type recorder struct {
+	mu         sync.Mutex
+	handshakes int
+	payloads   chan string
+}
+
+func newRecorder() *recorder {
+	return &recorder{payloads: make(chan string, 10)}
+}
+
+func (r *recorder) OnHandshake(pc *PeerConn, hs *ExtendedHandshake) error {
+	r.mu.Lock()
+	r.handshakes++
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *recorder) HandleExtended(pc *PeerConn, payload []byte) error {
+	r.payloads <- string(payload)
+	return nil
+}
+
+// extendedPair connects two peers speaking the extension protocol, each
+// handling the extended messages it receives
+func extendedPair(t *testing.T, a, b *Extensions) (*PeerConn, *PeerConn) {
+	left, right := net.Pipe()
+	pcA := newPeerConn(left, "a", [20]byte{}, a)
+	pcB := newPeerConn(right, "b", [20]byte{}, b)
+	for _, pc := range []*PeerConn{pcA, pcB} {
+		pc.SupportsExtensions = true
+		pc.start(nil)
+		go func(pc *PeerConn) {
+			for m := range pc.Events() {
+				if m.Id == message.ExtendedMsg {
+					if err := pc.HandleExtended(m); err != nil {
+						t.Errorf("HandleExtended() error = %v", err)
+					}
+				}
+			}
+		}(pc)
+		t.Cleanup(func() { pc.Close() })
+	}
+	return pcA, pcB
+}
+
+func TestExtendedHandshake(t *testing.T) {
+	a, b := NewExtensions(), NewExtensions()
+	a.ListenPort = 6881
+	a.MetadataSize = 1234
+	recA, recB := newRecorder(), newRecorder()
+	a.Register("ut_a", newRecorder())
+	a.Register("ut_b", recA)
+	b.Register("ut_b", recB)
+
+	pcA, pcB := extendedPair(t, a, b)
+	waitFor(t, func() bool { return pcA.SupportsExtension("ut_b") && pcB.SupportsExtension("ut_b") })
+
+	// each side uses the ids the other assigned
+	if id, _ := pcA.RemoteExtension("ut_b"); id != 1 {
+		t.Errorf("id of ut_b at b = %d, want 1", id)
+	}
+	if id, _ := pcB.RemoteExtension("ut_b"); id != 2 {
+		t.Errorf("id of ut_b at a = %d, want 2", id)
+	}
+	if pcA.SupportsExtension("ut_a") {
+		t.Errorf("ut_a supported by a peer that didn't announce it")
+	}
+	if got := pcB.ListenPort(); got != 6881 {
+		t.Errorf("ListenPort() = %d, want 6881", got)
+	}
+	if got := pcA.ListenPort(); got != 0 {
+		t.Errorf("ListenPort() = %d without a port announced, want 0", got)
+	}
+	if got := pcB.remoteReqq(); got != defaultReqq {
+		t.Errorf("remoteReqq() = %d, want %d", got, defaultReqq)
+	}
+	pcB.extMu.Lock()
+	hs := *pcB.extHandshake
+	pcB.extMu.Unlock()
+	if hs.MetadataSize != 1234 || !strings.HasPrefix(hs.Version, "swiftpeer") {
+		t.Errorf("handshake of a = %+v", hs)
+	}
+	recB.mu.Lock()
+	if recB.handshakes != 1 {
+		t.Errorf("OnHandshake() called %d times, want 1", recB.handshakes)
+	}
+	recB.mu.Unlock()
+}
+
+func TestExtendedDispatch(t *testing.T) {
+	a, b := NewExtensions(), NewExtensions()
+	other, recA, recB := newRecorder(), newRecorder(), newRecorder()
+	a.Register("ut_a", other)
+	a.Register("ut_b", recA)
+	b.Register("ut_b", recB)
+
+	pcA, pcB := extendedPair(t, a, b)
+	waitFor(t, func() bool { return pcA.SupportsExtension("ut_b") && pcB.SupportsExtension("ut_b") })
+
+	if err := pcA.SendExtended("ut_b", []byte("to b")); err != nil {
+		t.Fatalf("SendExtended() error = %v", err)
+	}
+	if got := <-recB.payloads; got != "to b" {
+		t.Errorf("b received %q", got)
+	}
+	// b sends with id 2, which a registered ut_b under
+	if err := pcB.SendExtended("ut_b", []byte("to a")); err != nil {
+		t.Fatalf("SendExtended() error = %v", err)
+	}
+	if got := <-recA.payloads; got != "to a" {
+		t.Errorf("a received %q", got)
+	}
+	if len(other.payloads) != 0 {
+		t.Errorf("ut_a received a message of ut_b")
+	}
+	if err := pcA.SendExtended("ut_a", []byte("x")); err == nil {
+		t.Errorf("SendExtended() succeeded for an extension the peer didn't announce")
+	}
+
+	// a later handshake disables ut_b with id 0
+	var buf bytes.Buffer
+	if err := bencode.NewEncoder(&buf).Encode(ExtendedHandshake{M: map[string]int{"ut_b": 0}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pcA.HandleExtended(message.NewExtended(0, buf.Bytes())); err != nil {
+		t.Fatalf("HandleExtended() error = %v", err)
+	}
+	if pcA.SupportsExtension("ut_b") {
+		t.Errorf("ut_b still supported once disabled")
+	}
+}
@@ -0,0 +1,47 @@
+package peerconn
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+)
+
+// AllowedFastCount is the number of pieces we let a choked peer request
+const AllowedFastCount = 10
+
+// AllowedFastSet returns the k pieces a peer at ip may request while choked,
+// computed as in BEP 6 so that the peer gets the same set from every
+// connection of the same /24. There is no set for IPv6 addresses.
+func AllowedFastSet(ip net.IP, infoHash [20]byte, numPieces, k int) []int {
+	ip4 := ip.To4()
+	if ip4 == nil || numPieces == 0 {
+		return nil
+	}
+	k = min(k, numPieces)
+
+	x := make([]byte, 0, 24)
+	x = append(x, ip4[0], ip4[1], ip4[2], 0)
+	x = append(x, infoHash[:]...)
+
+	var set []int
+	for len(set) < k {
+		sum := sha1.Sum(x)
+		x = sum[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			index := int(binary.BigEndian.Uint32(x[i*4:]) % uint32(numPieces))
+			if !contains(set, index) {
+				set = append(set, index)
+			}
+		}
+	}
+	return set
+}
+
+func contains(set []int, index int) bool {
+	for _, i := range set {
+		if i == index {
+			return true
+		}
+	}
+	return false
+}
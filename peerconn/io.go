@@ -0,0 +1,158 @@
+package peerconn
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"swiftpeer/client/message"
+	"time"
+)
+
+const (
+	// keepaliveInterval is how long the writer stays silent before sending
+	// a keepalive
+	keepaliveInterval = 2 * time.Minute
+	// IdleTimeout disconnects peers sending nothing, not even keepalives
+	IdleTimeout = 3 * time.Minute
+	// writeTimeout disconnects peers not reading what we send
+	writeTimeout = time.Minute
+	// maxQueuedBytes is the size of the outbound queue above which sending
+	// a piece waits for the writer, so that a slow peer doesn't make us
+	// buffer everything it requested
+	maxQueuedBytes = 1 << 20
+	// eventBuffer is the number of received messages waiting to be handled
+	// before the reader stops reading
+	eventBuffer = 64
+)
+
+var errClosed = errors.New("connection closed")
+
+// Events delivers the messages of the peer, keepalives excepted. It is
+// closed when the connection ends, Err then tells why.
+func (pc *PeerConn) Events() <-chan *message.Message {
+	return pc.events
+}
+
+// Err returns the error that ended the connection, nil while it is open
+func (pc *PeerConn) Err() error {
+	pc.outMu.Lock()
+	defer pc.outMu.Unlock()
+	return pc.err
+}
+
+// Close ends the connection, the messages still queued are dropped
+func (pc *PeerConn) Close() error {
+	pc.closeWithError(errClosed)
+	return nil
+}
+
+func (pc *PeerConn) closeWithError(err error) {
+	pc.outMu.Lock()
+	if pc.err == nil {
+		pc.err = err
+	}
+	pc.outbound = nil
+	pc.outCond.Broadcast()
+	pc.outMu.Unlock()
+
+	pc.closeOnce.Do(func() {
+		close(pc.closed)
+		pc.Conn.Close()
+	})
+}
+
+// send queues a message for the writer
+func (pc *PeerConn) send(m *message.Message) error {
+	data := m.Serialize()
+	pc.outMu.Lock()
+	defer pc.outMu.Unlock()
+	for m != nil && m.Id == message.PieceMsg && pc.queued > maxQueuedBytes && pc.err == nil {
+		pc.outCond.Wait()
+	}
+	if pc.err != nil {
+		return pc.err
+	}
+	pc.outbound = append(pc.outbound, data)
+	pc.queued += len(data)
+
+	select {
+	case pc.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// writeLoop writes the queued messages, everything queued since the last
+// write goes out in a single system call
+func (pc *PeerConn) writeLoop() {
+	keepalive := time.NewTimer(pc.keepaliveInterval)
+	defer keepalive.Stop()
+
+	for {
+		pc.outMu.Lock()
+		batch := pc.outbound
+		pc.outbound = nil
+		pc.queued = 0
+		pc.outCond.Broadcast()
+		pc.outMu.Unlock()
+
+		if len(batch) == 0 {
+			select {
+			case <-pc.wake:
+				continue
+			case <-keepalive.C:
+				batch = [][]byte{message.NewKeepAlive().Serialize()}
+			case <-pc.closed:
+				return
+			}
+		}
+
+		pc.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		buffers := net.Buffers(batch)
+		if _, err := buffers.WriteTo(pc.Conn); err != nil {
+			pc.closeWithError(fmt.Errorf("failed to write to %v: %w", pc.Addr, err))
+			return
+		}
+		keepalive.Reset(pc.keepaliveInterval)
+	}
+}
+
+// readLoop delivers the messages of the peer on the events channel until the
+// connection fails or stays idle for its idle timeout, IdleTimeout by default
+func (pc *PeerConn) readLoop() {
+	defer close(pc.events)
+	maxLength := message.MaxLength(pc.extensions.NumPieces)
+	started := false // a message other than an extension one arrived
+	for {
+		pc.Conn.SetReadDeadline(time.Now().Add(pc.idleTimeout))
+		m, err := message.Read(pc.Conn, maxLength)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				err = fmt.Errorf("peer %v idle for %v", pc.Addr, pc.idleTimeout)
+			}
+			pc.closeWithError(err)
+			return
+		}
+		if m == nil {
+			continue
+		}
+		switch m.Id {
+		case message.BitfieldMsg, message.HaveAllMsg, message.HaveNoneMsg:
+			// only ever the first message
+			if started {
+				pc.closeWithError(fmt.Errorf("%v from %v after the first message", m.Name(), pc.Addr))
+				return
+			}
+		}
+		if m.Id != message.ExtendedMsg {
+			started = true
+		}
+
+		select {
+		case pc.events <- m:
+		case <-pc.closed:
+			return
+		}
+	}
+}
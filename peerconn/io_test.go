@@ -0,0 +1,125 @@
+package peerconn
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"swiftpeer/client/message"
+	"testing"
+	"time"
+)
+
+// queuedMessages returns the number of messages waiting for the writer
+func queuedMessages(pc *PeerConn) int {
+	pc.outMu.Lock()
+	defer pc.outMu.Unlock()
+	return len(pc.outbound)
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("condition not met")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWriterBatches(t *testing.T) {
+	pc, remote := newTestConn(t, 10)
+
+	// the peer doesn't read yet, the writer blocks on the first message
+	pc.SendHave(0)
+	waitFor(t, func() bool { return queuedMessages(pc) == 0 })
+	for i := 1; i < 6; i++ {
+		pc.SendHave(i)
+	}
+	if got := queuedMessages(pc); got != 5 {
+		t.Fatalf("%d messages queued behind the write, want 5", got)
+	}
+
+	var want []byte
+	for i := 0; i < 6; i++ {
+		want = append(want, message.NewHave(i).Serialize()...)
+	}
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(remote, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("peer received %x, want %x", got, want)
+	}
+	waitFor(t, func() bool { return queuedMessages(pc) == 0 })
+}
+
+func TestWriterBackpressure(t *testing.T) {
+	pc, remote := newTestConn(t, 10)
+
+	pc.SendHave(0)
+	waitFor(t, func() bool { return queuedMessages(pc) == 0 })
+	// a piece is queued whatever its size, the next one waits for room
+	if err := pc.SendPiece(0, 0, make([]byte, maxQueuedBytes)); err != nil {
+		t.Fatal(err)
+	}
+	sent := make(chan error, 1)
+	go func() { sent <- pc.SendPiece(1, 0, make([]byte, 100)) }()
+	select {
+	case <-sent:
+		t.Fatalf("SendPiece() didn't wait with %d bytes queued", maxQueuedBytes)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	go io.Copy(io.Discard, remote)
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Errorf("SendPiece() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("SendPiece() still waiting once the peer reads")
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	pc, remote := newTestConn(t, 10, func(pc *PeerConn) { pc.keepaliveInterval = 20 * time.Millisecond })
+
+	// a message postpones the keepalive
+	pc.SendHave(1)
+	start := time.Now()
+	m, err := message.Read(remote, 1<<10)
+	if err != nil || m == nil || m.Id != message.HaveMsg {
+		t.Fatalf("Read() = %v, %v, want the have", m, err)
+	}
+	for i := 0; i < 2; i++ {
+		m, err := message.Read(remote, 1<<10)
+		if err != nil || m != nil {
+			t.Fatalf("Read() = %v, %v, want a keepalive", m, err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("two keepalives within %v", elapsed)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	pc, remote := newTestConn(t, 10, func(pc *PeerConn) { pc.idleTimeout = 100 * time.Millisecond })
+	go io.Copy(io.Discard, remote)
+
+	// keepalives of the peer keep the connection open
+	for i := 0; i < 5; i++ {
+		if _, err := remote.Write(message.NewKeepAlive().Serialize()); err != nil {
+			t.Fatalf("connection closed while the peer sends keepalives: %v", err)
+		}
+		time.Sleep(40 * time.Millisecond)
+	}
+	if err := pc.Err(); err != nil {
+		t.Fatalf("Err() = %v while the peer sends keepalives", err)
+	}
+
+	err := waitClosed(t, pc)
+	if err == nil || !strings.Contains(err.Error(), "idle") {
+		t.Errorf("Err() = %v, want the idle timeout", err)
+	}
+}
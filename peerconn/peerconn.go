@@ -8,18 +8,91 @@ import (
 	"swiftpeer/client/common"
 	"swiftpeer/client/handshake"
 	"swiftpeer/client/message"
+	"sync"
 	"time"
 )
 
+// PeerConn is a connection to a peer. Once set up, a reader goroutine
+// delivers the messages of the peer on Events and a writer goroutine sends
+// the queued messages, so that neither side waits for the other.
 type PeerConn struct {
 	Conn     net.Conn
 	Addr     string
 	InfoHash [20]byte
 	IsChoked bool
 	Pieces   bitfield.Bitfield
+	// SupportsExtensions is set when the peer speaks the extension protocol
+	SupportsExtensions bool
+	// SupportsDHT is set when the peer runs a DHT node
+	SupportsDHT bool
+	// SupportsFast is set when both sides speak the fast extension
+	SupportsFast bool
+	// AllowedFast has the pieces the peer lets us request while choked
+	AllowedFast bitfield.Bitfield
+	// Suggested has the pieces the peer advised us to download, latest last
+	Suggested []int
+	// Incoming is set when the peer connected to us, Addr then has the
+	// ephemeral port of the peer rather than its listen port
+	Incoming bool
+	// ConnectedAt is when the connection was established
+	ConnectedAt time.Time
+
+	extensions *Extensions
+	pipeline   *pipeline
+
+	// the peer may send its extended handshake again at any time, extMu
+	// guards what it updates
+	extMu            sync.Mutex
+	extHandshake     *ExtendedHandshake // the last one received
+	remoteExtensions map[string]byte
+
+	stateMu        sync.Mutex
+	amChoking      bool
+	peerInterested bool
+
+	// keepaliveInterval and idleTimeout are the defaults but in tests
+	keepaliveInterval time.Duration
+	idleTimeout       time.Duration
+
+	events    chan *message.Message
+	outMu     sync.Mutex
+	outCond   *sync.Cond
+	outbound  [][]byte
+	queued    int
+	err       error
+	wake      chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
-func NewPeerConn(addr string, infoHash [20]byte) (*PeerConn, error) {
+func newPeerConn(conn net.Conn, addr string, infoHash [20]byte, ext *Extensions) *PeerConn {
+	pc := &PeerConn{
+		Conn:              conn,
+		Addr:              addr,
+		InfoHash:          infoHash,
+		IsChoked:          true,
+		Pieces:            bitfield.New(ext.NumPieces),
+		extensions:        ext,
+		remoteExtensions:  make(map[string]byte),
+		pipeline:          newPipeline(),
+		amChoking:         true,
+		ConnectedAt:       time.Now(),
+		keepaliveInterval: keepaliveInterval,
+		idleTimeout:       IdleTimeout,
+		events:            make(chan *message.Message, eventBuffer),
+		wake:              make(chan struct{}, 1),
+		closed:            make(chan struct{}),
+	}
+	pc.outCond = sync.NewCond(&pc.outMu)
+	return pc
+}
+
+// NewPeerConn connects and handshakes with the peer. When both sides support
+// the extension protocol, the extended handshake advertises ext, which can be
+// nil when no extension is used. have is sent as our bitfield unless empty.
+// The bitfield of the peer is optional, a peer with no piece may not send
+// one, so it arrives on Events like any other message.
+func NewPeerConn(addr string, infoHash [20]byte, ext *Extensions, have bitfield.Bitfield) (*PeerConn, error) {
 	//address, err := addr.FormatAddress()
 	//if err != nil {
 	//	return nil, err
@@ -31,31 +104,70 @@ func NewPeerConn(addr string, infoHash [20]byte) (*PeerConn, error) {
 		return nil, fmt.Errorf("Failed to connect to  %v. %v\n", addr, err.Error())
 	}
 
-	pc := &PeerConn{
-		Conn:     conn,
-		Addr:     addr,
-		InfoHash: infoHash,
-		IsChoked: true,
-		Pieces:   bitfield.Bitfield{},
+	if ext == nil {
+		ext = NewExtensions()
 	}
 
+	pc := newPeerConn(conn, addr, infoHash, ext)
 	err = pc.doHandshake()
 	if err != nil {
 		conn.Close()
 		return nil, err
 	}
+	pc.start(have)
+	return pc, nil
+}
 
-	err = pc.receiveBitfield()
-	if err != nil {
-		conn.Close()
-		return nil, err
+// Accept completes the handshake of an incoming connection whose handshake hs
+// was already read. have is sent as our bitfield unless empty.
+func Accept(conn net.Conn, hs *handshake.Handshake, ext *Extensions, have bitfield.Bitfield) (*PeerConn, error) {
+	if ext == nil {
+		ext = NewExtensions()
 	}
 
+	pc := newPeerConn(conn, conn.RemoteAddr().String(), hs.InfoHash, ext)
+	pc.Incoming = true
+
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(pc.localHandshake().Serialize()); err != nil {
+		return nil, fmt.Errorf("failed to send handshake to %v: %v", pc.Addr, err)
+	}
+	conn.SetWriteDeadline(time.Time{})
+	pc.SupportsExtensions = hs.HasFlag(handshake.ExtensionProtocol)
+	pc.SupportsDHT = hs.HasFlag(handshake.DHT)
+	pc.SupportsFast = hs.HasFlag(handshake.FastExtension)
+
+	pc.start(have)
 	return pc, nil
 }
 
-func (pc *PeerConn) doHandshake() error {
+// start queues the messages following the handshake and starts the reader
+// and writer goroutines
+func (pc *PeerConn) start(have bitfield.Bitfield) {
+	pc.announcePieces(have)
+	if pc.SupportsExtensions {
+		pc.sendExtendedHandshake()
+	}
+	// the port message must follow the bitfield
+	if pc.SupportsDHT && pc.extensions.DHTPort != 0 {
+		pc.send(message.NewPort(pc.extensions.DHTPort))
+	}
+	go pc.readLoop()
+	go pc.writeLoop()
+}
+
+func (pc *PeerConn) localHandshake() *handshake.Handshake {
 	hs := handshake.NewHandshake(common.GeneratePeerId(), pc.InfoHash)
+	hs.SetFlag(handshake.ExtensionProtocol)
+	hs.SetFlag(handshake.FastExtension)
+	if pc.extensions.DHTPort != 0 {
+		hs.SetFlag(handshake.DHT)
+	}
+	return hs
+}
+
+func (pc *PeerConn) doHandshake() error {
+	hs := pc.localHandshake()
 	pc.Conn.SetDeadline(time.Now().Add(5 * time.Second))
 	defer pc.Conn.SetDeadline(time.Time{})
 	_, err := pc.Conn.Write(hs.Serialize())
@@ -74,60 +186,178 @@ func (pc *PeerConn) doHandshake() error {
 
 		return fmt.Errorf("different info_hash during handshake")
 	}
+	pc.SupportsExtensions = response.HasFlag(handshake.ExtensionProtocol)
+	pc.SupportsDHT = response.HasFlag(handshake.DHT)
+	pc.SupportsFast = response.HasFlag(handshake.FastExtension)
 	fmt.Printf("Successfuly connected to: %v\n", pc.Conn.LocalAddr())
 	return nil
 }
 
-func (pc *PeerConn) receiveBitfield() error {
-	pc.Conn.SetDeadline(time.Now().Add(5 * time.Second))
-	defer pc.Conn.SetDeadline(time.Time{})
-
-	msg, err := message.Read(pc.Conn)
-	if err != nil {
+// SetBitfield replaces the pieces of the peer with the bitfield it sent,
+// which must have a bit per piece and the spare bits of the last byte unset.
+// An invalid bitfield closes the connection.
+func (pc *PeerConn) SetBitfield(bf bitfield.Bitfield) error {
+	if err := pc.checkBitfield(bf); err != nil {
+		pc.closeWithError(err)
 		return err
 	}
+	pc.Pieces = append(bitfield.Bitfield(nil), bf...)
+	return nil
+}
 
-	if msg.Id != message.BitfieldMsg {
-		return fmt.Errorf("expected bitdfield msg but got: %v", msg.Name())
+func (pc *PeerConn) checkBitfield(bf bitfield.Bitfield) error {
+	n := pc.extensions.NumPieces
+	if n == 0 {
+		return nil
+	}
+	if len(bf) != (n+7)/8 {
+		return fmt.Errorf("bitfield of %d bytes for %d pieces", len(bf), n)
+	}
+	for i := n; i < len(bf)*8; i++ {
+		if bf.HasPiece(i) {
+			return fmt.Errorf("bitfield has spare bit %d set", i)
+		}
 	}
-
-	pc.Pieces = msg.Payload
 	return nil
 }
 
+// SetHave records a piece the peer announced, it reports whether the piece
+// is new to us
+func (pc *PeerConn) SetHave(index int) (bool, error) {
+	if n := pc.extensions.NumPieces; n > 0 && index >= n || index < 0 {
+		return false, fmt.Errorf("have for piece %d out of range", index)
+	}
+	if len(pc.Pieces)*8 <= index {
+		// the piece count is unknown, grow as pieces are announced
+		pc.Pieces = append(pc.Pieces, make(bitfield.Bitfield, index/8+1-len(pc.Pieces))...)
+	}
+	if pc.Pieces.HasPiece(index) {
+		return false, nil
+	}
+	pc.Pieces.SetPiece(index)
+	return true, nil
+}
+
+// SetHaveAll records that the peer has every piece, it stays empty while the
+// number of pieces is unknown
+func (pc *PeerConn) SetHaveAll() {
+	n := pc.extensions.NumPieces
+	pc.Pieces = bitfield.New(n)
+	for i := 0; i < n; i++ {
+		pc.Pieces.SetPiece(i)
+	}
+}
+
+func (pc *PeerConn) SetHaveNone() {
+	pc.Pieces = bitfield.New(pc.extensions.NumPieces)
+}
+
+// announcePieces sends our bitfield, replaced by HaveAll or HaveNone when the
+// peer speaks the fast extension. Without it nothing is sent when we have no
+// piece.
+func (pc *PeerConn) announcePieces(have bitfield.Bitfield) error {
+	count := 0
+	for i := 0; i < pc.extensions.NumPieces; i++ {
+		if have.HasPiece(i) {
+			count++
+		}
+	}
+	var m *message.Message
+	switch {
+	case pc.SupportsFast && count == 0:
+		m = message.NewHaveNone()
+	case pc.SupportsFast && count == pc.extensions.NumPieces:
+		m = message.NewHaveAll()
+	case count > 0:
+		m = message.NewBitfield(have)
+	default:
+		return nil
+	}
+	return pc.send(m)
+}
+
 func (pc *PeerConn) SendRequestMsg(pieceIndex, offset, length int) error {
 
 	m, err := message.NewRequest(pieceIndex, offset, length)
 	if err != nil {
 		return err
 	}
-	_, err = pc.Conn.Write(m.Serialize())
-	return err
+	pc.pipeline.requestSent(pieceIndex, offset)
+	return pc.send(m)
+}
+
+func (pc *PeerConn) SendCancel(pieceIndex, offset, length int) error {
+	pc.pipeline.requestCancelled(pieceIndex, offset)
+	return pc.send(message.NewCancel(pieceIndex, offset, length))
 }
 
 func (pc *PeerConn) SendInterested() error {
-	_, err := pc.Conn.Write(message.NewInterested().Serialize())
-	return err
+	return pc.send(message.NewInterested())
 }
 
 func (pc *PeerConn) SendNotInterested() error {
-	_, err := pc.Conn.Write(message.NewNotInterested().Serialize())
-	return err
+	return pc.send(message.NewNotInterested())
 }
 
 func (pc *PeerConn) SendUnchoke() error {
-	_, err := pc.Conn.Write(message.NewUnchoke().Serialize())
-	return err
+	pc.stateMu.Lock()
+	pc.amChoking = false
+	pc.stateMu.Unlock()
+	return pc.send(message.NewUnchoke())
 }
 
-func (pc *PeerConn) SendHave(index int) error {
-	_, err := pc.Conn.Write(message.NewHave(index).Serialize())
+func (pc *PeerConn) SendChoke() error {
+	pc.stateMu.Lock()
+	pc.amChoking = true
+	pc.stateMu.Unlock()
+	return pc.send(message.NewChoke())
+}
+
+// AmChoking reports whether we choke the peer, which starts choked
+func (pc *PeerConn) AmChoking() bool {
+	pc.stateMu.Lock()
+	defer pc.stateMu.Unlock()
+	return pc.amChoking
+}
+
+// PeerInterested reports whether the peer wants pieces we have
+func (pc *PeerConn) PeerInterested() bool {
+	pc.stateMu.Lock()
+	defer pc.stateMu.Unlock()
+	return pc.peerInterested
+}
+
+func (pc *PeerConn) SetPeerInterested(interested bool) {
+	pc.stateMu.Lock()
+	pc.peerInterested = interested
+	pc.stateMu.Unlock()
+}
+
+func (pc *PeerConn) SendBitfield(bf bitfield.Bitfield) error {
+	return pc.send(message.NewBitfield(bf))
+}
+
+func (pc *PeerConn) SendPiece(index, begin int, block []byte) error {
+	err := pc.send(message.NewPiece(index, begin, block))
+	if err == nil {
+		pc.pipeline.uploaded(len(block))
+	}
 	return err
 }
 
-func (pc *PeerConn) Read() (*message.Message, error) {
-	if pc == nil {
-		return nil, fmt.Errorf("error:connection closed")
+// SendReject refuses a request of the peer, only when it speaks the fast
+// extension
+func (pc *PeerConn) SendReject(index, begin, length int) error {
+	if !pc.SupportsFast {
+		return nil
 	}
-	return message.Read(pc.Conn)
+	return pc.send(message.NewReject(index, begin, length))
+}
+
+func (pc *PeerConn) SendAllowedFast(index int) error {
+	return pc.send(message.NewAllowedFast(index))
+}
+
+func (pc *PeerConn) SendHave(index int) error {
+	return pc.send(message.NewHave(index))
 }
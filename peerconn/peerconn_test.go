@@ -0,0 +1,186 @@
+package peerconn
+
+import (
+	"bytes"
+	"net"
+	"swiftpeer/client/bitfield"
+	"swiftpeer/client/message"
+	"testing"
+	"time"
+)
+
+// newTestConn returns a connection for a torrent of numPieces pieces, started
+// once configure ran, and the end of the peer
+func newTestConn(t *testing.T, numPieces int, configure ...func(pc *PeerConn)) (*PeerConn, net.Conn) {
+	local, remote := net.Pipe()
+	ext := NewExtensions()
+	ext.NumPieces = numPieces
+	pc := newPeerConn(local, "pipe", [20]byte{}, ext)
+	for _, f := range configure {
+		f(pc)
+	}
+	pc.start(nil)
+	t.Cleanup(func() {
+		pc.Close()
+		remote.Close()
+	})
+	return pc, remote
+}
+
+// waitClosed waits for the events of pc to end and returns why they did
+func waitClosed(t *testing.T, pc *PeerConn) error {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-pc.Events():
+			if !ok {
+				return pc.Err()
+			}
+		case <-timeout:
+			t.Fatalf("connection still open")
+		}
+	}
+}
+
+// receive returns the number of messages delivered by pc, up to n, until
+// the connection ends or nothing arrives for a while
+func receive(pc *PeerConn, n int) int {
+	got := 0
+	for got < n {
+		select {
+		case _, ok := <-pc.Events():
+			if !ok {
+				return got
+			}
+			got++
+		case <-time.After(time.Second):
+			return got
+		}
+	}
+	return got
+}
+
+func TestSetBitfield(t *testing.T) {
+	tests := []struct {
+		name    string
+		bf      bitfield.Bitfield
+		wantErr bool
+	}{
+		{
+			name: "Every piece",
+			bf:   bitfield.Bitfield{0xff, 0xc0},
+		},
+		{
+			name: "No piece",
+			bf:   bitfield.Bitfield{0x00, 0x00},
+		},
+		{
+			name:    "Too short",
+			bf:      bitfield.Bitfield{0xff},
+			wantErr: true,
+		},
+		{
+			name:    "Too long",
+			bf:      bitfield.Bitfield{0xff, 0xc0, 0x00},
+			wantErr: true,
+		},
+		{
+			name:    "Spare bit set",
+			bf:      bitfield.Bitfield{0xff, 0xe0},
+			wantErr: true,
+		},
+		{
+			name:    "Last spare bit set",
+			bf:      bitfield.Bitfield{0x00, 0x01},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pc, _ := newTestConn(t, 10)
+			err := pc.SetBitfield(tt.bf)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SetBitfield() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if waitClosed(t, pc) == nil {
+					t.Errorf("connection closed without an error")
+				}
+				if !bytes.Equal(pc.Pieces, bitfield.New(10)) {
+					t.Errorf("Pieces = %08b after an invalid bitfield", pc.Pieces)
+				}
+				return
+			}
+			if !bytes.Equal(pc.Pieces, tt.bf) || pc.Err() != nil {
+				t.Errorf("Pieces = %08b, Err() = %v, want %08b", pc.Pieces, pc.Err(), tt.bf)
+			}
+		})
+	}
+}
+
+func TestBitfieldFirst(t *testing.T) {
+	bf := message.NewBitfield(bitfield.Bitfield{0xff, 0xc0})
+	tests := []struct {
+		name     string
+		messages []*message.Message
+		want     int // messages delivered
+		wantErr  bool
+	}{
+		{
+			name:     "Bitfield first",
+			messages: []*message.Message{bf, message.NewHave(3), message.NewUnchoke()},
+			want:     3,
+		},
+		{
+			name:     "After the extended handshake",
+			messages: []*message.Message{message.NewExtended(0, []byte("de")), bf},
+			want:     2,
+		},
+		{
+			name:     "Keepalive first",
+			messages: []*message.Message{nil, message.NewHaveAll()},
+			want:     1,
+		},
+		{
+			name:     "Bitfield after a have",
+			messages: []*message.Message{message.NewHave(3), bf},
+			want:     1,
+			wantErr:  true,
+		},
+		{
+			name:     "Have none after unchoke",
+			messages: []*message.Message{message.NewUnchoke(), message.NewHaveNone()},
+			want:     1,
+			wantErr:  true,
+		},
+		{
+			name:     "Second bitfield",
+			messages: []*message.Message{bf, bf},
+			want:     1,
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pc, remote := newTestConn(t, 10)
+			go func() {
+				for _, m := range tt.messages {
+					if _, err := remote.Write(m.Serialize()); err != nil {
+						return
+					}
+				}
+			}()
+
+			got := receive(pc, len(tt.messages))
+			if got != tt.want {
+				t.Errorf("%d messages delivered, want %d", got, tt.want)
+			}
+			if err := pc.Err(); (err != nil) != tt.wantErr {
+				t.Errorf("Err() = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
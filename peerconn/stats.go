@@ -0,0 +1,171 @@
+package peerconn
+
+import (
+	"math"
+	"swiftpeer/client/common"
+	"sync"
+	"time"
+)
+
+const (
+	// initialQueueDepth is the number of requests kept in flight before
+	// anything was measured
+	initialQueueDepth = 5
+	minQueueDepth     = 2
+	// unadvertisedReqq bounds the queue of peers not sending reqq
+	unadvertisedReqq = 64
+	// rateInterval is the period over which a throughput sample is taken
+	rateInterval = time.Second
+	// minRTTWindow is how long an RTT sample is remembered as the minimum
+	minRTTWindow = 10 * time.Second
+	// queueSlack is added to the bandwidth-delay product so that the
+	// queue doesn't drain while the next request is on its way
+	queueSlack = 2
+)
+
+// Stats are the transfer statistics of a connection
+type Stats struct {
+	Downloaded   int64         // payload bytes received
+	Uploaded     int64         // payload bytes sent
+	DownloadRate float64       // bytes per second, smoothed
+	RTT          time.Duration // smoothed time between a request and its block
+	QueueDepth   int           // requests kept in flight
+}
+
+type blockKey struct {
+	index, begin int
+}
+
+// pipeline sizes the request queue of a connection from the bandwidth-delay
+// product of the peer. The smoothed RTT includes the time blocks wait in the
+// queue of the peer, which grows with our queue, so the product uses the
+// minimum RTT seen recently instead.
+type pipeline struct {
+	mu          sync.Mutex
+	stats       Stats
+	sentAt      map[blockKey]time.Time
+	windowStart time.Time
+	windowBytes int64
+	minRTT      [2]time.Duration // minimum of the current and previous windows
+	minRTTStart time.Time
+	now         func() time.Time
+}
+
+func newPipeline() *pipeline {
+	return &pipeline{
+		stats:  Stats{QueueDepth: initialQueueDepth},
+		sentAt: make(map[blockKey]time.Time),
+		now:    time.Now,
+	}
+}
+
+func (p *pipeline) requestSent(index, begin int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sentAt[blockKey{index, begin}] = p.now()
+	if p.windowStart.IsZero() {
+		p.windowStart = p.now()
+	}
+}
+
+func (p *pipeline) requestCancelled(index, begin int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.sentAt, blockKey{index, begin})
+}
+
+func (p *pipeline) clearRequests() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	clear(p.sentAt)
+}
+
+func (p *pipeline) blockReceived(index, begin, length int, reqq int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+
+	p.stats.Downloaded += int64(length)
+	if sent, ok := p.sentAt[blockKey{index, begin}]; ok {
+		delete(p.sentAt, blockKey{index, begin})
+		sample := now.Sub(sent)
+		if p.stats.RTT == 0 {
+			p.stats.RTT = sample
+		} else {
+			// same smoothing as the TCP retransmission timer
+			p.stats.RTT += (sample - p.stats.RTT) / 8
+		}
+
+		if now.Sub(p.minRTTStart) > minRTTWindow {
+			p.minRTT = [2]time.Duration{0, p.minRTT[0]}
+			p.minRTTStart = now
+		}
+		if p.minRTT[0] == 0 || sample < p.minRTT[0] {
+			p.minRTT[0] = sample
+		}
+	}
+
+	if p.windowStart.IsZero() {
+		p.windowStart = now
+	}
+	p.windowBytes += int64(length)
+	if elapsed := now.Sub(p.windowStart); elapsed >= rateInterval {
+		sample := float64(p.windowBytes) / elapsed.Seconds()
+		if p.stats.DownloadRate == 0 {
+			p.stats.DownloadRate = sample
+		} else {
+			p.stats.DownloadRate = 0.7*p.stats.DownloadRate + 0.3*sample
+		}
+		p.windowStart = now
+		p.windowBytes = 0
+	}
+
+	rtt := p.minRTT[0]
+	if p.minRTT[1] != 0 && p.minRTT[1] < rtt {
+		rtt = p.minRTT[1]
+	}
+	if p.stats.DownloadRate > 0 && rtt > 0 {
+		bdp := p.stats.DownloadRate * rtt.Seconds() / common.BlockSize
+		depth := int(math.Ceil(bdp)) + queueSlack
+		if reqq <= 0 {
+			reqq = unadvertisedReqq
+		}
+		p.stats.QueueDepth = max(minQueueDepth, min(depth, reqq))
+	}
+}
+
+func (p *pipeline) uploaded(length int) {
+	p.mu.Lock()
+	p.stats.Uploaded += int64(length)
+	p.mu.Unlock()
+}
+
+// BlockReceived updates the throughput and RTT of the peer with a block it
+// sent, and resizes the request queue accordingly
+func (pc *PeerConn) BlockReceived(index, begin, length int) {
+	pc.pipeline.blockReceived(index, begin, length, pc.remoteReqq())
+}
+
+// ClearRequests forgets the requests in flight, the peer discards them when
+// it chokes us unless it speaks the fast extension
+func (pc *PeerConn) ClearRequests() {
+	pc.pipeline.clearRequests()
+}
+
+// RequestRejected forgets a request the peer refused to serve
+func (pc *PeerConn) RequestRejected(index, begin int) {
+	pc.pipeline.requestCancelled(index, begin)
+}
+
+// QueueDepth is the number of requests to keep in flight with the peer
+func (pc *PeerConn) QueueDepth() int {
+	pc.pipeline.mu.Lock()
+	defer pc.pipeline.mu.Unlock()
+	return pc.pipeline.stats.QueueDepth
+}
+
+func (pc *PeerConn) Stats() Stats {
+	pc.pipeline.mu.Lock()
+	defer pc.pipeline.mu.Unlock()
+	return pc.pipeline.stats
+}
@@ -0,0 +1,135 @@
+package peerconn
+
+import (
+	"swiftpeer/client/common"
+	"testing"
+	"time"
+)
+
+// clock is a fake time advanced by the tests
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time { return c.t }
+
+func (c *clock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestPipeline() (*pipeline, *clock) {
+	c := &clock{t: time.Unix(1000, 0)}
+	p := newPipeline()
+	p.now = c.now
+	return p, c
+}
+
+// transfer receives a block every rtt for as long as the rate interval, each
+// requested when the previous one arrived, at rate bytes per second
+func transfer(p *pipeline, c *clock, rate float64, rtt time.Duration, reqq int) {
+	length := int(rate * rtt.Seconds())
+	for i := 0; time.Duration(i)*rtt < rateInterval; i++ {
+		p.requestSent(i, 0)
+		c.advance(rtt)
+		p.blockReceived(i, 0, length, reqq)
+	}
+}
+
+func TestQueueDepth(t *testing.T) {
+	tests := []struct {
+		name string
+		rate float64 // bytes per second
+		rtt  time.Duration
+		reqq int
+		want int
+	}{
+		{
+			name: "Bandwidth-delay product",
+			rate: 64 * common.BlockSize,
+			rtt:  100 * time.Millisecond,
+			reqq: 250,
+			want: 7 + queueSlack, // 6.4 blocks in flight
+		},
+		{
+			name: "Grows with the rate",
+			rate: 256 * common.BlockSize,
+			rtt:  100 * time.Millisecond,
+			reqq: 250,
+			want: 26 + queueSlack,
+		},
+		{
+			name: "Clamped to reqq",
+			rate: 256 * common.BlockSize,
+			rtt:  100 * time.Millisecond,
+			reqq: 20,
+			want: 20,
+		},
+		{
+			name: "Clamped without reqq",
+			rate: 1024 * common.BlockSize,
+			rtt:  100 * time.Millisecond,
+			reqq: 0,
+			want: unadvertisedReqq,
+		},
+		{
+			name: "Never below the minimum",
+			rate: 1024,
+			rtt:  10 * time.Millisecond,
+			reqq: 1,
+			want: minQueueDepth,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, c := newTestPipeline()
+			if got := p.stats.QueueDepth; got != initialQueueDepth {
+				t.Fatalf("initial QueueDepth = %d, want %d", got, initialQueueDepth)
+			}
+			transfer(p, c, tt.rate, tt.rtt, tt.reqq)
+			if got := p.stats.QueueDepth; got != tt.want {
+				t.Errorf("QueueDepth = %d, want %d (rate %.0f, rtt %v)", got, tt.want, p.stats.DownloadRate, p.stats.RTT)
+			}
+		})
+	}
+}
+
+func TestQueueDepthBeforeRate(t *testing.T) {
+	p, c := newTestPipeline()
+	p.requestSent(0, 0)
+	c.advance(100 * time.Millisecond)
+	p.blockReceived(0, 0, common.BlockSize, 250)
+	if got := p.stats.QueueDepth; got != initialQueueDepth {
+		t.Errorf("QueueDepth = %d before a rate was measured, want %d", got, initialQueueDepth)
+	}
+	if got := p.stats.RTT; got != 100*time.Millisecond {
+		t.Errorf("RTT = %v, want 100ms", got)
+	}
+}
+
+func TestMinRTTWindow(t *testing.T) {
+	p, c := newTestPipeline()
+	sample := func(index int, rtt time.Duration) {
+		p.requestSent(index, 0)
+		c.advance(rtt)
+		p.blockReceived(index, 0, common.BlockSize, 250)
+	}
+
+	sample(0, 50*time.Millisecond)
+	sample(1, 80*time.Millisecond)
+	if want := [2]time.Duration{50 * time.Millisecond, 0}; p.minRTT != want {
+		t.Fatalf("minRTT = %v, want %v", p.minRTT, want)
+	}
+
+	// the previous window is still remembered
+	c.advance(minRTTWindow)
+	sample(2, 200*time.Millisecond)
+	if want := [2]time.Duration{200 * time.Millisecond, 50 * time.Millisecond}; p.minRTT != want {
+		t.Fatalf("minRTT = %v after a window, want %v", p.minRTT, want)
+	}
+
+	// and forgotten one window later
+	c.advance(minRTTWindow)
+	sample(3, 300*time.Millisecond)
+	if want := [2]time.Duration{300 * time.Millisecond, 200 * time.Millisecond}; p.minRTT != want {
+		t.Fatalf("minRTT = %v after two windows, want %v", p.minRTT, want)
+	}
+}
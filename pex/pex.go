@@ -0,0 +1,213 @@
+package pex
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"swiftpeer/client/bencode"
+	"swiftpeer/client/peer"
+	"swiftpeer/client/peerconn"
+	"sync"
+	"time"
+)
+
+// Name is the name of the extension in the extended handshake
+const Name = "ut_pex"
+
+// Flags describing a peer in added.f and added6.f
+const (
+	FlagEncryption = 0x01
+	FlagSeed       = 0x02
+	FlagUTP        = 0x04
+	FlagHolepunch  = 0x08
+	FlagReachable  = 0x10
+)
+
+const (
+	// Interval is how often peer lists are exchanged, BEP 11 asks for
+	// at most one message per minute
+	Interval = time.Minute
+	// minInterval is the least time between two messages either way, it
+	// leaves some slack for timer jitter
+	minInterval = 45 * time.Second
+	// maxAdded is the most peers sent or accepted in a single message
+	maxAdded = 50
+)
+
+// messageLimits guards the decoder against hostile messages, a message holds
+// at most a few hundred compact peers
+var messageLimits = bencode.Options{MaxDepth: 2, MaxStringLen: 1 << 12, MaxBytes: 1 << 15}
+
+type pexMsg struct {
+	Added    []byte `bencode:"added,omitempty"`
+	AddedF   []byte `bencode:"added.f,omitempty"`
+	Added6   []byte `bencode:"added6,omitempty"`
+	Added6F  []byte `bencode:"added6.f,omitempty"`
+	Dropped  []byte `bencode:"dropped,omitempty"`
+	Dropped6 []byte `bencode:"dropped6,omitempty"`
+}
+
+// connState is what we know about the pex exchange with one peer
+type connState struct {
+	sent     map[string]struct{} // peers the remote already knows from us
+	lastSent time.Time
+	lastRecv time.Time
+}
+
+// Handler implements ut_pex. It is shared by every connection of a torrent
+// and hands the peers it learns to OnPeers.
+type Handler struct {
+	// OnPeers receives the addresses learned from a peer, it must not block
+	OnPeers func(addrs []string)
+
+	mu    sync.Mutex
+	conns map[*peerconn.PeerConn]*connState
+	now   func() time.Time
+}
+
+func NewHandler(onPeers func(addrs []string)) *Handler {
+	return &Handler{
+		OnPeers: onPeers,
+		conns:   make(map[*peerconn.PeerConn]*connState),
+		now:     time.Now,
+	}
+}
+
+func (h *Handler) state(pc *peerconn.PeerConn) *connState {
+	s, ok := h.conns[pc]
+	if !ok {
+		s = &connState{sent: make(map[string]struct{})}
+		h.conns[pc] = s
+	}
+	return s
+}
+
+func (h *Handler) OnHandshake(pc *peerconn.PeerConn, hs *peerconn.ExtendedHandshake) error {
+	return nil
+}
+
+func (h *Handler) HandleExtended(pc *peerconn.PeerConn, payload []byte) error {
+	h.mu.Lock()
+	s := h.state(pc)
+	now := h.now()
+	tooSoon := !s.lastRecv.IsZero() && now.Sub(s.lastRecv) < minInterval
+	s.lastRecv = now
+	h.mu.Unlock()
+
+	if tooSoon {
+		// a peer flooding us with peer lists is ignored rather than dropped
+		return nil
+	}
+
+	var msg pexMsg
+	if err := bencode.NewDecoderWithOptions(bytes.NewReader(payload), messageLimits).Decode(&msg); err != nil {
+		return fmt.Errorf("malformed %s message: %w", Name, err)
+	}
+
+	added, err := peer.ParseCompact(msg.Added, net.IPv4len)
+	if err != nil {
+		return err
+	}
+	added6, err := peer.ParseCompact(msg.Added6, net.IPv6len)
+	if err != nil {
+		return err
+	}
+
+	var addrs []string
+	for _, p := range append(added, added6...) {
+		if len(addrs) == maxAdded {
+			break
+		}
+		if p.Port == 0 {
+			continue
+		}
+		if addr, err := p.FormatAddress(); err == nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) > 0 && h.OnPeers != nil {
+		h.OnPeers(addrs)
+	}
+	return nil
+}
+
+// Send tells the peer which of the connected peers were added or dropped
+// since the last message it received from us. Nothing is sent within a
+// minute of that message, the changes wait for the next call.
+func (h *Handler) Send(pc *peerconn.PeerConn, connected []string) error {
+	// the peer may disable ut_pex with a later handshake, SendExtended
+	// checks again
+	if _, ok := pc.RemoteExtension(Name); !ok {
+		return nil
+	}
+
+	h.mu.Lock()
+	s := h.state(pc)
+	now := h.now()
+	if !s.lastSent.IsZero() && now.Sub(s.lastSent) < minInterval {
+		h.mu.Unlock()
+		return nil
+	}
+	current := make(map[string]struct{}, len(connected))
+	var msg pexMsg
+	addedCount := 0
+	for _, addr := range connected {
+		current[addr] = struct{}{}
+		if _, ok := s.sent[addr]; ok || addr == pc.Addr || addedCount == maxAdded {
+			continue
+		}
+		p, err := peer.ParseAddress(addr)
+		if err != nil {
+			continue
+		}
+		// we only list peers we managed to connect to
+		if buf, ok := peer.AppendCompact(msg.Added, p, net.IPv4len); ok {
+			msg.Added = buf
+			msg.AddedF = append(msg.AddedF, FlagReachable)
+		} else if buf, ok := peer.AppendCompact(msg.Added6, p, net.IPv6len); ok {
+			msg.Added6 = buf
+			msg.Added6F = append(msg.Added6F, FlagReachable)
+		} else {
+			continue
+		}
+		s.sent[addr] = struct{}{}
+		addedCount++
+	}
+	for addr := range s.sent {
+		if _, ok := current[addr]; ok {
+			continue
+		}
+		delete(s.sent, addr)
+		p, err := peer.ParseAddress(addr)
+		if err != nil {
+			continue
+		}
+		if buf, ok := peer.AppendCompact(msg.Dropped, p, net.IPv4len); ok {
+			msg.Dropped = buf
+		} else if buf, ok := peer.AppendCompact(msg.Dropped6, p, net.IPv6len); ok {
+			msg.Dropped6 = buf
+		}
+	}
+	empty := len(msg.Added) == 0 && len(msg.Added6) == 0 && len(msg.Dropped) == 0 && len(msg.Dropped6) == 0
+	if !empty {
+		s.lastSent = now
+	}
+	h.mu.Unlock()
+
+	if empty {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if err := bencode.NewEncoder(&buf).Encode(msg); err != nil {
+		return err
+	}
+	return pc.SendExtended(Name, buf.Bytes())
+}
+
+// Forget releases the state kept for a closed connection
+func (h *Handler) Forget(pc *peerconn.PeerConn) {
+	h.mu.Lock()
+	delete(h.conns, pc)
+	h.mu.Unlock()
+}
@@ -0,0 +1,295 @@
+package pex
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"swiftpeer/client/bencode"
+	"swiftpeer/client/handshake"
+	"swiftpeer/client/message"
+	"swiftpeer/client/peer"
+	"swiftpeer/client/peerconn"
+	"testing"
+	"time"
+)
+
+// remoteId is the id the peer assigns to ut_pex
+const remoteId = 5
+
+// clock is a fake time advanced by the tests
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time { return c.t }
+
+func (c *clock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestHandler(onPeers func(addrs []string)) (*Handler, *clock) {
+	c := &clock{t: time.Unix(1000, 0)}
+	h := NewHandler(onPeers)
+	h.now = c.now
+	return h, c
+}
+
+// encode returns the bencoded msg
+func encode(t *testing.T, msg pexMsg) []byte {
+	var buf bytes.Buffer
+	if err := bencode.NewEncoder(&buf).Encode(msg); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// compact returns the compact form of addrs, all of the same family
+func compact(t *testing.T, ipLen int, addrs ...string) []byte {
+	var buf []byte
+	for _, addr := range addrs {
+		p, err := peer.ParseAddress(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ok bool
+		if buf, ok = peer.AppendCompact(buf, p, ipLen); !ok {
+			t.Fatalf("AppendCompact(%s) failed", addr)
+		}
+	}
+	return buf
+}
+
+// pexConn connects h to a peer that announces ut_pex as remoteId, and
+// returns the connection and the end of the peer
+func pexConn(t *testing.T, h *Handler) (*peerconn.PeerConn, net.Conn) {
+	local, remote := net.Pipe()
+	ext := peerconn.NewExtensions()
+	ext.Register(Name, h)
+	hs := handshake.NewHandshake([20]byte{1}, [20]byte{})
+	hs.SetFlag(handshake.ExtensionProtocol)
+	go hs.Deserialize(remote)
+	pc, err := peerconn.Accept(local, hs, ext, nil)
+	if err != nil {
+		t.Fatalf("Accept() error = %v", err)
+	}
+	t.Cleanup(func() {
+		pc.Close()
+		remote.Close()
+	})
+	go func() {
+		for m := range pc.Events() {
+			if m.Id == message.ExtendedMsg {
+				pc.HandleExtended(m)
+			}
+		}
+	}()
+
+	if m, err := message.Read(remote, 1<<12); err != nil || m.Id != message.ExtendedMsg {
+		t.Fatalf("Read() = %v, %v, want the extended handshake", m, err)
+	}
+	var buf bytes.Buffer
+	if err := bencode.NewEncoder(&buf).Encode(peerconn.ExtendedHandshake{M: map[string]int{Name: remoteId}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := remote.Write(message.NewExtended(0, buf.Bytes()).Serialize()); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !pc.SupportsExtension(Name) {
+		if time.Now().After(deadline) {
+			t.Fatalf("extended handshake not received")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return pc, remote
+}
+
+// readPex returns the next ut_pex message received by the peer
+func readPex(t *testing.T, remote net.Conn) pexMsg {
+	t.Helper()
+	m, err := message.Read(remote, 1<<16)
+	if err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	if m == nil || m.Id != message.ExtendedMsg || len(m.Payload) == 0 || m.Payload[0] != remoteId {
+		t.Fatalf("Read() = %v, want a %s message", m, Name)
+	}
+	var msg pexMsg
+	if err := bencode.NewDecoder(bytes.NewReader(m.Payload[1:])).Decode(&msg); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	return msg
+}
+
+func TestSend(t *testing.T) {
+	h, c := newTestHandler(nil)
+	pc, remote := pexConn(t, h)
+
+	v4, v6 := "10.0.0.1:6881", "[2001:db8::1]:51413"
+	if err := h.Send(pc, []string{v4, v6, pc.Addr}); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	want := pexMsg{
+		Added:   compact(t, net.IPv4len, v4),
+		AddedF:  []byte{FlagReachable},
+		Added6:  compact(t, net.IPv6len, v6),
+		Added6F: []byte{FlagReachable},
+	}
+	if got := readPex(t, remote); !reflect.DeepEqual(got, want) {
+		t.Errorf("first message = %+v, want %+v", got, want)
+	}
+
+	// too soon, the changes wait for the next message
+	c.advance(time.Second)
+	v4b := "10.0.0.2:6882"
+	if err := h.Send(pc, []string{v4, v4b}); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	c.advance(Interval)
+	if err := h.Send(pc, []string{v4, v4b}); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	want = pexMsg{
+		Added:    compact(t, net.IPv4len, v4b),
+		AddedF:   []byte{FlagReachable},
+		Dropped6: compact(t, net.IPv6len, v6),
+	}
+	if got := readPex(t, remote); !reflect.DeepEqual(got, want) {
+		t.Errorf("second message = %+v, want %+v", got, want)
+	}
+
+	// nothing changed, nothing is sent and the next change goes out at once
+	c.advance(Interval)
+	if err := h.Send(pc, []string{v4, v4b}); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	c.advance(Interval)
+	if err := h.Send(pc, []string{v4b}); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	want = pexMsg{Dropped: compact(t, net.IPv4len, v4)}
+	if got := readPex(t, remote); !reflect.DeepEqual(got, want) {
+		t.Errorf("third message = %+v, want %+v", got, want)
+	}
+}
+
+func TestSendLimit(t *testing.T) {
+	h, _ := newTestHandler(nil)
+	pc, remote := pexConn(t, h)
+
+	var connected []string
+	for i := 0; i < maxAdded+10; i++ {
+		connected = append(connected, net.JoinHostPort(net.IPv4(10, 0, 1, byte(i)).String(), "6881"))
+	}
+	if err := h.Send(pc, connected); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	msg := readPex(t, remote)
+	if len(msg.Added) != maxAdded*6 || len(msg.AddedF) != maxAdded {
+		t.Errorf("%d bytes of peers and %d flags sent, want %d peers", len(msg.Added), len(msg.AddedF), maxAdded)
+	}
+}
+
+func TestHandleExtended(t *testing.T) {
+	var many []string
+	for i := 0; i < maxAdded+10; i++ {
+		many = append(many, net.JoinHostPort(net.IPv4(10, 0, 1, byte(i)).String(), "6881"))
+	}
+
+	tests := []struct {
+		name    string
+		payload func(t *testing.T) []byte
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "IPv4 and IPv6",
+			payload: func(t *testing.T) []byte {
+				return encode(t, pexMsg{
+					Added:   compact(t, net.IPv4len, "10.0.0.1:6881"),
+					AddedF:  []byte{FlagSeed | FlagReachable},
+					Added6:  compact(t, net.IPv6len, "[2001:db8::1]:51413"),
+					Added6F: []byte{FlagUTP},
+				})
+			},
+			want: []string{"10.0.0.1:6881", "[2001:db8::1]:51413"},
+		},
+		{
+			name: "Dropped only",
+			payload: func(t *testing.T) []byte {
+				return encode(t, pexMsg{Dropped: compact(t, net.IPv4len, "10.0.0.1:6881")})
+			},
+		},
+		{
+			name: "Port zero skipped",
+			payload: func(t *testing.T) []byte {
+				return encode(t, pexMsg{Added: append(compact(t, net.IPv4len, "10.0.0.1:6881"), 10, 0, 0, 2, 0, 0)})
+			},
+			want: []string{"10.0.0.1:6881"},
+		},
+		{
+			name: "Too many peers",
+			payload: func(t *testing.T) []byte {
+				return encode(t, pexMsg{Added: compact(t, net.IPv4len, many...)})
+			},
+			want: many[:maxAdded],
+		},
+		{
+			name: "Truncated peer",
+			payload: func(t *testing.T) []byte {
+				return encode(t, pexMsg{Added: []byte{10, 0, 0, 1, 0x1a}})
+			},
+			wantErr: true,
+		},
+		{
+			name:    "Not bencode",
+			payload: func(t *testing.T) []byte { return []byte("added") },
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			h, _ := newTestHandler(func(addrs []string) { got = addrs })
+			err := h.HandleExtended(&peerconn.PeerConn{}, tt.payload(t))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("HandleExtended() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("peers = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReceiveLimit(t *testing.T) {
+	var got []string
+	h, c := newTestHandler(func(addrs []string) { got = append(got, addrs...) })
+	pc := &peerconn.PeerConn{}
+	send := func(addr string) {
+		t.Helper()
+		payload := encode(t, pexMsg{Added: compact(t, net.IPv4len, addr)})
+		if err := h.HandleExtended(pc, payload); err != nil {
+			t.Fatalf("HandleExtended() error = %v", err)
+		}
+	}
+
+	send("10.0.0.1:6881")
+	c.advance(10 * time.Second)
+	send("10.0.0.2:6881")
+	// the ignored message counts, the flood has to stop for a while
+	c.advance(minInterval - time.Second)
+	send("10.0.0.3:6881")
+	c.advance(minInterval)
+	send("10.0.0.4:6881")
+	if want := []string{"10.0.0.1:6881", "10.0.0.4:6881"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("peers = %v, want %v", got, want)
+	}
+
+	// each connection has its own limit
+	if err := h.HandleExtended(&peerconn.PeerConn{}, encode(t, pexMsg{Added: compact(t, net.IPv4len, "10.0.0.5:6881")})); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 {
+		t.Errorf("peers = %v, a message of another connection was ignored", got)
+	}
+}
@@ -0,0 +1,234 @@
+package picker
+
+import (
+	"math/rand"
+	"swiftpeer/client/bitfield"
+	"sync"
+)
+
+// Piece priorities, pieces of a higher priority are picked first
+const (
+	PriorityNone   = 0 // not downloaded
+	PriorityLow    = 1
+	PriorityNormal = 2
+	PriorityHigh   = 3
+)
+
+type pieceStatus int
+
+const (
+	missing pieceStatus = iota
+	inProgress
+	done
+)
+
+// Picker chooses which piece to download next. It keeps track of how many
+// connected peers have each piece and hands out the rarest piece the asking
+// peer has, so that rare pieces don't end up being the last ones.
+type Picker struct {
+	mu           sync.Mutex
+	availability []int
+	priority     []int
+	status       []pieceStatus
+	left         int  // wanted pieces not done yet
+	sequential   bool // pieces of a priority are picked in order, not by rarity
+}
+
+func New(numPieces int) *Picker {
+	p := &Picker{
+		availability: make([]int, numPieces),
+		priority:     make([]int, numPieces),
+		status:       make([]pieceStatus, numPieces),
+		left:         numPieces,
+	}
+	for i := range p.priority {
+		p.priority[i] = PriorityNormal
+	}
+	return p
+}
+
+// AddPeer counts the pieces of a newly connected peer
+func (p *Picker) AddPeer(bf bitfield.Bitfield) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.availability {
+		if bf.HasPiece(i) {
+			p.availability[i]++
+		}
+	}
+}
+
+// RemovePeer uncounts the pieces of a disconnected peer, bf must be the
+// bitfield given to AddPeer updated by the calls to PeerHave
+func (p *Picker) RemovePeer(bf bitfield.Bitfield) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.availability {
+		if bf.HasPiece(i) && p.availability[i] > 0 {
+			p.availability[i]--
+		}
+	}
+}
+
+// PeerHave counts a piece announced by a peer, it must only be called for
+// pieces the peer didn't have
+func (p *Picker) PeerHave(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if index >= 0 && index < len(p.availability) {
+		p.availability[index]++
+	}
+}
+
+// SetPriority changes the priority of a piece, PriorityNone excludes it
+// from the download
+func (p *Picker) SetPriority(index, priority int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if index < 0 || index >= len(p.priority) || p.priority[index] == priority {
+		return
+	}
+	if p.status[index] != done {
+		if priority == PriorityNone {
+			p.left--
+		} else if p.priority[index] == PriorityNone {
+			p.left++
+		}
+	}
+	p.priority[index] = priority
+}
+
+// SetSequential picks the pieces of a priority in order instead of rarest
+// first, e.g. to play a file while it downloads
+func (p *Picker) SetSequential(sequential bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sequential = sequential
+}
+
+// Priority returns the priority of a piece
+func (p *Picker) Priority(index int) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.priority[index]
+}
+
+// Pick returns the rarest wanted piece of the highest priority that the peer
+// has and nobody is downloading, ties are broken randomly. The piece is in
+// progress until Done or Abort is called.
+func (p *Picker) Pick(has bitfield.Bitfield) (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	best, ties := -1, 0
+	for i, status := range p.status {
+		if status != missing || p.priority[i] == PriorityNone || !has.HasPiece(i) {
+			continue
+		}
+		if best >= 0 {
+			c := p.compare(i, best)
+			if c < 0 {
+				continue
+			}
+			if c == 0 {
+				// reservoir sampling picks each tie with the same probability
+				ties++
+				if rand.Intn(ties) == 0 {
+					best = i
+				}
+				continue
+			}
+		}
+		best, ties = i, 1
+	}
+
+	if best < 0 {
+		return 0, false
+	}
+	p.status[best] = inProgress
+	return best, true
+}
+
+// PickFrom returns the first of candidates that Pick could return, ignoring
+// rarity, e.g. for the pieces a peer suggests
+func (p *Picker) PickFrom(candidates []int, has bitfield.Bitfield) (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, i := range candidates {
+		if i < 0 || i >= len(p.status) || p.status[i] != missing || p.priority[i] == PriorityNone || !has.HasPiece(i) {
+			continue
+		}
+		p.status[i] = inProgress
+		return i, true
+	}
+	return 0, false
+}
+
+// compare returns a positive number when piece a should be picked before b,
+// a negative one when b should, and 0 for a tie
+func (p *Picker) compare(a, b int) int {
+	if p.priority[a] != p.priority[b] {
+		return p.priority[a] - p.priority[b]
+	}
+	if p.sequential {
+		return b - a
+	}
+	return p.availability[b] - p.availability[a]
+}
+
+// Done marks a piece as downloaded and verified
+func (p *Picker) Done(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.status[index] != done && p.priority[index] != PriorityNone {
+		p.left--
+	}
+	p.status[index] = done
+}
+
+// Start marks a piece as in progress without picking it, e.g. a piece
+// restored half downloaded
+func (p *Picker) Start(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.status[index] == missing {
+		p.status[index] = inProgress
+	}
+}
+
+// Abort puts a piece back to be picked again, e.g. after its peer went away
+// or its data failed the hash check
+func (p *Picker) Abort(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.status[index] == inProgress {
+		p.status[index] = missing
+	}
+}
+
+// Complete reports whether every wanted piece is done
+func (p *Picker) Complete() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.left == 0
+}
+
+// Unpicked returns the number of wanted pieces nobody is downloading yet
+func (p *Picker) Unpicked() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	count := 0
+	for i, status := range p.status {
+		if status == missing && p.priority[i] != PriorityNone {
+			count++
+		}
+	}
+	return count
+}
+
+// Availability returns the number of connected peers having the piece
+func (p *Picker) Availability(index int) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.availability[index]
+}
@@ -0,0 +1,136 @@
+package picker
+
+import (
+	"swiftpeer/client/bitfield"
+	"testing"
+)
+
+func TestPick(t *testing.T) {
+	all := bitfield.Bitfield{0xf0}
+
+	tests := []struct {
+		name       string
+		peers      []bitfield.Bitfield
+		priority   map[int]int
+		sequential bool
+		has        bitfield.Bitfield
+		want       int
+		wantOk     bool
+	}{
+		{
+			name:   "Rarest piece first",
+			peers:  []bitfield.Bitfield{all, {0xe0}, {0xc0}},
+			has:    all,
+			want:   3,
+			wantOk: true,
+		},
+		{
+			name:   "Only pieces the peer has",
+			peers:  []bitfield.Bitfield{all, {0xe0}, {0xc0}},
+			has:    bitfield.Bitfield{0x60},
+			want:   2,
+			wantOk: true,
+		},
+		{
+			name:     "Low priority after rarer normal ones",
+			peers:    []bitfield.Bitfield{all, {0x70}},
+			priority: map[int]int{1: PriorityLow, 2: PriorityLow, 3: PriorityLow},
+			has:      all,
+			want:     0,
+			wantOk:   true,
+		},
+		{
+			name:     "Priority before rarity",
+			peers:    []bitfield.Bitfield{all, {0xe0}},
+			priority: map[int]int{0: PriorityHigh},
+			has:      all,
+			want:     0,
+			wantOk:   true,
+		},
+		{
+			name:     "Skipped pieces are never picked",
+			peers:    []bitfield.Bitfield{all},
+			priority: map[int]int{0: PriorityNone, 1: PriorityNone},
+			has:      bitfield.Bitfield{0xc0},
+			wantOk:   false,
+		},
+		{
+			name:       "Sequential ignores rarity",
+			peers:      []bitfield.Bitfield{all, {0xe0}},
+			priority:   map[int]int{2: PriorityHigh, 3: PriorityHigh},
+			sequential: true,
+			has:        all,
+			want:       2,
+			wantOk:     true,
+		},
+		{
+			name:   "Peer without pieces",
+			peers:  []bitfield.Bitfield{all},
+			has:    bitfield.Bitfield{0x00},
+			wantOk: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := New(4)
+			p.SetSequential(tt.sequential)
+			for _, bf := range tt.peers {
+				p.AddPeer(bf)
+			}
+			for index, priority := range tt.priority {
+				p.SetPriority(index, priority)
+			}
+			got, ok := p.Pick(tt.has)
+			if ok != tt.wantOk || ok && got != tt.want {
+				t.Errorf("Pick() = %d, %v, want %d, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestPickLifecycle(t *testing.T) {
+	p := New(2)
+	has := bitfield.Bitfield{0xc0}
+	p.AddPeer(has)
+
+	first, _ := p.Pick(has)
+	second, _ := p.Pick(has)
+	if first == second {
+		t.Fatalf("piece %d picked twice", first)
+	}
+	if _, ok := p.Pick(has); ok {
+		t.Fatalf("Pick() succeeded with every piece in progress")
+	}
+
+	p.Abort(first)
+	if got, ok := p.Pick(has); !ok || got != first {
+		t.Errorf("Pick() after Abort = %d, %v, want %d", got, ok, first)
+	}
+
+	p.Done(first)
+	p.Done(second)
+	if !p.Complete() {
+		t.Errorf("Complete() = false with every piece done")
+	}
+
+	p.RemovePeer(has)
+	if got := p.Availability(0); got != 0 {
+		t.Errorf("Availability(0) = %d after RemovePeer, want 0", got)
+	}
+}
+
+func TestPickFrom(t *testing.T) {
+	p := New(4)
+	has := bitfield.Bitfield{0x70}
+	p.AddPeer(has)
+	p.SetPriority(2, PriorityNone)
+
+	// 0 is missing from has and 2 is skipped
+	if got, ok := p.PickFrom([]int{0, 2, 3, 1}, has); !ok || got != 3 {
+		t.Errorf("PickFrom() = %d, %v, want 3, true", got, ok)
+	}
+	if _, ok := p.PickFrom([]int{3, 7}, has); ok {
+		t.Errorf("PickFrom() succeeded with a piece in progress")
+	}
+}
@@ -0,0 +1,307 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+type fileStorage struct {
+	dir string
+}
+
+// NewFile returns a storage keeping torrents in files under dir, written and
+// read with plain pwrite and pread calls
+func NewFile(dir string) Storage {
+	return fileStorage{dir}
+}
+
+func (s fileStorage) OpenTorrent(info Info) (Torrent, error) {
+	return newFileTorrent(s.dir, info), nil
+}
+
+type fileState int
+
+const (
+	unopened fileState = iota
+	readOnly           // the file or its part file, left by a previous run
+	partial            // a skipped file or its part file, open for writing
+	created            // the file at its length, open for writing
+)
+
+// fileTorrent opens the files as they are read. Nothing is created before
+// the first write, which creates every wanted file at its length. Skipped
+// files are never created nor truncated: the blocks they share with wanted
+// ones go to the file when a previous run left it, else to a part file next
+// to it, which becomes the file if it is wanted later.
+type fileTorrent struct {
+	dir  string
+	info Info
+
+	mu        sync.Mutex
+	files     []*os.File
+	state     []fileState
+	skipped   []bool
+	retired   []*os.File // replaced handles a reader may still use, closed on Close
+	allocated bool
+	left      []int64 // bytes of each file not in a completed piece
+	complete  map[int]struct{}
+}
+
+func newFileTorrent(dir string, info Info) *fileTorrent {
+	t := &fileTorrent{
+		dir:      dir,
+		info:     info,
+		files:    make([]*os.File, len(info.Files)),
+		state:    make([]fileState, len(info.Files)),
+		skipped:  make([]bool, len(info.Files)),
+		left:     make([]int64, len(info.Files)),
+		complete: make(map[int]struct{}),
+	}
+	for i, f := range info.Files {
+		t.left[i] = f.Length
+	}
+	return t
+}
+
+func (t *fileTorrent) path(i int) string {
+	return filepath.Join(t.dir, t.info.Files[i].Path)
+}
+
+func (t *fileTorrent) partPath(i int) string {
+	return t.path(i) + ".part"
+}
+
+// createFile creates file i at its length, from its part file if there is one
+func (t *fileTorrent) createFile(i int) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(t.path(i)), os.ModePerm); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(t.path(i)); os.IsNotExist(err) {
+		// keep the blocks written while the file was skipped
+		if err := os.Rename(t.partPath(i), t.path(i)); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	f, err := os.OpenFile(t.path(i), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := f.Stat(); err != nil || fi.Size() != t.info.Files[i].Length {
+		if err := f.Truncate(t.info.Files[i].Length); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// replace makes f the handle of file i, t.mu must be held
+func (t *fileTorrent) replace(i int, f *os.File, state fileState) {
+	if t.files[i] != nil {
+		t.retired = append(t.retired, t.files[i])
+	}
+	t.files[i] = f
+	t.state[i] = state
+}
+
+// create makes file i writable, t.mu must be held
+func (t *fileTorrent) create(i int) error {
+	f, err := t.createFile(i)
+	if err != nil {
+		return err
+	}
+	t.replace(i, f, created)
+	return nil
+}
+
+// allocate creates the wanted files, t.mu must be held
+func (t *fileTorrent) allocate() error {
+	if t.allocated {
+		return nil
+	}
+	for i := range t.info.Files {
+		if t.state[i] == created || t.skipped[i] {
+			continue
+		}
+		if err := t.create(i); err != nil {
+			return err
+		}
+	}
+	t.allocated = true
+	return nil
+}
+
+// isSkipped reports whether file i is skipped and wasn't created before
+func (t *fileTorrent) isSkipped(i int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.skipped[i] && t.state[i] != created
+}
+
+func (t *fileTorrent) Skip(i int, skip bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.skipped[i] = skip
+	if !skip && t.allocated && t.state[i] != created {
+		return t.create(i)
+	}
+	return nil
+}
+
+// file returns the handle to read or write file i through
+func (t *fileTorrent) file(i int, write bool) (*os.File, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch {
+	case t.state[i] == created || t.state[i] == partial:
+	case write:
+		// a skipped file, keep the blocks in it if it is on disk, else in
+		// its part file
+		f, err := os.OpenFile(t.path(i), os.O_RDWR, 0666)
+		if os.IsNotExist(err) {
+			if err := os.MkdirAll(filepath.Dir(t.path(i)), os.ModePerm); err != nil {
+				return nil, err
+			}
+			f, err = os.OpenFile(t.partPath(i), os.O_RDWR|os.O_CREATE, 0666)
+		}
+		if err != nil {
+			return nil, err
+		}
+		t.replace(i, f, partial)
+	case t.state[i] == unopened:
+		f, err := os.Open(t.path(i))
+		if os.IsNotExist(err) {
+			f, err = os.Open(t.partPath(i))
+		}
+		if err != nil {
+			return nil, err
+		}
+		t.replace(i, f, readOnly)
+	}
+	return t.files[i], nil
+}
+
+func (t *fileTorrent) readSpan(s span, p []byte) error {
+	f, err := t.file(s.file, false)
+	if err != nil {
+		return err
+	}
+	_, err = f.ReadAt(p[s.start:s.end], s.offset)
+	return err
+}
+
+func (t *fileTorrent) writeSpan(s span, p []byte) error {
+	f, err := t.file(s.file, true)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt(p[s.start:s.end], s.offset)
+	return err
+}
+
+func (t *fileTorrent) ReadAt(index, begin int, p []byte) error {
+	spans, err := t.info.spans(index, begin, len(p))
+	if err != nil {
+		return err
+	}
+	for _, s := range spans {
+		if err := t.readSpan(s, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *fileTorrent) WriteAt(index, begin int, p []byte) error {
+	spans, err := t.info.spans(index, begin, len(p))
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	err = t.allocate()
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, s := range spans {
+		if err := t.writeSpan(s, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MarkComplete syncs the files whose every piece is complete
+func (t *fileTorrent) MarkComplete(index int) error {
+	for _, i := range t.completeFiles(index) {
+		t.mu.Lock()
+		f, writable := t.files[i], t.state[i] == created || t.state[i] == partial
+		t.mu.Unlock()
+		if !writable {
+			continue
+		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// completeFiles counts a complete piece and returns the files it completes,
+// a piece already counted completes none
+func (t *fileTorrent) completeFiles(index int) []int {
+	spans, err := t.info.pieceSpans(index)
+	if err != nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.complete[index]; ok {
+		return nil
+	}
+	t.complete[index] = struct{}{}
+	var complete []int
+	for _, s := range spans {
+		t.left[s.file] -= int64(s.end - s.start)
+		if t.left[s.file] == 0 {
+			complete = append(complete, s.file)
+		}
+	}
+	return complete
+}
+
+func (t *fileTorrent) Sync() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, f := range t.files {
+		if t.state[i] != created && t.state[i] != partial {
+			continue
+		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *fileTorrent) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var firstErr error
+	for _, f := range append(t.files, t.retired...) {
+		if f == nil {
+			continue
+		}
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	for i := range t.files {
+		t.files[i] = nil
+		t.state[i] = unopened
+	}
+	t.retired = nil
+	t.allocated = false
+	return firstErr
+}
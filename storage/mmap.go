@@ -0,0 +1,214 @@
+package storage
+
+import (
+	"fmt"
+	"swiftpeer/client/filewriter"
+	"sync"
+)
+
+type mmapStorage struct {
+	dir string
+}
+
+// NewMmap returns a storage keeping torrents in files under dir mapped to
+// memory, blocks are copied in and out of the mappings. Large files are
+// mapped a window at a time.
+func NewMmap(dir string) Storage {
+	return mmapStorage{dir}
+}
+
+func (s mmapStorage) OpenTorrent(info Info) (Torrent, error) {
+	return &mmapTorrent{info: info, files: newFileTorrent(s.dir, info)}, nil
+}
+
+// mmapTorrent reads the files with pread until the first write, which
+// creates and maps the wanted ones. Skipped files are left to files.
+type mmapTorrent struct {
+	info  Info
+	files *fileTorrent
+
+	mu     sync.RWMutex // held for writing while mapping and unmapping
+	maps   []*filewriter.FileWriter
+	closed bool
+}
+
+// mapFile creates file i and maps it when it isn't empty
+func (t *mmapTorrent) mapFile(i int) (*filewriter.FileWriter, error) {
+	f, err := t.files.createFile(i)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	if t.info.Files[i].Length == 0 {
+		return nil, nil
+	}
+	return filewriter.New(t.files.path(i), t.info.Files[i].Length)
+}
+
+// mapFiles maps the wanted files, t.mu must be held for writing
+func (t *mmapTorrent) mapFiles() error {
+	if t.maps != nil {
+		return nil
+	}
+	if t.closed {
+		return fmt.Errorf("storage closed")
+	}
+	maps := make([]*filewriter.FileWriter, len(t.info.Files))
+	for i := range t.info.Files {
+		if t.files.isSkipped(i) {
+			continue
+		}
+		var err error
+		if maps[i], err = t.mapFile(i); err != nil {
+			unmap(maps)
+			return err
+		}
+	}
+	t.maps = maps
+	return nil
+}
+
+func unmap(maps []*filewriter.FileWriter) error {
+	var firstErr error
+	for _, fw := range maps {
+		if fw == nil {
+			continue
+		}
+		if err := fw.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (t *mmapTorrent) Skip(i int, skip bool) error {
+	if err := t.files.Skip(i, skip); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if skip || t.maps == nil || t.maps[i] != nil {
+		return nil
+	}
+	fw, err := t.mapFile(i)
+	if err != nil {
+		return err
+	}
+	t.maps[i] = fw
+	return nil
+}
+
+// mapped returns the mapping of file i, nil when it goes through t.files.
+// t.mu must be held.
+func (t *mmapTorrent) mapped(i int) *filewriter.FileWriter {
+	if t.maps == nil {
+		return nil
+	}
+	return t.maps[i]
+}
+
+func (t *mmapTorrent) ReadAt(index, begin int, p []byte) error {
+	spans, err := t.info.spans(index, begin, len(p))
+	if err != nil {
+		return err
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.closed {
+		return fmt.Errorf("storage closed")
+	}
+	for _, s := range spans {
+		if fw := t.mapped(s.file); fw != nil {
+			err = fw.ReadAt(p[s.start:s.end], s.offset)
+		} else {
+			err = t.files.readSpan(s, p)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *mmapTorrent) WriteAt(index, begin int, p []byte) error {
+	spans, err := t.info.spans(index, begin, len(p))
+	if err != nil {
+		return err
+	}
+	t.mu.RLock()
+	if t.maps == nil {
+		t.mu.RUnlock()
+		t.mu.Lock()
+		err := t.mapFiles()
+		t.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		t.mu.RLock()
+	}
+	defer t.mu.RUnlock()
+	if t.closed {
+		return fmt.Errorf("storage closed")
+	}
+	for _, s := range spans {
+		if fw := t.mapped(s.file); fw != nil {
+			err = fw.WriteAt(p[s.start:s.end], s.offset)
+		} else {
+			err = t.files.writeSpan(s, p)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MarkComplete writes the mapped pages of the files whose every piece is
+// complete back to them
+func (t *mmapTorrent) MarkComplete(index int) error {
+	complete := t.files.completeFiles(index)
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, i := range complete {
+		if fw := t.mapped(i); fw != nil {
+			if err := fw.Sync(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (t *mmapTorrent) Sync() error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, fw := range t.maps {
+		if fw == nil {
+			continue
+		}
+		if err := fw.Sync(); err != nil {
+			return err
+		}
+	}
+	return t.files.Sync()
+}
+
+func (t *mmapTorrent) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	for _, fw := range t.maps {
+		if fw != nil {
+			fw.Sync()
+		}
+	}
+	err := unmap(t.maps)
+	t.maps = nil
+	if closeErr := t.files.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
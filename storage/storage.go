@@ -0,0 +1,78 @@
+package storage
+
+import "fmt"
+
+// File is a file of a torrent, its path relative to the storage directory
+type File struct {
+	Path   string
+	Length int64
+}
+
+// Info describes the data of a torrent, the pieces run over the files one
+// after the other
+type Info struct {
+	PieceLength int
+	Files       []File
+}
+
+// Storage holds the data of torrents
+type Storage interface {
+	OpenTorrent(info Info) (Torrent, error)
+}
+
+// Torrent is the data of one torrent. Offsets are relative to the start of
+// a piece, a read or write may span several files.
+type Torrent interface {
+	ReadAt(index, begin int, p []byte) error
+	WriteAt(index, begin int, p []byte) error
+	// Skip tells whether file i is wanted. Skipped files are not created,
+	// the blocks they share with pieces of wanted files are kept aside.
+	Skip(i int, skip bool) error
+	// MarkComplete is called once the piece passed its hash check
+	MarkComplete(index int) error
+	// Sync flushes the written data to the underlying media
+	Sync() error
+	Close() error
+}
+
+func (info Info) totalLength() int64 {
+	var total int64
+	for _, f := range info.Files {
+		total += f.Length
+	}
+	return total
+}
+
+// span is the part of a read or write falling in one file
+type span struct {
+	file       int
+	offset     int64 // in the file
+	start, end int   // in the buffer
+}
+
+// spans splits length bytes at begin of piece index over the files
+func (info Info) spans(index, begin, length int) ([]span, error) {
+	offset := int64(index)*int64(info.PieceLength) + int64(begin)
+	if index < 0 || begin < 0 || length < 0 || offset+int64(length) > info.totalLength() {
+		return nil, fmt.Errorf("%d bytes at %d of piece %d out of range", length, begin, index)
+	}
+
+	var spans []span
+	var fileStart int64
+	for i, f := range info.Files {
+		fileEnd := fileStart + f.Length
+		if f.Length > 0 && offset < fileEnd && offset+int64(length) > fileStart {
+			start := max(offset, fileStart)
+			end := min(offset+int64(length), fileEnd)
+			spans = append(spans, span{i, start - fileStart, int(start - offset), int(end - offset)})
+		}
+		fileStart = fileEnd
+	}
+	return spans, nil
+}
+
+// pieceSpans splits a whole piece over the files
+func (info Info) pieceSpans(index int) ([]span, error) {
+	length := min(int64(info.PieceLength), info.totalLength()-int64(index)*int64(info.PieceLength))
+	return info.spans(index, 0, int(length))
+}
@@ -0,0 +1,240 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testInfo = Info{
+	PieceLength: 8,
+	Files: []File{
+		{Path: "a", Length: 5},
+		{Path: "empty", Length: 0},
+		{Path: filepath.Join("dir", "b"), Length: 14},
+	},
+}
+
+func TestSpans(t *testing.T) {
+	tests := []struct {
+		name                 string
+		index, begin, length int
+		want                 []span
+		wantErr              bool
+	}{
+		{
+			name:   "Within a file",
+			index:  0,
+			begin:  1,
+			length: 3,
+			want:   []span{{0, 1, 0, 3}},
+		},
+		{
+			name:   "Across files",
+			index:  0,
+			begin:  2,
+			length: 6,
+			want:   []span{{0, 2, 0, 3}, {2, 0, 3, 6}},
+		},
+		{
+			name:   "Last piece",
+			index:  2,
+			begin:  0,
+			length: 3,
+			want:   []span{{2, 11, 0, 3}},
+		},
+		{
+			name:    "Past the end",
+			index:   2,
+			begin:   2,
+			length:  2,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := testInfo.spans(tt.index, tt.begin, tt.length)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("spans() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("spans() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("spans() = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestStorages(t *testing.T) {
+	data := []byte("0123456789abcdefghi")
+
+	tests := []struct {
+		name  string
+		new   func(dir string) Storage
+		files bool
+	}{
+		{name: "Mmap", new: NewMmap, files: true},
+		{name: "File", new: NewFile, files: true},
+		{name: "Memory", new: func(string) Storage { return NewMemory() }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			st, err := tt.new(dir).OpenTorrent(testInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.files {
+				if err := st.ReadAt(0, 0, make([]byte, 8)); err == nil {
+					t.Error("ReadAt() of missing files succeeded")
+				}
+				if _, err := os.Stat(filepath.Join(dir, "a")); !os.IsNotExist(err) {
+					t.Error("reading created the files")
+				}
+			}
+
+			for index := 0; index*8 < len(data); index++ {
+				piece := data[index*8 : min(index*8+8, len(data))]
+				if err := st.WriteAt(index, 0, piece); err != nil {
+					t.Fatalf("WriteAt(%d) error = %v", index, err)
+				}
+				if err := st.MarkComplete(index); err != nil {
+					t.Fatalf("MarkComplete(%d) error = %v", index, err)
+				}
+			}
+			got := make([]byte, 6)
+			if err := st.ReadAt(0, 3, got); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data[3:9]) {
+				t.Errorf("ReadAt() = %q, want %q", got, data[3:9])
+			}
+			if err := st.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.files {
+				a, _ := os.ReadFile(filepath.Join(dir, "a"))
+				b, _ := os.ReadFile(filepath.Join(dir, "dir", "b"))
+				if !bytes.Equal(append(a, b...), data) {
+					t.Errorf("files = %q, want %q", append(a, b...), data)
+				}
+				if _, err := os.Stat(filepath.Join(dir, "empty")); err != nil {
+					t.Errorf("empty file not created: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestSkip(t *testing.T) {
+	data := []byte("01234567")
+
+	tests := []struct {
+		name string
+		new  func(dir string) Storage
+	}{
+		{name: "Mmap", new: NewMmap},
+		{name: "File", new: NewFile},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			st, err := tt.new(dir).OpenTorrent(testInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer st.Close()
+			if err := st.Skip(0, true); err != nil {
+				t.Fatal(err)
+			}
+
+			// piece 0 straddles the skipped file and a wanted one
+			if err := st.WriteAt(0, 0, data); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "a")); !os.IsNotExist(err) {
+				t.Error("skipped file created")
+			}
+			got := make([]byte, len(data))
+			if err := st.ReadAt(0, 0, got); err != nil || !bytes.Equal(got, data) {
+				t.Errorf("ReadAt() = %q, %v, want %q", got, err, data)
+			}
+
+			if err := st.Skip(0, false); err != nil {
+				t.Fatal(err)
+			}
+			a, err := os.ReadFile(filepath.Join(dir, "a"))
+			if err != nil || !bytes.Equal(a, data[:5]) {
+				t.Errorf("wanted file = %q, %v, want %q", a, err, data[:5])
+			}
+		})
+	}
+}
+
+func TestSkipExisting(t *testing.T) {
+	tests := []struct {
+		name string
+		new  func(dir string) Storage
+	}{
+		{name: "Mmap", new: NewMmap},
+		{name: "File", new: NewFile},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// a file of another length left by a previous run
+			dir := t.TempDir()
+			path := filepath.Join(dir, "a")
+			if err := os.WriteFile(path, []byte("xyz"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			st, err := tt.new(dir).OpenTorrent(testInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer st.Close()
+			if err := st.Skip(0, true); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := st.WriteAt(1, 0, []byte("89abcdef")); err != nil {
+				t.Fatal(err)
+			}
+			if a, err := os.ReadFile(path); err != nil || string(a) != "xyz" {
+				t.Errorf("skipped file = %q, %v, want it untouched", a, err)
+			}
+
+			if err := st.Skip(0, false); err != nil {
+				t.Fatal(err)
+			}
+			if a, err := os.ReadFile(path); err != nil || !bytes.Equal(a, []byte("xyz\x00\x00")) {
+				t.Errorf("wanted file = %q, %v, want it at its length", a, err)
+			}
+		})
+	}
+}
+
+func TestCompleteFiles(t *testing.T) {
+	ft := newFileTorrent(t.TempDir(), testInfo)
+	if got := ft.completeFiles(0); len(got) == 0 || got[0] != 0 {
+		t.Fatalf("completeFiles(0) = %v, want a completed", got)
+	}
+	// a piece completed twice is counted once
+	for _, index := range []int{0, 1} {
+		if got := ft.completeFiles(index); len(got) != 0 {
+			t.Errorf("completeFiles(%d) = %v, want no file completed", index, got)
+		}
+	}
+	if got := ft.completeFiles(2); len(got) != 1 || got[0] != 2 {
+		t.Errorf("completeFiles(2) = %v, want b completed", got)
+	}
+}
@@ -0,0 +1,236 @@
+package metadata
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"swiftpeer/client/bencode"
+	"swiftpeer/client/common"
+	"sync"
+	"time"
+)
+
+const (
+	maxPieceLength = 16 << 20
+	// targetPieces is the piece count aimed for when choosing a piece length
+	targetPieces = 1500
+)
+
+// Builder creates the metadata of a new torrent from a file or a directory
+type Builder struct {
+	Path         string
+	PieceLength  int        // chosen from the total size when zero
+	AnnounceList [][]string // tiers of tracker urls, the first one is also used as announce
+	Comment      string
+	CreatedBy    string
+	Private      bool
+	Source       string
+	WebSeeds     []string
+	CreationDate time.Time // defaults to now
+}
+
+type pieceJob struct {
+	index int
+	data  []byte
+}
+
+func (b *Builder) Build() (*Metadata, error) {
+	info, err := b.collectFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	total := info.Length
+	for _, file := range info.Files {
+		total += file.Length
+	}
+	// a torrent without a byte has no piece, and its info dictionary would
+	// have neither length nor files
+	if total == 0 {
+		return nil, fmt.Errorf("%s holds no data to share", b.Path)
+	}
+
+	info.PieceLength = b.PieceLength
+	if info.PieceLength == 0 {
+		info.PieceLength = choosePieceLength(total)
+	}
+	if info.PieceLength < common.BlockSize || info.PieceLength&(info.PieceLength-1) != 0 {
+		return nil, fmt.Errorf("piece length must be a power of two of at least %d, got %d", common.BlockSize, info.PieceLength)
+	}
+
+	if b.Private {
+		info.Private = 1
+	}
+	info.Source = b.Source
+
+	pieces, err := b.hashPieces(info, total)
+	if err != nil {
+		return nil, err
+	}
+	info.Pieces = string(pieces)
+
+	m := &Metadata{
+		Comment:   b.Comment,
+		CreatedBy: b.CreatedBy,
+		Info:      *info,
+		URLList:   b.WebSeeds,
+	}
+	m.CreationDate = Time{b.CreationDate}
+	if m.CreationDate.IsZero() {
+		m.CreationDate = Time{time.Now()}
+	}
+	if len(b.AnnounceList) > 0 && len(b.AnnounceList[0]) > 0 {
+		m.Announce = b.AnnounceList[0][0]
+		if len(b.AnnounceList) > 1 || len(b.AnnounceList[0]) > 1 {
+			m.AnnounceList = b.AnnounceList
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := bencode.NewEncoder(&buf).Encode(m.Info); err != nil {
+		return nil, fmt.Errorf("failed to encode info dictionary: %v", err)
+	}
+	m.InfoBytes = buf.Bytes()
+	if err := m.calculateInfoHash(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// collectFiles builds the file list of the info dictionary, directories are
+// walked in lexical order so the same tree always gives the same torrent
+func (b *Builder) collectFiles() (*Info, error) {
+	root := filepath.Clean(b.Path)
+	stat, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &Info{Name: filepath.Base(root)}
+	if !stat.IsDir() {
+		info.Length = stat.Size()
+		return info, nil
+	}
+
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		fileInfo, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		info.Files = append(info.Files, File{
+			Length: fileInfo.Size(),
+			Path:   strings.Split(filepath.ToSlash(rel), "/"),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(info.Files) == 0 {
+		return nil, fmt.Errorf("no files found in %s", root)
+	}
+	return info, nil
+}
+
+// hashPieces reads the files as one stream and hashes the pieces on all CPUs
+func (b *Builder) hashPieces(info *Info, total int64) ([]byte, error) {
+	pieceCount := int((total + int64(info.PieceLength) - 1) / int64(info.PieceLength))
+	hashes := make([]byte, pieceCount*20)
+
+	workers := runtime.NumCPU()
+	jobs := make(chan pieceJob, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				hash := sha1.Sum(job.data)
+				copy(hashes[job.index*20:], hash[:])
+			}
+		}()
+	}
+
+	read, err := b.readPieces(info, func(index int, data []byte) {
+		jobs <- pieceJob{index, data}
+	})
+	close(jobs)
+	wg.Wait()
+
+	if err != nil {
+		return nil, err
+	}
+	if read != total {
+		return nil, fmt.Errorf("files shrank while hashing, read %d bytes instead of %d", read, total)
+	}
+	return hashes, nil
+}
+
+func (b *Builder) readPieces(info *Info, emit func(index int, data []byte)) (int64, error) {
+	files := info.Files
+	if len(files) == 0 {
+		files = []File{{Length: info.Length}}
+	}
+
+	var read int64
+	index := 0
+	piece := make([]byte, 0, info.PieceLength)
+	for _, file := range files {
+		f, err := os.Open(filepath.Join(append([]string{b.Path}, file.Path...)...))
+		if err != nil {
+			return read, err
+		}
+		// files are read up to the size seen when they were listed
+		r := io.LimitReader(f, file.Length)
+		for {
+			n, err := io.ReadFull(r, piece[len(piece):cap(piece)])
+			piece = piece[:len(piece)+n]
+			read += int64(n)
+			if len(piece) == cap(piece) {
+				emit(index, piece)
+				index++
+				piece = make([]byte, 0, info.PieceLength)
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				f.Close()
+				return read, err
+			}
+		}
+		f.Close()
+	}
+	if len(piece) > 0 {
+		emit(index, piece)
+	}
+	return read, nil
+}
+
+// choosePieceLength picks the smallest power of two giving at most
+// targetPieces pieces, between one block and maxPieceLength
+func choosePieceLength(total int64) int {
+	length := common.BlockSize
+	for length < maxPieceLength && total/int64(length) > targetPieces {
+		length *= 2
+	}
+	return length
+}
@@ -0,0 +1,108 @@
+package metadata
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuildPieceHashes(t *testing.T) {
+	const pieceLength = 1 << 14
+
+	tests := []struct {
+		name   string
+		single bool
+		sizes  []int // files a, b, c... walked in this order
+	}{
+		{
+			name:   "Single file",
+			single: true,
+			sizes:  []int{5*pieceLength + 123},
+		},
+		{
+			name:   "Single file of whole pieces",
+			single: true,
+			sizes:  []int{3 * pieceLength},
+		},
+		{
+			name:  "Pieces across files",
+			sizes: []int{1000, pieceLength, 2*pieceLength + 7, 3},
+		},
+		{
+			name:  "Files ending on piece boundaries",
+			sizes: []int{pieceLength - 100, 100, pieceLength, 0, pieceLength},
+		},
+		{
+			name:  "Files smaller than a piece",
+			sizes: []int{1, 2, 3, 0, 5},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "file")
+			if !tt.single {
+				path = filepath.Join(dir, "pack")
+				os.Mkdir(path, 0755)
+			}
+
+			var all []byte
+			for i, size := range tt.sizes {
+				data := make([]byte, size)
+				rand.Read(data)
+				all = append(all, data...)
+				name := path
+				if !tt.single {
+					name = filepath.Join(path, string(rune('a'+i)))
+				}
+				if err := os.WriteFile(name, data, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			md, err := (&Builder{Path: path, PieceLength: pieceLength}).Build()
+			if err != nil {
+				t.Fatalf("Build() error = %v", err)
+			}
+
+			var want []byte
+			for begin := 0; begin < len(all); begin += pieceLength {
+				hash := sha1.Sum(all[begin:min(begin+pieceLength, len(all))])
+				want = append(want, hash[:]...)
+			}
+			if !bytes.Equal([]byte(md.Info.Pieces), want) {
+				t.Errorf("Build() pieces differ from the hashes of the concatenated files")
+			}
+			if got := md.TotalLength(); got != int64(len(all)) {
+				t.Errorf("TotalLength() = %d, want %d", got, len(all))
+			}
+
+			parsed, err := NewMetadataFromInfo(md.InfoBytes)
+			if err != nil {
+				t.Fatalf("NewMetadataFromInfo() error = %v", err)
+			}
+			if parsed.InfoHash != md.InfoHash || parsed.TotalLength() != md.TotalLength() {
+				t.Errorf("info dictionary doesn't round trip")
+			}
+		})
+	}
+}
+
+func TestBuildEmpty(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty")
+	os.WriteFile(empty, nil, 0644)
+	if _, err := (&Builder{Path: empty}).Build(); err == nil {
+		t.Error("Build() of an empty file succeeded")
+	}
+
+	os.Mkdir(filepath.Join(dir, "pack"), 0755)
+	os.WriteFile(filepath.Join(dir, "pack", "a"), nil, 0644)
+	if _, err := (&Builder{Path: filepath.Join(dir, "pack")}).Build(); err == nil {
+		t.Error("Build() of empty files succeeded")
+	}
+}
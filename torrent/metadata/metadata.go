@@ -1,7 +1,6 @@
 package metadata
 
 import (
-	"bufio"
 	"bytes"
 	"crypto/sha1"
 	"fmt"
@@ -9,33 +8,97 @@ import (
 	"os"
 	"path/filepath"
 	"swiftpeer/client/bencode"
+	"swiftpeer/client/layout"
 	"time"
 )
 
 type File struct {
-	Length int      `bencode:"length"`
+	Length int64    `bencode:"length"`
 	Path   []string `bencode:"path"`
 }
 
 type Info struct {
-	Length      int    `bencode:"length,omitempty"`
+	Length      int64  `bencode:"length,omitempty"`
 	Files       []File `bencode:"files,omitempty"`
 	Name        string `bencode:"name"`
 	PieceLength int    `bencode:"piece length"`
 	Pieces      string `bencode:"pieces"`
-	Private     int    `bencode:"-"`
+	Private     int    `bencode:"private,omitempty"`
+	Source      string `bencode:"source,omitempty"`
+}
+
+// SingleFile reports whether the torrent holds a single file, described by
+// Length and Name, rather than a directory of Files. The file may be empty.
+func (i Info) SingleFile() bool {
+	return len(i.Files) == 0
 }
 
 type Metadata struct {
-	Announce     string     `bencode:"announce"`
-	AnnounceList [][]string `bencode:"announce-list,omitempty"`
-	CreationDate int64      `bencode:"creation date,omitempty"`
-	Comment      string     `bencode:"comment,omitempty"`
-	CreatedBy    string     `bencode:"created by,omitempty"`
-	Encoding     string     `bencode:"encoding,omitempty"`
-	Info         Info       `bencode:"info"`
-	InfoHash     [20]byte   `bencode:"-"` // Not part of bencode, calculated separately
-	Private      int        `bencode:"private,omitempty"`
+	Announce     string             `bencode:"announce,omitempty"`
+	AnnounceList [][]string         `bencode:"announce-list,omitempty"`
+	CreationDate Time               `bencode:"creation date,omitempty"`
+	Comment      string             `bencode:"comment,omitempty"`
+	CreatedBy    string             `bencode:"created by,omitempty"`
+	Encoding     string             `bencode:"encoding,omitempty"`
+	Info         Info               `bencode:"info"`
+	InfoBytes    bencode.RawMessage `bencode:"-"` // info dict exactly as it appeared in the file
+	InfoHash     [20]byte           `bencode:"-"` // Not part of bencode, calculated separately
+	URLList      URLList            `bencode:"url-list,omitempty"`
+}
+
+// metadataFile is Metadata as it is decoded from a .torrent file. The info
+// hash must be computed over the original bytes of the info dictionary,
+// re-encoding Info would drop every key we don't model.
+type metadataFile struct {
+	Announce     string             `bencode:"announce,omitempty"`
+	AnnounceList [][]string         `bencode:"announce-list,omitempty"`
+	CreationDate Time               `bencode:"creation date,omitempty"`
+	Comment      string             `bencode:"comment,omitempty"`
+	CreatedBy    string             `bencode:"created by,omitempty"`
+	Encoding     string             `bencode:"encoding,omitempty"`
+	Info         bencode.RawMessage `bencode:"info"`
+	URLList      URLList            `bencode:"url-list,omitempty"`
+}
+
+// Time is a timestamp stored as seconds since the unix epoch
+type Time struct {
+	time.Time
+}
+
+func (t Time) MarshalBencode() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := bencode.NewEncoder(&buf).Encode(t.Unix()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (t *Time) UnmarshalBencode(data []byte) error {
+	var seconds int64
+	if err := bencode.NewDecoder(bytes.NewReader(data)).Decode(&seconds); err != nil {
+		return err
+	}
+	t.Time = time.Unix(seconds, 0)
+	return nil
+}
+
+// URLList holds the web seeds of a torrent (BEP 19), stored either as a
+// single url or as a list of urls
+type URLList []string
+
+func (l *URLList) UnmarshalBencode(data []byte) error {
+	decoder := bencode.NewDecoder(bytes.NewReader(data))
+	if len(data) > 0 && data[0] == 'l' {
+		return decoder.Decode((*[]string)(l))
+	}
+	var url string
+	if err := decoder.Decode(&url); err != nil {
+		return err
+	}
+	if url != "" {
+		*l = URLList{url}
+	}
+	return nil
 }
 
 func NewMetadataFromFile(path string) (*Metadata, error) {
@@ -49,11 +112,25 @@ func NewMetadataFromFile(path string) (*Metadata, error) {
 }
 
 func NewMetadataFromReader(r io.Reader) (*Metadata, error) {
-	m := new(Metadata)
-	decoder := bencode.NewDecoder(bufio.NewReader(r))
-	if err := decoder.Decode(m); err != nil {
+	var f metadataFile
+	if err := bencode.NewDecoder(r).Decode(&f); err != nil {
 		return nil, fmt.Errorf("failed to decode metadata: %v", err)
 	}
+	m := &Metadata{
+		Announce:     f.Announce,
+		AnnounceList: f.AnnounceList,
+		CreationDate: f.CreationDate,
+		Comment:      f.Comment,
+		CreatedBy:    f.CreatedBy,
+		Encoding:     f.Encoding,
+		InfoBytes:    f.Info,
+		URLList:      f.URLList,
+	}
+	if len(m.InfoBytes) > 0 {
+		if err := bencode.NewDecoder(bytes.NewReader(m.InfoBytes)).Decode(&m.Info); err != nil {
+			return nil, fmt.Errorf("failed to decode info dictionary: %v", err)
+		}
+	}
 
 	if err := m.calculateInfoHash(); err != nil {
 		return nil, fmt.Errorf("failed to calculate info hash: %v", err)
@@ -62,23 +139,34 @@ func NewMetadataFromReader(r io.Reader) (*Metadata, error) {
 	return m, nil
 }
 
+// NewMetadataFromInfo builds the metadata of a torrent from its raw info
+// dictionary, e.g. as downloaded from peers with ut_metadata
+func NewMetadataFromInfo(info []byte) (*Metadata, error) {
+	m := &Metadata{InfoBytes: info}
+	if err := bencode.NewDecoder(bytes.NewReader(info)).Decode(&m.Info); err != nil {
+		return nil, fmt.Errorf("failed to decode info dictionary: %v", err)
+	}
+	if err := m.calculateInfoHash(); err != nil {
+		return nil, fmt.Errorf("failed to calculate info hash: %v", err)
+	}
+	return m, nil
+}
+
 func (m *Metadata) calculateInfoHash() error {
-	var buf bytes.Buffer
-	err := bencode.NewEncoder(&buf).Encode(m.Info)
-	if err != nil {
-		return err
+	if len(m.InfoBytes) == 0 {
+		return fmt.Errorf("missing info dictionary")
 	}
-	m.InfoHash = sha1.Sum(buf.Bytes())
+	m.InfoHash = sha1.Sum(m.InfoBytes)
 	return nil
 }
 
 func (m *Metadata) TotalLength() int64 {
-	if m.Info.Length > 0 {
-		return int64(m.Info.Length)
+	if m.Info.SingleFile() {
+		return m.Info.Length
 	}
 	var total int64
 	for _, file := range m.Info.Files {
-		total += int64(file.Length)
+		total += file.Length
 	}
 	return total
 }
@@ -96,25 +184,61 @@ func (m *Metadata) PieceHashes() ([][20]byte, error) {
 }
 
 func (m *Metadata) Files() []File {
-	if m.Info.Length > 0 {
+	if m.Info.SingleFile() {
 		return []File{{Length: m.Info.Length, Path: []string{m.Info.Name}}}
 	}
 	return m.Info.Files
 }
 
+// Layout returns where each file is saved relative to the output directory,
+// made safe whatever the torrent holds, and the files moved to do so
+func (m *Metadata) Layout() ([]string, []layout.Mapping, error) {
+	if m.Info.SingleFile() {
+		return layout.Paths(m.Info.Name, nil)
+	}
+	files := make([][]string, len(m.Info.Files))
+	for i, file := range m.Info.Files {
+		files[i] = file.Path
+	}
+	return layout.Paths(m.Info.Name, files)
+}
+
+// FullPath returns where each file is saved under basePath, nil when the
+// paths of the torrent can't be made safe
 func (m *Metadata) FullPath(basePath string) []string {
-	var paths []string
-	for _, file := range m.Files() {
-		fullPath := filepath.Join(append([]string{basePath, m.Info.Name}, file.Path...)...)
-		paths = append(paths, fullPath)
+	rel, _, err := m.Layout()
+	if err != nil {
+		return nil
+	}
+	paths := make([]string, len(rel))
+	for i, path := range rel {
+		paths[i] = filepath.Join(basePath, path)
 	}
 	return paths
 }
 
 func (m *Metadata) CreationTime() time.Time {
-	return time.Unix(m.CreationDate, 0)
+	return m.CreationDate.Time
 }
 
 func (m *Metadata) IsPrivate() bool {
-	return m.Private == 1
+	return m.Info.Private == 1
+}
+
+// Write encodes the torrent file. The info dictionary is written from
+// InfoBytes, so the info hash is preserved even for keys we don't model.
+func (m *Metadata) Write(w io.Writer) error {
+	if len(m.InfoBytes) == 0 {
+		return fmt.Errorf("missing info dictionary")
+	}
+	var buf bytes.Buffer
+	if err := bencode.NewEncoder(&buf).Encode(m); err != nil {
+		return err
+	}
+	var dict map[string]bencode.RawMessage
+	if err := bencode.NewDecoder(&buf).Decode(&dict); err != nil {
+		return err
+	}
+	dict["info"] = m.InfoBytes
+	return bencode.NewEncoder(w).Encode(dict)
 }
@@ -0,0 +1,78 @@
+package metadata
+
+import (
+	"crypto/sha1"
+	"strings"
+	"testing"
+)
+
+func TestNewMetadataFromReader(t *testing.T) {
+	// keys of the info dictionary we don't model still count in the hash
+	info := "d6:lengthi5e4:name5:a.bin12:piece lengthi16384e6:pieces20:aaaaaaaaaaaaaaaaaaaa7:x-extra3:fooe"
+	data := "d8:announce14:http://tracker4:info" + info + "e"
+
+	m, err := NewMetadataFromReader(strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("NewMetadataFromReader() error = %v", err)
+	}
+	if m.InfoHash != sha1.Sum([]byte(info)) {
+		t.Errorf("InfoHash = %x, want the hash of the info dictionary as read", m.InfoHash)
+	}
+	if string(m.InfoBytes) != info {
+		t.Errorf("InfoBytes = %q, want %q", m.InfoBytes, info)
+	}
+	if m.Announce != "http://tracker" || m.Info.Name != "a.bin" || m.Info.Length != 5 || m.Info.PieceLength != 16384 {
+		t.Errorf("decoded %+v", m)
+	}
+
+	if _, err := NewMetadataFromReader(strings.NewReader("d8:announce14:http://trackere")); err == nil {
+		t.Errorf("NewMetadataFromReader() succeeded without an info dictionary")
+	}
+}
+
+func TestSingleFile(t *testing.T) {
+	tests := []struct {
+		name      string
+		info      Info
+		wantFiles int
+		wantTotal int64
+	}{
+		{
+			name:      "Single file",
+			info:      Info{Name: "a.bin", Length: 5},
+			wantFiles: 1,
+			wantTotal: 5,
+		},
+		{
+			name:      "Empty single file",
+			info:      Info{Name: "a.bin"},
+			wantFiles: 1,
+			wantTotal: 0,
+		},
+		{
+			name: "Directory",
+			info: Info{Name: "dir", Files: []File{
+				{Length: 3, Path: []string{"a"}},
+				{Length: 0, Path: []string{"b"}},
+			}},
+			wantFiles: 2,
+			wantTotal: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &Metadata{Info: tt.info}
+			if got := len(m.Files()); got != tt.wantFiles {
+				t.Errorf("Files() has %d files, want %d", got, tt.wantFiles)
+			}
+			if got := m.TotalLength(); got != tt.wantTotal {
+				t.Errorf("TotalLength() = %d, want %d", got, tt.wantTotal)
+			}
+			paths, _, err := m.Layout()
+			if err != nil || len(paths) != tt.wantFiles {
+				t.Errorf("Layout() = %v, %v, want %d paths", paths, err, tt.wantFiles)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package torrent
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"swiftpeer/client/picker"
+)
+
+// File priorities, a piece gets the highest priority of the files it overlaps
+// so that pieces shared by a skipped file and a wanted one are downloaded
+const (
+	PrioritySkip   = picker.PriorityNone
+	PriorityLow    = picker.PriorityLow
+	PriorityNormal = picker.PriorityNormal
+	PriorityHigh   = picker.PriorityHigh
+)
+
+var priorityNames = map[string]int{
+	"skip":   PrioritySkip,
+	"low":    PriorityLow,
+	"normal": PriorityNormal,
+	"high":   PriorityHigh,
+}
+
+// ParsePriority returns the priority named skip, low, normal or high
+func ParsePriority(name string) (int, error) {
+	priority, ok := priorityNames[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown priority %q, expected skip, low, normal or high", name)
+	}
+	return priority, nil
+}
+
+// MatchFiles returns the files matching pattern, either the index of a file
+// or a glob matched against its path in the torrent, or against its name when
+// the pattern has no separator
+func (t *Torrent) MatchFiles(pattern string) ([]int, error) {
+	if i, err := strconv.Atoi(pattern); err == nil {
+		if i < 0 || i >= len(t.Files) {
+			return nil, fmt.Errorf("no file %d in the torrent, it has %d", i, len(t.Files))
+		}
+		return []int{i}, nil
+	}
+
+	var matches []int
+	for i, file := range t.Files {
+		// the path under the directory of the torrent
+		_, name, ok := strings.Cut(file.Path, string(filepath.Separator))
+		if !ok || !strings.ContainsRune(pattern, filepath.Separator) {
+			name = filepath.Base(file.Path)
+		}
+		ok, err := filepath.Match(pattern, name)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matches = append(matches, i)
+		}
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("no file matches %q", pattern)
+	}
+	return matches, nil
+}
+
+// SetFilePriority changes the priority of file i and of its pieces. Skipped
+// files are not created, unless they already are on disk.
+func (t *Torrent) SetFilePriority(i, priority int) error {
+	if i < 0 || i >= len(t.Files) {
+		return fmt.Errorf("no file %d in the torrent, it has %d", i, len(t.Files))
+	}
+	if priority < PrioritySkip || priority > PriorityHigh {
+		return fmt.Errorf("invalid priority %d", priority)
+	}
+	t.priorityMu.Lock()
+	defer t.priorityMu.Unlock()
+	t.Files[i].Priority = priority
+	if err := t.storage.Skip(i, priority == PrioritySkip); err != nil {
+		return err
+	}
+
+	begin, end := t.Files[i].Start, t.Files[i].Start+t.Files[i].Length
+	for index := int(begin / int64(t.PieceLength)); int64(index)*int64(t.PieceLength) < end; index++ {
+		t.picker.SetPriority(index, t.piecePriority(index))
+	}
+	return nil
+}
+
+// selectOnly skips every file but the given ones, e.g. from the so parameter
+// of a magnet link (BEP 53). Indices past the last file are ignored, and so
+// is the selection when none is left.
+func (t *Torrent) selectOnly(indices []int) error {
+	selected := make(map[int]bool)
+	for _, i := range indices {
+		if i >= 0 && i < len(t.Files) {
+			selected[i] = true
+		}
+	}
+	if len(selected) == 0 {
+		fmt.Printf("[INFO] ignoring the file selection, the torrent has %d files\n", len(t.Files))
+		return nil
+	}
+	for i := range t.Files {
+		if !selected[i] {
+			if err := t.SetFilePriority(i, PrioritySkip); err != nil {
+				return err
+			}
+		}
+	}
+	fmt.Printf("[INFO] downloading %d of %d files\n", len(selected), len(t.Files))
+	return nil
+}
+
+// piecePriority returns the highest priority of the files the piece overlaps,
+// or the high one when a reader waits for it. t.priorityMu must be held.
+func (t *Torrent) piecePriority(index int) int {
+	begin, end := t.computeBounds(index)
+	// the first file ending after the piece begins
+	i := sort.Search(len(t.Files), func(i int) bool {
+		return t.Files[i].Start+t.Files[i].Length > begin
+	})
+	priority := PrioritySkip
+	for ; i < len(t.Files) && t.Files[i].Start < end; i++ {
+		if t.Files[i].Length > 0 {
+			priority = max(priority, t.Files[i].Priority)
+		}
+	}
+	if t.streamed(index) {
+		priority = PriorityHigh
+	}
+	return priority
+}
+
+// wantedBytes returns the size of the pieces not skipped, and how much of it
+// is verified
+func (t *Torrent) wantedBytes() (wanted, verified int64) {
+	for index := range t.PieceHashes {
+		if t.picker.Priority(index) == PrioritySkip {
+			continue
+		}
+		wanted += int64(t.computeSize(index))
+		if t.hasPiece(index) {
+			verified += int64(t.computeSize(index))
+		}
+	}
+	return wanted, verified
+}
@@ -0,0 +1,202 @@
+package torrent
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"swiftpeer/client/bencode"
+	"swiftpeer/client/bitfield"
+	"sync/atomic"
+	"time"
+)
+
+// resumeInterval is how often the resume data is saved while downloading
+const resumeInterval = 30 * time.Second
+
+// resumeLimits fits the bitfield of a million pieces and the known peers
+var resumeLimits = bencode.Options{MaxDepth: 4, MaxStringLen: 1 << 20, MaxBytes: 16 << 20}
+
+// resumeData is what we save of a download so that a restart only requests
+// the missing pieces. Pieces and partial blocks are trusted as long as the
+// files keep the size and modification time they had when it was saved.
+type resumeData struct {
+	InfoHash   []byte          `bencode:"info-hash"`
+	Pieces     []byte          `bencode:"pieces"` // bitfield of the verified pieces
+	Files      []resumeFile    `bencode:"files"`
+	Partial    []resumePartial `bencode:"partial,omitempty"`
+	Peers      []string        `bencode:"peers,omitempty"`
+	Uploaded   int64           `bencode:"uploaded"`
+	Downloaded int64           `bencode:"downloaded"`
+}
+
+type resumeFile struct {
+	Length int64 `bencode:"length"`
+	Mtime  int64 `bencode:"mtime"` // unix nanoseconds
+}
+
+// resumePartial is a piece some blocks of which are written to the files
+type resumePartial struct {
+	Index  int    `bencode:"index"`
+	Blocks []byte `bencode:"blocks"` // bitfield of the blocks received
+}
+
+func resumePath(dir string, infoHash [20]byte) string {
+	return filepath.Join(dir, fmt.Sprintf(".%x.resume", infoHash))
+}
+
+// loadResume restores the progress saved by a previous run in dir. The
+// pieces of files modified since are checked against their hash, and their
+// partial pieces dropped. The error satisfies os.IsNotExist when nothing was
+// saved.
+func (t *Torrent) loadResume(dir string) error {
+	data, err := os.ReadFile(resumePath(dir, t.InfoHash))
+	if err != nil {
+		return err
+	}
+	rd := new(resumeData)
+	if err := bencode.NewDecoderWithOptions(bytes.NewReader(data), resumeLimits).Decode(rd); err != nil {
+		return err
+	}
+	if !bytes.Equal(rd.InfoHash, t.InfoHash[:]) || len(rd.Files) != len(t.Files) || len(rd.Pieces) != len(t.have) {
+		return fmt.Errorf("resume data doesn't match the torrent")
+	}
+
+	changed := make([]bool, len(t.Files))
+	for i, file := range t.Files {
+		fi, err := os.Stat(filepath.Join(dir, file.Path))
+		changed[i] = err != nil || fi.Size() != rd.Files[i].Length || fi.ModTime().UnixNano() != rd.Files[i].Mtime
+	}
+	pieceChanged := func(index int) bool {
+		begin, end := t.computeBounds(index)
+		for i, file := range t.Files {
+			fileStart, fileEnd := file.Start, file.Start+file.Length
+			if changed[i] && begin < fileEnd && end > fileStart {
+				return true
+			}
+		}
+		return false
+	}
+
+	pieces := bitfield.Bitfield(rd.Pieces)
+	var recheck []int
+	for index := range t.PieceHashes {
+		if pieceChanged(index) {
+			recheck = append(recheck, index)
+		} else if pieces.HasPiece(index) {
+			t.have.SetPiece(index)
+		}
+	}
+	if len(recheck) > 0 {
+		fmt.Printf("[INFO] checking %d pieces of modified files\n", len(recheck))
+		verified := t.verifyPieces(recheck, nil)
+		for _, index := range recheck {
+			if verified.HasPiece(index) {
+				t.have.SetPiece(index)
+			}
+		}
+	}
+	restored := 0
+	for index := range t.PieceHashes {
+		if t.have.HasPiece(index) {
+			t.picker.Done(index)
+			t.storage.MarkComplete(index)
+			restored++
+		}
+	}
+
+	for _, p := range rd.Partial {
+		if p.Index < 0 || p.Index >= len(t.PieceHashes) || t.have.HasPiece(p.Index) || pieceChanged(p.Index) {
+			continue
+		}
+		data, err := t.readBlock(p.Index, 0, t.computeSize(p.Index))
+		if err != nil {
+			continue
+		}
+		t.scheduler.restore(p.Index, p.Blocks, data)
+	}
+
+	for _, addr := range rd.Peers {
+		if len(t.Peers) >= maxKnownPeers {
+			break
+		}
+		t.Peers[addr] = struct{}{}
+	}
+	atomic.StoreInt64(&t.uploaded, rd.Uploaded)
+	atomic.StoreInt64(&t.downloaded, rd.Downloaded)
+
+	fmt.Printf("[INFO] resumed %d of %d pieces\n", restored, len(t.PieceHashes))
+	return nil
+}
+
+// saveResume writes the blocks of partial pieces to the files and saves the
+// resume data next to them. It is written to a temporary file renamed over
+// the previous one, so that a crash never leaves a truncated one.
+func (t *Torrent) saveResume() error {
+	rd := resumeData{
+		InfoHash:   t.InfoHash[:],
+		Pieces:     t.haveBitfield(),
+		Uploaded:   atomic.LoadInt64(&t.uploaded),
+		Downloaded: atomic.LoadInt64(&t.downloaded),
+	}
+
+	for _, p := range t.scheduler.partialPieces() {
+		for b := 0; b*maxBlockSize < len(p.data); b++ {
+			if !p.blocks.HasPiece(b) {
+				continue
+			}
+			block := p.data[b*maxBlockSize : min((b+1)*maxBlockSize, len(p.data))]
+			if err := t.storage.WriteAt(p.index, b*maxBlockSize, block); err != nil {
+				return err
+			}
+		}
+		rd.Partial = append(rd.Partial, resumePartial{Index: p.index, Blocks: p.blocks})
+	}
+
+	// the modification times are only final once the written data is flushed
+	if err := t.storage.Sync(); err != nil {
+		return err
+	}
+	for _, file := range t.Files {
+		var rf resumeFile
+		if fi, err := os.Stat(filepath.Join(t.basePath, file.Path)); err == nil {
+			rf = resumeFile{Length: fi.Size(), Mtime: fi.ModTime().UnixNano()}
+		}
+		rd.Files = append(rd.Files, rf)
+	}
+
+	t.peersMu.Lock()
+	for addr := range t.Peers {
+		rd.Peers = append(rd.Peers, addr)
+	}
+	t.peersMu.Unlock()
+
+	path := resumePath(t.basePath, t.InfoHash)
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := bencode.NewEncoder(f).Encode(rd); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// verifiedBytes returns the bytes of the pieces of have within [begin, end)
+func (t *Torrent) verifiedBytes(have bitfield.Bitfield, begin, end int64) int64 {
+	var total int64
+	for index := int(begin / int64(t.PieceLength)); int64(index)*int64(t.PieceLength) < end; index++ {
+		if have.HasPiece(index) {
+			pieceStart, pieceEnd := t.computeBounds(index)
+			total += min(pieceEnd, end) - max(pieceStart, begin)
+		}
+	}
+	return total
+}
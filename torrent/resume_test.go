@@ -0,0 +1,229 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"swiftpeer/client/bitfield"
+	"swiftpeer/client/peer"
+	"swiftpeer/client/peerconn"
+	"swiftpeer/client/storage"
+	"swiftpeer/client/torrent/metadata"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const savedPeer = "10.0.0.1:6881"
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+// saveTestResume downloads pieces 0, 2 and 3 and the first block of piece 1
+// of a torrent of files a.bin and b.bin, piece 1 spanning both, and saves the
+// resume data in the returned directory
+func saveTestResume(t *testing.T) (*metadata.Metadata, string) {
+	a, b := randomBytes(3*maxBlockSize+100), randomBytes(4*maxBlockSize)
+	md := buildTorrent(t, 2*maxBlockSize, a, b)
+	data := append(a, b...)
+	dir := t.TempDir()
+
+	tr, err := newTorrent(md, [20]byte{}, 0, peer.AddrSet{savedPeer: {}}, dir, storage.NewFile(dir), nil)
+	if err != nil {
+		t.Fatalf("newTorrent() error = %v", err)
+	}
+	for _, index := range []int{0, 2, 3} {
+		begin, end := tr.computeBounds(index)
+		if err := tr.handlePiece(index, data[begin:end]); err != nil {
+			t.Fatalf("handlePiece() error = %v", err)
+		}
+		tr.markHave(index)
+		tr.picker.Done(index)
+	}
+	pc := &peerconn.PeerConn{}
+	r, ok := tr.scheduler.next(pc, bitfield.Bitfield{0x40})
+	if !ok || r.index != 1 {
+		t.Fatalf("next() = %+v, %v, want a block of piece 1", r, ok)
+	}
+	begin, _ := tr.computeBounds(1)
+	block := data[begin+int64(r.begin) : begin+int64(r.begin+r.length)]
+	if _, _, err := tr.scheduler.received(pc, r.index, r.begin, block); err != nil {
+		t.Fatalf("received() error = %v", err)
+	}
+	atomic.StoreInt64(&tr.uploaded, 1234)
+	atomic.StoreInt64(&tr.downloaded, 5678)
+
+	if err := tr.saveResume(); err != nil {
+		t.Fatalf("saveResume() error = %v", err)
+	}
+	if err := tr.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return md, dir
+}
+
+// corrupt overwrites bytes of a file at offset, keeping its modification time
+func corrupt(t *testing.T, path string, offset int64) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("garbage"), offset); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := os.Chtimes(path, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func restoreTorrent(t *testing.T, md *metadata.Metadata, dir string) *Torrent {
+	tr, err := newTorrent(md, [20]byte{}, 0, nil, dir, storage.NewFile(dir), nil)
+	if err != nil {
+		t.Fatalf("newTorrent() error = %v", err)
+	}
+	t.Cleanup(func() { tr.Close() })
+	tr.restore()
+	return tr
+}
+
+// checkRestored compares the pieces and the partial piece 1 restored
+func checkRestored(t *testing.T, tr *Torrent, want []int, wantPartial bool) {
+	t.Helper()
+	wantHave := bitfield.New(len(tr.PieceHashes))
+	for _, index := range want {
+		wantHave.SetPiece(index)
+	}
+	for index := range tr.PieceHashes {
+		if got := tr.hasPiece(index); got != wantHave.HasPiece(index) {
+			t.Errorf("piece %d restored = %v, want %v", index, got, wantHave.HasPiece(index))
+		}
+	}
+	if _, ok := tr.scheduler.partial[1]; ok != wantPartial {
+		t.Errorf("partial piece restored = %v, want %v", ok, wantPartial)
+	}
+	wantUnpicked := len(tr.PieceHashes) - len(want)
+	if wantPartial {
+		wantUnpicked--
+	}
+	if got := tr.picker.Unpicked(); got != wantUnpicked {
+		t.Errorf("Unpicked() = %d, want %d", got, wantUnpicked)
+	}
+}
+
+func TestResume(t *testing.T) {
+	tests := []struct {
+		name        string
+		change      func(t *testing.T, fileA, fileB string)
+		wantHave    []int
+		wantPartial bool
+	}{
+		{
+			// the pieces saved are trusted without reading them
+			name:        "Files unchanged",
+			change:      func(t *testing.T, fileA, fileB string) {},
+			wantHave:    []int{0, 2, 3},
+			wantPartial: true,
+		},
+		{
+			name: "Modification time changed",
+			change: func(t *testing.T, fileA, fileB string) {
+				later := time.Now().Add(time.Hour)
+				if err := os.Chtimes(fileB, later, later); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantHave:    []int{0, 3},
+			wantPartial: false,
+		},
+		{
+			name: "Length changed",
+			change: func(t *testing.T, fileA, fileB string) {
+				fi, err := os.Stat(fileA)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Truncate(fileA, fi.Size()+1); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chtimes(fileA, fi.ModTime(), fi.ModTime()); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantHave:    []int{2, 3},
+			wantPartial: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			md, dir := saveTestResume(t)
+			fileA, fileB := filepath.Join(dir, "data", "a.bin"), filepath.Join(dir, "data", "b.bin")
+			// pieces 0 and 2 no longer match, only a recheck notices
+			corrupt(t, fileA, 10)
+			corrupt(t, fileB, maxBlockSize-100+10)
+			tt.change(t, fileA, fileB)
+
+			tr := restoreTorrent(t, md, dir)
+			checkRestored(t, tr, tt.wantHave, tt.wantPartial)
+			if got := atomic.LoadInt64(&tr.uploaded); got != 1234 {
+				t.Errorf("uploaded = %d, want 1234", got)
+			}
+			if got := atomic.LoadInt64(&tr.downloaded); got != 5678 {
+				t.Errorf("downloaded = %d, want 5678", got)
+			}
+			if _, ok := tr.Peers[savedPeer]; !ok || len(tr.Peers) != 1 {
+				t.Errorf("peers = %v, want %v", tr.Peers, savedPeer)
+			}
+		})
+	}
+}
+
+func TestResumeUnusable(t *testing.T) {
+	tests := []struct {
+		name  string
+		alter func(data []byte, infoHash [20]byte) []byte
+	}{
+		{
+			name:  "Truncated",
+			alter: func(data []byte, infoHash [20]byte) []byte { return data[:len(data)/2] },
+		},
+		{
+			name:  "Not bencode",
+			alter: func(data []byte, infoHash [20]byte) []byte { return []byte("garbage") },
+		},
+		{
+			name: "Another torrent",
+			alter: func(data []byte, infoHash [20]byte) []byte {
+				return bytes.Replace(data, infoHash[:], make([]byte, 20), 1)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			md, dir := saveTestResume(t)
+			corrupt(t, filepath.Join(dir, "data", "a.bin"), 10)
+			path := resumePath(dir, md.InfoHash)
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, tt.alter(data, md.InfoHash), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			// every piece is checked, the partial one included
+			tr := restoreTorrent(t, md, dir)
+			checkRestored(t, tr, []int{2, 3}, false)
+		})
+	}
+}
@@ -0,0 +1,282 @@
+package torrent
+
+import (
+	"fmt"
+	"swiftpeer/client/bitfield"
+	"swiftpeer/client/peerconn"
+	"swiftpeer/client/picker"
+	"sync"
+	"time"
+)
+
+// blockTimeout is how long a requested block may stay unanswered before
+// another peer is allowed to request it too
+const blockTimeout = 20 * time.Second
+
+type block struct {
+	received    bool
+	owners      []*peerconn.PeerConn // peers the block is requested from
+	requestedAt time.Time
+}
+
+func (b *block) ownedBy(pc *peerconn.PeerConn) bool {
+	for _, owner := range b.owners {
+		if owner == pc {
+			return true
+		}
+	}
+	return false
+}
+
+// partialPiece is a piece being downloaded, its blocks may come from
+// several peers and it survives the loss of any of them
+type partialPiece struct {
+	data     []byte
+	blocks   []block
+	received int
+}
+
+// scheduler splits the pieces handed out by the picker into blocks and
+// decides which block each peer requests next. Once every remaining block
+// is requested it enters endgame mode, where blocks are requested from
+// every peer having them and cancelled on the others when they arrive.
+type scheduler struct {
+	mu          sync.Mutex
+	picker      *picker.Picker
+	pieceLength int
+	totalLength int64
+	partial     map[int]*partialPiece
+	inflight    map[*peerconn.PeerConn]int
+	endgame     bool
+	wasted      int64 // bytes of blocks received more than once or unasked
+}
+
+func newScheduler(p *picker.Picker, pieceLength int, totalLength int64) *scheduler {
+	return &scheduler{
+		picker:      p,
+		pieceLength: pieceLength,
+		totalLength: totalLength,
+		partial:     make(map[int]*partialPiece),
+		inflight:    make(map[*peerconn.PeerConn]int),
+	}
+}
+
+func (s *scheduler) pieceSize(index int) int {
+	return int(min(int64(s.pieceLength), s.totalLength-int64(index)*int64(s.pieceLength)))
+}
+
+func (s *scheduler) blockRequest(index, b int) blockRequest {
+	begin := b * maxBlockSize
+	return blockRequest{index, begin, min(maxBlockSize, s.pieceSize(index)-begin)}
+}
+
+// next returns the block pc should request among the pieces of has. Missing
+// blocks of partial pieces come first, then blocks of a newly picked piece,
+// preferably one the peer suggested, and last blocks other peers have been
+// sitting on for longer than blockTimeout, or for any time in endgame mode.
+func (s *scheduler) next(pc *peerconn.PeerConn, has bitfield.Bitfield) (blockRequest, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	missing := func(b *block) bool { return !b.received && len(b.owners) == 0 }
+	if r, ok := s.find(has, missing); ok {
+		return s.assign(pc, r), true
+	}
+
+	index, ok := s.picker.PickFrom(pc.Suggested, has)
+	if !ok {
+		index, ok = s.picker.Pick(has)
+	}
+	if ok {
+		size := s.pieceSize(index)
+		s.partial[index] = &partialPiece{
+			data:   make([]byte, size),
+			blocks: make([]block, (size+maxBlockSize-1)/maxBlockSize),
+		}
+		return s.assign(pc, s.blockRequest(index, 0)), true
+	}
+
+	if !s.endgame && s.picker.Unpicked() == 0 {
+		if _, ok := s.find(nil, missing); !ok {
+			s.endgame = true
+			fmt.Println("[INFO] entering endgame mode")
+		}
+	}
+
+	duplicate := func(b *block) bool {
+		return !b.received && !b.ownedBy(pc) && (s.endgame || time.Since(b.requestedAt) > blockTimeout)
+	}
+	if r, ok := s.find(has, duplicate); ok {
+		return s.assign(pc, r), true
+	}
+	return blockRequest{}, false
+}
+
+// find returns a block matching in the partial pieces of has, all of them
+// when has is nil
+func (s *scheduler) find(has bitfield.Bitfield, match func(b *block) bool) (blockRequest, bool) {
+	for index, p := range s.partial {
+		if has != nil && !has.HasPiece(index) {
+			continue
+		}
+		for i := range p.blocks {
+			if match(&p.blocks[i]) {
+				return s.blockRequest(index, i), true
+			}
+		}
+	}
+	return blockRequest{}, false
+}
+
+func (s *scheduler) assign(pc *peerconn.PeerConn, r blockRequest) blockRequest {
+	b := &s.partial[r.index].blocks[r.begin/maxBlockSize]
+	b.owners = append(b.owners, pc)
+	b.requestedAt = time.Now()
+	s.inflight[pc]++
+	return r
+}
+
+// pending returns the number of blocks requested from pc and not received
+func (s *scheduler) pending(pc *peerconn.PeerConn) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inflight[pc]
+}
+
+// received stores a block from pc. It returns the data of the piece once
+// every block arrived, the piece then leaves the scheduler, and the other
+// peers the block was requested from, which should be sent a cancel.
+// Duplicates of blocks received from another peer, and blocks not requested
+// from pc, are dropped and counted as wasted.
+func (s *scheduler) received(pc *peerconn.PeerConn, index, begin int, data []byte) ([]byte, []*peerconn.PeerConn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.partial[index]
+	if !ok {
+		// the piece was completed with the blocks of other peers
+		s.wasted += int64(len(data))
+		return nil, nil, nil
+	}
+	if begin%maxBlockSize != 0 || begin >= len(p.data) || len(data) != s.blockRequest(index, begin/maxBlockSize).length {
+		return nil, nil, fmt.Errorf("unexpected block of piece %d at %d, length %d", index, begin, len(data))
+	}
+
+	b := &p.blocks[begin/maxBlockSize]
+	if b.received || !b.ownedBy(pc) {
+		// a block pc sent unasked, or after it was released from pc
+		s.wasted += int64(len(data))
+		return nil, nil, nil
+	}
+	copy(p.data[begin:], data)
+	b.received = true
+	p.received++
+
+	var cancel []*peerconn.PeerConn
+	for _, owner := range b.owners {
+		s.inflight[owner]--
+		if owner != pc {
+			cancel = append(cancel, owner)
+		}
+	}
+	b.owners = nil
+
+	if p.received < len(p.blocks) {
+		return nil, cancel, nil
+	}
+	delete(s.partial, index)
+	return p.data, cancel, nil
+}
+
+// rejected forgets a block pc refused to send, so that it is requested again
+func (s *scheduler) rejected(pc *peerconn.PeerConn, index, begin int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.partial[index]
+	if !ok || begin%maxBlockSize != 0 || begin >= len(p.data) {
+		return
+	}
+	b := &p.blocks[begin/maxBlockSize]
+	for j, owner := range b.owners {
+		if owner == pc {
+			b.owners = append(b.owners[:j], b.owners[j+1:]...)
+			s.inflight[pc]--
+			return
+		}
+	}
+}
+
+// release forgets the blocks requested from pc, when the peer chokes us or
+// goes away, so that other peers request them
+func (s *scheduler) release(pc *peerconn.PeerConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.partial {
+		for i := range p.blocks {
+			b := &p.blocks[i]
+			for j, owner := range b.owners {
+				if owner == pc {
+					b.owners = append(b.owners[:j], b.owners[j+1:]...)
+					break
+				}
+			}
+		}
+	}
+	delete(s.inflight, pc)
+}
+
+// savedPiece is a partial piece as saved in the resume data
+type savedPiece struct {
+	index  int
+	blocks bitfield.Bitfield // received blocks
+	data   []byte
+}
+
+// partialPieces returns a copy of the pieces with blocks received
+func (s *scheduler) partialPieces() []savedPiece {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var saved []savedPiece
+	for index, p := range s.partial {
+		if p.received == 0 {
+			continue
+		}
+		sp := savedPiece{index, bitfield.New(len(p.blocks)), append([]byte(nil), p.data...)}
+		for i := range p.blocks {
+			if p.blocks[i].received {
+				sp.blocks.SetPiece(i)
+			}
+		}
+		saved = append(saved, sp)
+	}
+	return saved
+}
+
+// restore puts back a partial piece of a previous run, data holding the
+// blocks set in blocks
+func (s *scheduler) restore(index int, blocks bitfield.Bitfield, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := &partialPiece{
+		data:   data,
+		blocks: make([]block, (len(data)+maxBlockSize-1)/maxBlockSize),
+	}
+	for i := range p.blocks {
+		if blocks.HasPiece(i) {
+			p.blocks[i].received = true
+			p.received++
+		}
+	}
+	if p.received == 0 || p.received == len(p.blocks) {
+		return
+	}
+	s.picker.Start(index)
+	s.partial[index] = p
+}
+
+// wastedBytes returns the bytes of blocks received more than once or unasked
+func (s *scheduler) wastedBytes() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.wasted
+}
@@ -0,0 +1,392 @@
+package torrent
+
+import (
+	"bytes"
+	"swiftpeer/client/bitfield"
+	"swiftpeer/client/peerconn"
+	"swiftpeer/client/picker"
+	"testing"
+	"time"
+)
+
+func allPieces(n int) bitfield.Bitfield {
+	bf := bitfield.New(n)
+	for i := 0; i < n; i++ {
+		bf.SetPiece(i)
+	}
+	return bf
+}
+
+func newTestScheduler(numPieces, pieceLength int, totalLength int64) *scheduler {
+	p := picker.New(numPieces)
+	p.AddPeer(allPieces(numPieces))
+	return newScheduler(p, pieceLength, totalLength)
+}
+
+// blockData returns the content of a block, distinct for every block
+func blockData(r blockRequest) []byte {
+	data := make([]byte, r.length)
+	for i := range data {
+		data[i] = byte(r.index*31 + r.begin/maxBlockSize*7 + i)
+	}
+	return data
+}
+
+func TestSchedulerSharesPiece(t *testing.T) {
+	tests := []struct {
+		name        string
+		pieceLength int
+		peers       int
+		wantBlocks  int
+	}{
+		{
+			name:        "One block",
+			pieceLength: maxBlockSize,
+			peers:       2,
+			wantBlocks:  1,
+		},
+		{
+			name:        "Short last block",
+			pieceLength: 2*maxBlockSize + 100,
+			peers:       2,
+			wantBlocks:  3,
+		},
+		{
+			name:        "As many peers as blocks",
+			pieceLength: 3 * maxBlockSize,
+			peers:       3,
+			wantBlocks:  3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestScheduler(1, tt.pieceLength, int64(tt.pieceLength))
+			has := allPieces(1)
+			peers := make([]*peerconn.PeerConn, tt.peers)
+			for i := range peers {
+				peers[i] = &peerconn.PeerConn{}
+			}
+
+			// the peers take turns until every block is requested
+			var requests []blockRequest
+			from := make(map[blockRequest]*peerconn.PeerConn)
+			for i := 0; len(requests) < tt.wantBlocks; i++ {
+				pc := peers[i%len(peers)]
+				r, ok := s.next(pc, has)
+				if !ok {
+					t.Fatalf("next() found nothing after %d of %d blocks", len(requests), tt.wantBlocks)
+				}
+				if _, dup := from[r]; dup {
+					t.Fatalf("block %+v requested twice", r)
+				}
+				if r.index != 0 || r.begin != len(requests)*maxBlockSize {
+					t.Fatalf("next() = %+v, want block %d of piece 0", r, len(requests))
+				}
+				if want := min(maxBlockSize, tt.pieceLength-r.begin); r.length != want {
+					t.Fatalf("block at %d has length %d, want %d", r.begin, r.length, want)
+				}
+				requests = append(requests, r)
+				from[r] = pc
+			}
+
+			var want []byte
+			for i, r := range requests {
+				want = append(want, blockData(r)...)
+				data, cancel, err := s.received(from[r], r.index, r.begin, blockData(r))
+				if err != nil {
+					t.Fatalf("received() error = %v", err)
+				}
+				if len(cancel) != 0 {
+					t.Errorf("received() asked to cancel %d requests of a single copy", len(cancel))
+				}
+				if last := i == len(requests)-1; last != (data != nil) {
+					t.Fatalf("received() returned data = %v after block %d of %d", data != nil, i+1, len(requests))
+				}
+				if data != nil && !bytes.Equal(data, want) {
+					t.Errorf("piece data doesn't match the blocks")
+				}
+			}
+			for _, pc := range peers {
+				if got := s.pending(pc); got != 0 {
+					t.Errorf("pending() = %d with every block received", got)
+				}
+			}
+		})
+	}
+}
+
+func TestSchedulerRelease(t *testing.T) {
+	tests := []struct {
+		name string
+		drop func(s *scheduler, pc *peerconn.PeerConn, r blockRequest)
+	}{
+		{
+			name: "Choked or disconnected",
+			drop: func(s *scheduler, pc *peerconn.PeerConn, r blockRequest) { s.release(pc) },
+		},
+		{
+			name: "Request rejected",
+			drop: func(s *scheduler, pc *peerconn.PeerConn, r blockRequest) { s.rejected(pc, r.index, r.begin) },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// two pieces so that the third peer could start a new one
+			s := newTestScheduler(2, 2*maxBlockSize, 4*maxBlockSize)
+			a, b, c := &peerconn.PeerConn{}, &peerconn.PeerConn{}, &peerconn.PeerConn{}
+			has := allPieces(2)
+
+			first, _ := s.next(a, has)
+			second, _ := s.next(b, has)
+			if first.index != second.index {
+				t.Fatalf("the second peer started piece %d instead of sharing piece %d", second.index, first.index)
+			}
+			if _, _, err := s.received(a, first.index, first.begin, blockData(first)); err != nil {
+				t.Fatalf("received() error = %v", err)
+			}
+
+			tt.drop(s, b, second)
+			if got := s.pending(b); got != 0 {
+				t.Errorf("pending() = %d after the requests were dropped", got)
+			}
+			r, ok := s.next(c, has)
+			if !ok || r != second {
+				t.Fatalf("next() = %+v, %v, want the dropped block %+v", r, ok, second)
+			}
+			data, _, err := s.received(c, r.index, r.begin, blockData(r))
+			if err != nil {
+				t.Fatalf("received() error = %v", err)
+			}
+			if want := append(blockData(first), blockData(second)...); !bytes.Equal(data, want) {
+				t.Errorf("the piece lost the block received before the drop")
+			}
+		})
+	}
+}
+
+func TestSchedulerTimeout(t *testing.T) {
+	// the second piece stays unpicked, so this isn't endgame
+	s := newTestScheduler(2, maxBlockSize, 2*maxBlockSize)
+	a, b := &peerconn.PeerConn{}, &peerconn.PeerConn{}
+
+	r, ok := s.next(a, allPieces(1))
+	if !ok {
+		t.Fatalf("next() found nothing")
+	}
+	if _, ok := s.next(b, allPieces(1)); ok {
+		t.Fatalf("next() handed out a block requested just now")
+	}
+
+	s.partial[r.index].blocks[0].requestedAt = time.Now().Add(-blockTimeout - time.Second)
+	if got, ok := s.next(b, allPieces(1)); !ok || got != r {
+		t.Fatalf("next() = %+v, %v, want the timed out block %+v", got, ok, r)
+	}
+	if _, ok := s.next(a, allPieces(1)); ok {
+		t.Errorf("next() handed a block back to the peer sitting on it")
+	}
+
+	data, cancel, err := s.received(b, r.index, r.begin, blockData(r))
+	if err != nil {
+		t.Fatalf("received() error = %v", err)
+	}
+	if data == nil {
+		t.Errorf("received() didn't complete the piece")
+	}
+	if len(cancel) != 1 || cancel[0] != a {
+		t.Errorf("received() cancels %v, want the slow peer", cancel)
+	}
+}
+
+func TestSchedulerUnsolicited(t *testing.T) {
+	tests := []struct {
+		name string
+		send func(s *scheduler, owner, other *peerconn.PeerConn) *peerconn.PeerConn
+	}{
+		{
+			name: "Never requested from the peer",
+			send: func(s *scheduler, owner, other *peerconn.PeerConn) *peerconn.PeerConn { return other },
+		},
+		{
+			name: "Released from the peer",
+			send: func(s *scheduler, owner, other *peerconn.PeerConn) *peerconn.PeerConn {
+				s.release(owner)
+				return owner
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestScheduler(1, maxBlockSize, maxBlockSize)
+			owner, other := &peerconn.PeerConn{}, &peerconn.PeerConn{}
+			r, ok := s.next(owner, allPieces(1))
+			if !ok {
+				t.Fatalf("next() found nothing")
+			}
+
+			from := tt.send(s, owner, other)
+			data, cancel, err := s.received(from, r.index, r.begin, blockData(r))
+			if err != nil || data != nil || cancel != nil {
+				t.Fatalf("received() = %v, %v, %v, want the block dropped", data != nil, cancel, err)
+			}
+			if got := s.wastedBytes(); got != int64(r.length) {
+				t.Errorf("wastedBytes() = %d, want %d", got, r.length)
+			}
+
+			if s.partial[r.index].blocks[0].received {
+				t.Fatalf("the dropped block is marked received")
+			}
+			// the peer it was requested from still completes the piece
+			if from == other {
+				if data, _, err := s.received(owner, r.index, r.begin, blockData(r)); err != nil || data == nil {
+					t.Errorf("received() = %v, %v from the owner, want the piece", data != nil, err)
+				}
+			}
+		})
+	}
+}
+
+func TestSchedulerRestore(t *testing.T) {
+	const pieceLength = 3 * maxBlockSize
+
+	tests := []struct {
+		name        string
+		blocks      bitfield.Bitfield
+		wantPartial bool
+		wantNext    int // begin of the next block requested
+	}{
+		{
+			name:        "Missing block requested",
+			blocks:      bitfield.Bitfield{0xa0},
+			wantPartial: true,
+			wantNext:    maxBlockSize,
+		},
+		{
+			name:        "No block received",
+			blocks:      bitfield.Bitfield{0x00},
+			wantPartial: false,
+			wantNext:    0,
+		},
+		{
+			name:        "Every block received",
+			blocks:      bitfield.Bitfield{0xe0},
+			wantPartial: false,
+			wantNext:    0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestScheduler(1, pieceLength, pieceLength)
+			var saved []byte
+			for b := 0; b < 3; b++ {
+				saved = append(saved, blockData(s.blockRequest(0, b))...)
+			}
+			s.restore(0, tt.blocks, append([]byte(nil), saved...))
+
+			if _, ok := s.partial[0]; ok != tt.wantPartial {
+				t.Fatalf("piece restored = %v, want %v", ok, tt.wantPartial)
+			}
+			if tt.wantPartial {
+				got := s.partialPieces()
+				if len(got) != 1 || got[0].index != 0 || !bytes.Equal(got[0].blocks, tt.blocks) {
+					t.Errorf("partialPieces() = %+v, want piece 0 with blocks %08b", got, tt.blocks)
+				}
+			}
+
+			pc := &peerconn.PeerConn{}
+			r, ok := s.next(pc, allPieces(1))
+			if !ok || r.index != 0 || r.begin != tt.wantNext {
+				t.Fatalf("next() = %+v, %v, want the block at %d", r, ok, tt.wantNext)
+			}
+			if !tt.wantPartial {
+				return
+			}
+			if _, ok := s.next(pc, allPieces(1)); ok {
+				t.Errorf("next() requested a restored block")
+			}
+			data, _, err := s.received(pc, r.index, r.begin, blockData(r))
+			if err != nil {
+				t.Fatalf("received() error = %v", err)
+			}
+			if !bytes.Equal(data, saved) {
+				t.Errorf("piece data doesn't match the restored and received blocks")
+			}
+		})
+	}
+}
+
+func TestSchedulerEndgame(t *testing.T) {
+	s := newTestScheduler(1, 2*maxBlockSize, 2*maxBlockSize)
+	a, b, c, d := &peerconn.PeerConn{}, &peerconn.PeerConn{}, &peerconn.PeerConn{}, &peerconn.PeerConn{}
+	has := allPieces(1)
+
+	first, _ := s.next(a, has)
+	second, _ := s.next(b, has)
+	if s.endgame {
+		t.Fatalf("endgame entered before every block was requested")
+	}
+
+	// every remaining block is requested, the other peers duplicate them
+	var duplicates []blockRequest
+	for _, pc := range []*peerconn.PeerConn{c, d} {
+		for i := 0; i < 2; i++ {
+			r, ok := s.next(pc, has)
+			if !ok {
+				t.Fatalf("next() found nothing in endgame")
+			}
+			duplicates = append(duplicates, r)
+		}
+		if r, ok := s.next(pc, has); ok {
+			t.Fatalf("next() = %+v, requested twice from the same peer", r)
+		}
+	}
+	if !s.endgame {
+		t.Fatalf("endgame not entered with every block requested")
+	}
+	if want := []blockRequest{first, second, first, second}; !equalRequests(duplicates, want) {
+		t.Errorf("duplicate requests = %+v, want %+v", duplicates, want)
+	}
+
+	// the first copy cancels the others
+	_, cancel, err := s.received(a, first.index, first.begin, blockData(first))
+	if err != nil {
+		t.Fatalf("received() error = %v", err)
+	}
+	if len(cancel) != 2 || cancel[0] != c || cancel[1] != d {
+		t.Errorf("received() cancels %v, want the two other peers", cancel)
+	}
+	for _, pc := range []*peerconn.PeerConn{a, c, d} {
+		if got, want := s.pending(pc), map[*peerconn.PeerConn]int{a: 0, c: 1, d: 1}[pc]; got != want {
+			t.Errorf("pending() = %d after the first block, want %d", got, want)
+		}
+	}
+
+	// a copy already on its way is wasted, before and after the piece completes
+	if data, _, _ := s.received(c, first.index, first.begin, blockData(first)); data != nil {
+		t.Errorf("received() completed the piece with a duplicate")
+	}
+	if data, _, _ := s.received(b, second.index, second.begin, blockData(second)); data == nil {
+		t.Errorf("received() didn't complete the piece")
+	}
+	if _, _, err := s.received(d, second.index, second.begin, blockData(second)); err != nil {
+		t.Errorf("received() error = %v for a block of a completed piece", err)
+	}
+	if got, want := s.wastedBytes(), int64(first.length+second.length); got != want {
+		t.Errorf("wastedBytes() = %d, want %d", got, want)
+	}
+}
+
+func equalRequests(a, b []blockRequest) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
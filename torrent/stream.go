@@ -0,0 +1,194 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// streamReadahead is how much of a file ahead of a reader is downloaded
+// before anything else
+const streamReadahead = 8 << 20
+
+var errReaderClosed = errors.New("reader closed")
+
+// Reader reads a file of the torrent while it downloads. A read waits for
+// the pieces it needs to be verified, the pieces ahead of it get the high
+// priority.
+type Reader struct {
+	t           *Torrent
+	file        FileData
+	pos         int64
+	first, last int  // the window of high priority pieces, guarded by t.priorityMu
+	closed      bool // guarded by t.haveMu
+}
+
+// NewReader returns a reader of file i, it must be closed to give up the
+// priority of the pieces it is waiting for
+func (t *Torrent) NewReader(i int) (*Reader, error) {
+	if i < 0 || i >= len(t.Files) {
+		return nil, fmt.Errorf("no file %d in the torrent, it has %d", i, len(t.Files))
+	}
+	return &Reader{t: t, file: t.Files[i]}, nil
+}
+
+// SetSequential downloads the pieces of a priority in order rather than the
+// rarest first
+func (t *Torrent) SetSequential(sequential bool) {
+	t.picker.SetSequential(sequential)
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.pos >= r.file.Length {
+		return 0, io.EOF
+	}
+	t := r.t
+	offset := r.file.Start + r.pos
+	index := int(offset / int64(t.PieceLength))
+	lastPiece := int((r.file.Start + r.file.Length - 1) / int64(t.PieceLength))
+	t.setWindow(r, index, min(index+max(streamReadahead/t.PieceLength, 1), lastPiece+1))
+
+	if err := t.waitPiece(r, index); err != nil {
+		return 0, err
+	}
+	begin := int(offset - int64(index)*int64(t.PieceLength))
+	n := int(min(int64(len(p)), r.file.Length-r.pos, int64(t.computeSize(index)-begin)))
+	if err := t.storage.ReadAt(index, begin, p[:n]); err != nil {
+		return 0, err
+	}
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.file.Length
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position %d", offset)
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+// Close gives up the priority of the pieces ahead of the reader and makes a
+// read waiting for a piece fail
+func (r *Reader) Close() error {
+	r.t.setWindow(r, 0, 0)
+	r.t.haveMu.Lock()
+	r.closed = true
+	r.t.haveCond.Broadcast()
+	r.t.haveMu.Unlock()
+	return nil
+}
+
+// setWindow moves the high priority window of r to the pieces [first, last)
+func (t *Torrent) setWindow(r *Reader, first, last int) {
+	t.priorityMu.Lock()
+	defer t.priorityMu.Unlock()
+	if r.first == first && r.last == last {
+		return
+	}
+	oldFirst, oldLast := r.first, r.last
+	r.first, r.last = first, last
+	if first < last {
+		t.readers[r] = struct{}{}
+	} else {
+		delete(t.readers, r)
+	}
+
+	for index := oldFirst; index < oldLast; index++ {
+		t.picker.SetPriority(index, t.piecePriority(index))
+	}
+	for index := first; index < last; index++ {
+		t.picker.SetPriority(index, t.piecePriority(index))
+	}
+}
+
+// streamed reports whether a reader waits for the piece soon, t.priorityMu
+// must be held
+func (t *Torrent) streamed(index int) bool {
+	for r := range t.readers {
+		if index >= r.first && index < r.last {
+			return true
+		}
+	}
+	return false
+}
+
+// waitPiece blocks until the piece is verified or r is closed. It fails once
+// Download returned without the piece, e.g. a piece of a skipped file.
+func (t *Torrent) waitPiece(r *Reader, index int) error {
+	t.haveMu.Lock()
+	defer t.haveMu.Unlock()
+	for !t.have.HasPiece(index) {
+		if r.closed {
+			return errReaderClosed
+		}
+		select {
+		case <-t.done:
+			return fmt.Errorf("piece %d was not downloaded", index)
+		default:
+		}
+		t.haveCond.Wait()
+	}
+	return nil
+}
+
+// ServeHTTP serves each file of the torrent at its path in the torrent, with
+// range requests, while it downloads. The root lists the files.
+func (t *Torrent) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(req.URL.Path, "/")
+	if name == "" {
+		t.serveIndex(w)
+		return
+	}
+	for i, file := range t.Files {
+		if filepath.ToSlash(file.Path) != name {
+			continue
+		}
+		r, err := t.NewReader(i)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer r.Close()
+		// a read waiting for a piece gives up when the client goes away
+		stop := context.AfterFunc(req.Context(), func() { r.Close() })
+		defer stop()
+
+		http.ServeContent(w, req, path.Base(name), time.Time{}, r)
+		return
+	}
+	http.NotFound(w, req)
+}
+
+func (t *Torrent) serveIndex(w http.ResponseWriter) {
+	have := t.haveBitfield()
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<title>%s</title>\n<ul>\n", html.EscapeString(t.Name))
+	for _, file := range t.Files {
+		link := (&url.URL{Path: "/" + filepath.ToSlash(file.Path)}).String()
+		done := 100.0
+		if file.Length > 0 {
+			done = float64(t.verifiedBytes(have, file.Start, file.Start+file.Length)) * 100 / float64(file.Length)
+		}
+		fmt.Fprintf(w, "<li><a href=\"%s\">%s</a> %d bytes, %.1f%%</li>\n",
+			html.EscapeString(link), html.EscapeString(file.Path), file.Length, done)
+	}
+	fmt.Fprint(w, "</ul>\n")
+}
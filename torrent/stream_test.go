@@ -0,0 +1,102 @@
+package torrent
+
+import (
+	"bytes"
+	"io"
+	"swiftpeer/client/storage"
+	"testing"
+	"time"
+)
+
+func TestReaderAfterDownload(t *testing.T) {
+	// file a is downloaded and file b skipped
+	a, b := randomBytes(2*maxBlockSize), randomBytes(2*maxBlockSize)
+	md := buildTorrent(t, maxBlockSize, a, b)
+	tr, err := newTorrent(md, [20]byte{}, 0, nil, t.TempDir(), storage.NewMemory(), nil)
+	if err != nil {
+		t.Fatalf("newTorrent() error = %v", err)
+	}
+	defer tr.Close()
+	if err := tr.SetFilePriority(1, PrioritySkip); err != nil {
+		t.Fatal(err)
+	}
+	for index := 0; index < 2; index++ {
+		if err := tr.handlePiece(index, a[index*maxBlockSize:(index+1)*maxBlockSize]); err != nil {
+			t.Fatalf("handlePiece() error = %v", err)
+		}
+		tr.markHave(index)
+		tr.picker.Done(index)
+	}
+
+	if err := tr.Download(nil); err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+
+	ra, err := tr.NewReader(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ra.Close()
+	got, err := io.ReadAll(ra)
+	if err != nil || !bytes.Equal(got, a) {
+		t.Errorf("ReadAll() of the downloaded file = %d bytes, %v, want %d bytes", len(got), err, len(a))
+	}
+
+	rb, err := tr.NewReader(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rb.Close()
+	read := make(chan error, 1)
+	go func() {
+		_, err := rb.Read(make([]byte, 10))
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		if err == nil {
+			t.Errorf("Read() of a skipped piece succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Read() of a skipped piece still waiting after Download returned")
+	}
+}
+
+func TestReaderDownloadStopped(t *testing.T) {
+	md := buildTorrent(t, maxBlockSize, randomBytes(2*maxBlockSize))
+	tr, err := newTorrent(md, [20]byte{}, 0, nil, t.TempDir(), storage.NewMemory(), nil)
+	if err != nil {
+		t.Fatalf("newTorrent() error = %v", err)
+	}
+	defer tr.Close()
+	r, err := tr.NewReader(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	read := make(chan error, 1)
+	go func() {
+		_, err := r.Read(make([]byte, 10))
+		read <- err
+	}()
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() { done <- tr.Download(stop) }()
+	select {
+	case err := <-read:
+		t.Fatalf("Read() = %v while downloading", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(stop)
+	<-done
+	select {
+	case err := <-read:
+		if err == nil {
+			t.Errorf("Read() succeeded without the piece")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Read() still waiting after Download returned")
+	}
+}
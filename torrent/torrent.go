@@ -5,60 +5,88 @@ import (
 	"crypto/sha1"
 	"fmt"
 	"github.com/schollz/progressbar/v3"
-	"log"
+	"net"
 	"os"
-	"path/filepath"
 	"runtime"
-	"swiftpeer/client/filewriter"
+	"strconv"
+	"swiftpeer/client/bitfield"
+	"swiftpeer/client/choker"
+	"swiftpeer/client/dht"
+	"swiftpeer/client/magnet"
 	"swiftpeer/client/message"
 	"swiftpeer/client/peer"
 	"swiftpeer/client/peerconn"
+	"swiftpeer/client/pex"
+	"swiftpeer/client/picker"
+	"swiftpeer/client/storage"
 	"swiftpeer/client/torrent/metadata"
 	"swiftpeer/client/tracker"
+	"swiftpeer/client/utmetadata"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
-const maxRequest = 5
 const maxBlockSize = 2 << 13
 
-var activeConns int32
+// stallTimeout is how long the download may go without a piece before it is
+// given up, only once no peer is left to download from
+var stallTimeout = 30 * time.Second
+
+const (
+	// maxKnownPeers bounds the peer set grown through peer exchange
+	maxKnownPeers = 1000
+	// maxActiveConns is the connection count above which no new peer is dialed
+	maxActiveConns = 80
+	// dialsPerSecond rate limits connections to peers learned while downloading
+	dialsPerSecond = 5
+	// requestTimeout is how long a peer may stay silent while we wait
+	// for blocks it was asked for
+	requestTimeout = 30 * time.Second
+	// dhtInterval is how often we look up peers on the DHT and announce us
+	dhtInterval = 15 * time.Minute
+)
 
 type FileData struct {
-	Length     int
-	Path       string
-	Writer     *filewriter.FileWriter
-	Downloaded int
-	Completed  bool
-	Start      int
+	Length   int64
+	Path     string
+	Start    int64 // offset of the file in the torrent
+	Priority int
 }
 
 // Torrent used to store the necessary information to download  the peers
 type Torrent struct {
 	Name        string
-	TotalLength int
+	TotalLength int64
 	InfoHash    [20]byte
 	PieceHashes [][20]byte
 	PieceLength int
 	PeerID      [20]byte
 	Peers       peer.AddrSet
 	Files       []FileData
-}
-
-// used to track the progress of a piece
-type pieceState struct {
-	peerConn   *peerconn.PeerConn
-	index      int
-	downloaded int
-	requested  int
-	left       int
-	data       []byte
-}
 
-type pieceTask struct {
-	index  int
-	hash   [20]byte
-	length int
+	extensions *peerconn.Extensions
+	pex        *pex.Handler
+	picker     *picker.Picker
+	choker     *choker.Choker
+	scheduler  *scheduler
+	dht        *dht.Server // nil when the DHT is disabled or the torrent is private
+	peersMu    sync.Mutex  // guards Peers, conns and dialing
+	conns      map[*peerconn.PeerConn]struct{}
+	dialing    int                  // connections being set up, not in conns yet
+	candidates chan string          // peers learned while downloading, not dialed yet
+	completed  chan *pieceCompleted // pieces verified by the peers, written by Download
+	done       chan struct{}        // closed when Download returns
+
+	haveMu     sync.Mutex
+	haveCond   *sync.Cond        // broadcast when a piece is verified
+	have       bitfield.Bitfield // verified pieces, served to peers
+	priorityMu sync.Mutex        // guards the file priorities and readers
+	readers    map[*Reader]struct{}
+	basePath   string          // where the resume data is saved
+	storage    storage.Torrent // the data of the pieces
+	uploaded   int64           // atomic
+	downloaded int64           // atomic, verified bytes including previous runs
 }
 
 type pieceCompleted struct {
@@ -66,28 +94,140 @@ type pieceCompleted struct {
 	buf   []byte
 }
 
-func NewTorrent(pathToTorrentFile string, peerId [20]byte, port int, outDir string) (*Torrent, error) {
+// NewTorrent finds peers through the trackers of the torrent file and the
+// DHT, node can be nil to rely on trackers only. The data is kept in store,
+// or in files mapped to memory under outDir when it is nil.
+func NewTorrent(pathToTorrentFile string, peerId [20]byte, port int, outDir string, store storage.Storage, node *dht.Server) (*Torrent, error) {
 	md, err := metadata.NewMetadataFromFile(pathToTorrentFile)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load metadata: %v", err)
 	}
-	pHashes, err := md.PieceHashes()
+
+	// private torrents must only get peers from their trackers (BEP 27)
+	if md.IsPrivate() {
+		node = nil
+	}
+
+	peers := make(peer.AddrSet)
+	err = findPeers(md.Announce, md.AnnounceList, port, md.InfoHash, peerId, node, peers)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get piece hashes: %v", err)
+		return nil, err
+	}
+
+	t, err := newTorrent(md, peerId, port, peers, outDir, store, node)
+	if err != nil {
+		return nil, err
+	}
+	t.restore()
+	return t, nil
+}
+
+// NewTorrentFromMagnet finds peers through the trackers and peers of the
+// magnet link and the DHT, and downloads the info dictionary from them
+func NewTorrentFromMagnet(uri string, peerId [20]byte, port int, outDir string, store storage.Storage, node *dht.Server) (*Torrent, error) {
+	mg, err := magnet.Parse(uri)
+	if err != nil {
+		return nil, err
 	}
 
 	peers := make(peer.AddrSet)
+	for _, addr := range mg.Peers {
+		peers[addr] = struct{}{}
+	}
+
+	err = findPeers("", magnetTiers(mg.Trackers), port, mg.InfoHash, peerId, node, peers)
+	if err != nil && len(peers) == 0 {
+		return nil, err
+	}
+
+	info, err := utmetadata.FetchFromPeers(peers, mg.InfoHash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch metadata: %v", err)
+	}
+	md, err := metadata.NewMetadataFromInfo(info)
+	if err != nil {
+		return nil, err
+	}
+	md.AnnounceList = magnetTiers(mg.Trackers)
+	md.URLList = mg.WebSeeds
+	fmt.Printf("[INFO] fetched metadata for %v\n", md.Info.Name)
 
-	err = tracker.GetTorrentData(md.Announce, md.AnnounceList, port, md.InfoHash, peerId, peers)
+	if md.IsPrivate() {
+		node = nil
+	}
+	t, err := newTorrent(md, peerId, port, peers, outDir, store, node)
 	if err != nil {
 		return nil, err
 	}
-	//TODO:remove this print
-	for p := range peers {
-		fmt.Println(p)
+	if len(mg.SelectOnly) > 0 {
+		if err := t.selectOnly(mg.SelectOnly); err != nil {
+			return nil, err
+		}
+	}
+	t.restore()
+	return t, nil
+}
+
+// magnetTiers puts the trackers of a magnet link in a single tier, there is
+// no tier without trackers
+func magnetTiers(trackers []string) [][]string {
+	if len(trackers) == 0 {
+		return nil
 	}
+	return [][]string{trackers}
+}
 
-	atomic.StoreInt32(&activeConns, int32(len(peers)))
+// findPeers adds the peers given by the trackers and the DHT to peers, the
+// DHT lookup also announces us
+func findPeers(announce string, announceList [][]string, port int, infoHash, peerId [20]byte, node *dht.Server, peers peer.AddrSet) error {
+	dhtPeers := make(chan []string, 1)
+	if node != nil {
+		go func() {
+			addrs, err := node.Announce(infoHash, port)
+			if err != nil {
+				fmt.Printf("[INFO] DHT lookup failed: %v\n", err)
+			}
+			dhtPeers <- addrs
+		}()
+	} else {
+		dhtPeers <- nil
+	}
+
+	var trackerErr error
+	hasTrackers := announce != ""
+	for _, tier := range announceList {
+		hasTrackers = hasTrackers || len(tier) > 0
+	}
+	if hasTrackers {
+		trackerErr = tracker.GetTorrentData(announce, announceList, port, infoHash, peerId, peers)
+	}
+
+	addrs := <-dhtPeers
+	if node != nil {
+		fmt.Printf("[INFO] DHT returned %d peers\n", len(addrs))
+	}
+	for _, addr := range addrs {
+		peers[addr] = struct{}{}
+	}
+
+	if len(peers) > 0 {
+		return nil
+	}
+	if trackerErr != nil {
+		return trackerErr
+	}
+	return fmt.Errorf("no peers found on trackers or DHT")
+}
+
+func newTorrent(md *metadata.Metadata, peerId [20]byte, port int, peers peer.AddrSet, outDir string, store storage.Storage, node *dht.Server) (*Torrent, error) {
+	pHashes, err := md.PieceHashes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get piece hashes: %v", err)
+	}
+
+	if peers == nil {
+		peers = make(peer.AddrSet)
+	}
 
 	t := &Torrent{
 		Peers:       peers,
@@ -97,171 +237,391 @@ func NewTorrent(pathToTorrentFile string, peerId [20]byte, port int, outDir stri
 		PieceLength: md.Info.PieceLength,
 		Name:        md.Info.Name,
 		Files:       make([]FileData, 0, len(md.Info.Files)),
+		extensions:  peerconn.NewExtensions(),
+		dht:         node,
+		conns:       make(map[*peerconn.PeerConn]struct{}),
+		candidates:  make(chan string, maxKnownPeers),
+		completed:   make(chan *pieceCompleted),
+		done:        make(chan struct{}),
+		picker:      picker.New(len(pHashes)),
+		choker:      choker.New(choker.DefaultSlots),
+		have:        bitfield.New(len(pHashes)),
+		readers:     make(map[*Reader]struct{}),
 	}
+	t.haveCond = sync.NewCond(&t.haveMu)
+	t.extensions.ListenPort = port
+	t.extensions.NumPieces = len(pHashes)
+	if node != nil {
+		t.extensions.DHTPort = node.Addr().Port
+	}
+	t.pex = pex.NewHandler(t.addPeers)
+	t.extensions.Register(pex.Name, t.pex)
 
-	if md.Info.Length != 0 {
+	// the paths come from the torrent, they must not leave outDir
+	paths, moved, err := md.Layout()
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range moved {
+		fmt.Printf("[INFO] saving %q as %q\n", m.Original, m.Path)
+	}
+
+	for i, file := range md.Files() {
 		t.Files = append(t.Files, FileData{
-			Length: md.Info.Length,
-			Path:   md.Info.Name,
+			Length:   file.Length,
+			Path:     paths[i],
+			Start:    t.TotalLength,
+			Priority: PriorityNormal,
 		})
-		t.TotalLength = md.Info.Length
-	} else {
-		for _, file := range md.Info.Files {
-			paths := append([]string{md.Info.Name}, file.Path...)
-			t.Files = append(t.Files, FileData{
-				Length: file.Length,
-				Path:   filepath.Join(paths...),
-			})
-			t.TotalLength += file.Length
+		t.TotalLength += file.Length
+	}
+	for _, file := range t.Files {
+		if file.Length < 0 {
+			return nil, fmt.Errorf("negative length for %v", file.Path)
 		}
-
 	}
+	if t.PieceLength <= 0 || int64(len(pHashes)) != (t.TotalLength+int64(t.PieceLength)-1)/int64(t.PieceLength) {
+		return nil, fmt.Errorf("%d pieces of %d bytes don't fit %d bytes of files", len(pHashes), t.PieceLength, t.TotalLength)
+	}
+	t.scheduler = newScheduler(t.picker, t.PieceLength, t.TotalLength)
 
+	if store == nil {
+		store = storage.NewMmap(outDir)
+	}
+	info := storage.Info{PieceLength: t.PieceLength}
 	for _, file := range t.Files {
-		outPath := filepath.Join(outDir, file.Path)
-		baseDir := filepath.Dir(outPath)
-		if _, err := os.Stat(baseDir); os.IsNotExist(err) {
-			if err := os.MkdirAll(baseDir, os.ModePerm); err != nil {
-				return nil, fmt.Errorf("making output directory: %w", err)
+		info.Files = append(info.Files, storage.File{Path: file.Path, Length: file.Length})
+	}
+	t.storage, err = store.OpenTorrent(info)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open storage: %v", err)
+	}
+	t.basePath = outDir
+	return t, nil
+}
+
+// downloadFrom requests blocks from pc until the download completes or
+// Download returns, keeping as many requests in flight as its pipeline asks
+// for while the peer doesn't choke us
+func (t *Torrent) downloadFrom(pc *peerconn.PeerConn, up *uploader) error {
+	defer t.scheduler.release(pc)
+
+	// a peer with nothing for us is dropped by the idle timeout of the
+	// connection, one sitting on our requests by requestTimeout
+	timer := time.NewTimer(requestTimeout)
+	defer timer.Stop()
+
+	for !t.picker.Complete() {
+		if has := requestable(pc); has != nil {
+			for t.scheduler.pending(pc) < pc.QueueDepth() {
+				r, ok := t.scheduler.next(pc, has)
+				if !ok {
+					break
+				}
+				if err := pc.SendRequestMsg(r.index, r.begin, r.length); err != nil {
+					return fmt.Errorf("failed to send request message for piece %d: %w", r.index, err)
+				}
+			}
+		}
+
+		var timeout <-chan time.Time
+		if t.scheduler.pending(pc) > 0 {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(requestTimeout)
+			timeout = timer.C
+		}
+
+		var m *message.Message
+		select {
+		case msg, ok := <-pc.Events():
+			if !ok {
+				return pc.Err()
+			}
+			m = msg
+		case <-timeout:
+			return fmt.Errorf("no block received for %v", requestTimeout)
+		case <-t.done:
+			return nil
+		}
+
+		switch m.Id {
+		case message.ChokeMsg:
+			pc.IsChoked = true
+			if !pc.SupportsFast {
+				// the peer discards our requests when it chokes us, with
+				// the fast extension it rejects them one by one instead
+				pc.ClearRequests()
+				t.scheduler.release(pc)
+			}
+		case message.UnchokeMsg:
+			pc.IsChoked = false
+		case message.RejectRequestMsg:
+			if !pc.SupportsFast {
+				return fmt.Errorf("reject request without the fast extension")
+			}
+			index, begin, _, err := m.ProcessRequestMsg()
+			if err != nil {
+				return err
+			}
+			pc.RequestRejected(index, begin)
+			t.scheduler.rejected(pc, index, begin)
+			if pc.IsChoked {
+				// don't ask again for a piece the peer no longer allows
+				pc.AllowedFast.ClearPiece(index)
+			}
+		case message.PieceMsg:
+			index, begin, block, err := m.ParsePieceMsg()
+			if err != nil {
+				return err
+			}
+			pc.BlockReceived(index, begin, len(block))
+			data, cancel, err := t.scheduler.received(pc, index, begin, block)
+			if err != nil {
+				return err
+			}
+			for _, other := range cancel {
+				other.SendCancel(index, begin, len(block))
+			}
+			if data == nil {
+				continue
+			}
+			if !checkIntegrity(index, t.PieceHashes[index], data) {
+				t.picker.Abort(index)
+				continue
+			}
+			// the piece is done once Download wrote it
+			select {
+			case t.completed <- &pieceCompleted{index, data}:
+			case <-t.done:
+				return nil
+			}
+		default:
+			if err := t.handlePeerMessage(pc, up, m); err != nil {
+				return err
 			}
 		}
 	}
+	return nil
+}
 
-	return t, nil
+// requestable returns the pieces we may request from pc, only the allowed
+// fast ones while it chokes us, nil when there is none
+func requestable(pc *peerconn.PeerConn) bitfield.Bitfield {
+	if !pc.IsChoked {
+		return pc.Pieces
+	}
+	if pc.AllowedFast == nil {
+		return nil
+	}
+	has := make(bitfield.Bitfield, len(pc.AllowedFast))
+	for i := range has {
+		if i < len(pc.Pieces) {
+			has[i] = pc.AllowedFast[i] & pc.Pieces[i]
+		}
+	}
+	return has
 }
 
-func (s *pieceState) handleMessage() error {
+func (t *Torrent) startTask(peer string) {
+	pc, err := peerconn.NewPeerConn(peer, t.InfoHash, t.extensions, t.haveBitfield())
+	t.peersMu.Lock()
+	t.dialing--
+	t.peersMu.Unlock()
+	if err != nil {
+		fmt.Printf("[INFO] failed to complete the handshake with %v. Disconnecting\n", peer)
+		return
+	}
+
+	defer pc.Close()
+
+	t.addConn(pc)
+	defer t.removeConn(pc)
 
-	m, err := s.peerConn.Read()
+	up := t.newUploader(pc)
+	defer up.close()
+
+	// the pieces of the peer are counted as its bitfield and haves arrive,
+	// pc.Pieces is replaced by a bitfield so only read it on return
+	defer func() { t.picker.RemovePeer(pc.Pieces) }()
+
+	fmt.Printf("[INFO] Completed the handshake with %v.\n", peer)
+
+	err = pc.SendInterested()
 	if err != nil {
-		return err
+		fmt.Printf("[INFO] failed to send interested to %v: %v\n", peer, err)
 	}
 
-	//checks for keep alive message which has length 0, no id and no payload
-	if m == nil {
-		return nil
+	if err := t.downloadFrom(pc, up); err != nil {
+		fmt.Printf("[INFO] stopped downloading from %v: %v\n", peer, err)
 	}
+	stats := pc.Stats()
+	fmt.Printf("[INFO] %v: downloaded %d bytes at %.1f KiB/s, rtt %v, queue depth %d\n",
+		peer, stats.Downloaded, stats.DownloadRate/1024, stats.RTT.Round(time.Millisecond), stats.QueueDepth)
+}
 
-	switch m.Id {
-	case message.ChokeMsg:
-		s.peerConn.IsChoked = true
-	case message.UnchokeMsg:
-		s.peerConn.IsChoked = false
-	case message.PieceMsg:
-		received, err := m.ProcessPieceMsg(s.index, s.data)
-		if err != nil {
-			fmt.Println("error during piece message")
-			return err
+// addPeers queues the peers we didn't know yet to be dialed by Download
+func (t *Torrent) addPeers(addrs []string) {
+	t.peersMu.Lock()
+	defer t.peersMu.Unlock()
+	for _, addr := range addrs {
+		if _, ok := t.Peers[addr]; ok || len(t.Peers) >= maxKnownPeers {
+			continue
 		}
-		s.downloaded += received
-		s.left--
-	case message.HaveMsg:
-		index, err := m.ProcessHaveMsg()
-		if err != nil {
-			fmt.Println("error during unchoke message")
-			return err
+		t.Peers[addr] = struct{}{}
+		select {
+		case t.candidates <- addr:
+		default:
 		}
-		s.peerConn.Pieces.SetPiece(index)
-	default:
-		return nil
 	}
-	return nil
 }
 
-func prepareDownload(pc *peerconn.PeerConn, task *pieceTask) ([]byte, error) {
-	state := pieceState{
-		peerConn: pc,
-		index:    task.index,
-		data:     make([]byte, task.length),
-	}
+func (t *Torrent) addConn(pc *peerconn.PeerConn) {
+	t.peersMu.Lock()
+	t.conns[pc] = struct{}{}
+	t.peersMu.Unlock()
+}
 
-	pc.Conn.SetDeadline(time.Now().Add(10 * time.Second))
-	defer pc.Conn.SetDeadline(time.Time{})
+func (t *Torrent) removeConn(pc *peerconn.PeerConn) {
+	t.peersMu.Lock()
+	delete(t.conns, pc)
+	t.peersMu.Unlock()
+	t.pex.Forget(pc)
+	t.choker.Forget(pc)
+}
 
-	for state.downloaded < task.length {
-		if !state.peerConn.IsChoked {
-			for state.left < maxRequest && state.requested < task.length {
-				blockSize := maxBlockSize
+// activeConns returns the number of connections established or being set up
+func (t *Torrent) activeConns() int {
+	t.peersMu.Lock()
+	defer t.peersMu.Unlock()
+	return len(t.conns) + t.dialing
+}
 
-				if task.length-state.requested < blockSize {
-					blockSize = task.length - state.requested
-				}
+// dial starts a task connecting to peer, counted as active right away
+func (t *Torrent) dial(peer string) {
+	t.peersMu.Lock()
+	t.dialing++
+	t.peersMu.Unlock()
+	go t.startTask(peer)
+}
 
-				err := pc.SendRequestMsg(task.index, state.requested, blockSize)
-				if err != nil {
-					log.Printf("Failed to send request message for piece %d: %v\n", task.index, err)
-					return nil, err
-				}
-				state.left++
-				state.requested += blockSize
+func (t *Torrent) connections() []*peerconn.PeerConn {
+	t.peersMu.Lock()
+	defer t.peersMu.Unlock()
+	conns := make([]*peerconn.PeerConn, 0, len(t.conns))
+	for pc := range t.conns {
+		conns = append(conns, pc)
+	}
+	return conns
+}
+
+// rechoke runs the choker over the connected peers
+func (t *Torrent) rechoke() {
+	t.choker.Rechoke(t.connections(), t.picker.Complete())
+}
+
+// Seed keeps choking and unchoking the peers downloading from us until stop
+// is closed, Download must have completed. The resume data is saved
+// periodically and on return, so that the uploaded bytes carry over.
+func (t *Torrent) Seed(stop <-chan struct{}) {
+	chokeTicker := time.NewTicker(choker.Interval)
+	defer chokeTicker.Stop()
+	resumeTicker := time.NewTicker(resumeInterval)
+	defer resumeTicker.Stop()
+	for {
+		select {
+		case <-chokeTicker.C:
+			t.rechoke()
+		case <-resumeTicker.C:
+			if err := t.saveResume(); err != nil {
+				fmt.Printf("[INFO] failed to save resume data: %v\n", err)
 			}
+		case <-stop:
+			if err := t.saveResume(); err != nil {
+				fmt.Printf("[INFO] failed to save resume data: %v\n", err)
+			}
+			return
 		}
+	}
+}
 
-		err := state.handleMessage()
-		if err != nil {
-			atomic.AddInt32(&activeConns, -1)
-			fmt.Println("\nerror while handling message in preparing download")
-			return nil, err
+// PeerStats returns the transfer statistics of every connected peer by address
+func (t *Torrent) PeerStats() map[string]peerconn.Stats {
+	t.peersMu.Lock()
+	defer t.peersMu.Unlock()
+	stats := make(map[string]peerconn.Stats, len(t.conns))
+	for pc := range t.conns {
+		stats[pc.Addr] = pc.Stats()
+	}
+	return stats
+}
+
+// sendPex sends our connected peers to every peer supporting ut_pex
+func (t *Torrent) sendPex() {
+	t.peersMu.Lock()
+	conns := make([]*peerconn.PeerConn, 0, len(t.conns))
+	addrs := make([]string, 0, len(t.conns))
+	for pc := range t.conns {
+		conns = append(conns, pc)
+		if addr, ok := listenAddr(pc); ok {
+			addrs = append(addrs, addr)
 		}
 	}
+	t.peersMu.Unlock()
 
-	return state.data, nil
+	for _, pc := range conns {
+		if err := t.pex.Send(pc, addrs); err != nil {
+			fmt.Printf("[INFO] failed to send peer exchange to %v: %v\n", pc.Addr, err)
+		}
+	}
 }
 
-func (t *Torrent) startTask(peer string, pieceQueue chan *pieceTask, completed chan *pieceCompleted) {
-	pc, err := peerconn.NewPeerConn(peer, t.InfoHash)
-
+// lookupDHT queues the peers the DHT knows and announces us again
+func (t *Torrent) lookupDHT() {
+	addrs, err := t.dht.Announce(t.InfoHash, t.extensions.ListenPort)
 	if err != nil {
-		fmt.Printf("[INFO] failed to complete the handshake with %v. Disconnecting\n", peer)
-		atomic.AddInt32(&activeConns, -1)
+		fmt.Printf("[INFO] DHT lookup failed: %v\n", err)
 		return
 	}
+	t.addPeers(addrs)
+}
 
-	defer pc.Conn.Close()
-
-	fmt.Printf("[INFO] Completed the handshake with %v.\n", peer)
-
-	err = pc.SendUnchoke()
-	if err != nil {
-		fmt.Printf("[INFO] failed to send unchoke to %v: %v\n", peer, err)
-		atomic.AddInt32(&activeConns, -1)
+// listenAddr is the address other peers can reach pc at, for incoming
+// connections it is only known once the peer announced its port
+func listenAddr(pc *peerconn.PeerConn) (string, bool) {
+	if !pc.Incoming {
+		return pc.Addr, true
 	}
-
-	err = pc.SendInterested()
+	port := pc.ListenPort()
+	if port == 0 {
+		return "", false
+	}
+	host, _, err := net.SplitHostPort(pc.Addr)
 	if err != nil {
-		fmt.Printf("[INFO] failed to send interested to %v: %v\n", peer, err)
-		atomic.AddInt32(&activeConns, -1)
+		return "", false
 	}
+	return net.JoinHostPort(host, strconv.Itoa(port)), true
+}
 
-	for pieceTask := range pieceQueue {
-		if !pc.Pieces.HasPiece(pieceTask.index) {
-			pieceQueue <- pieceTask
-			continue
-		}
-
-		buff, err := prepareDownload(pc, pieceTask)
-		if err != nil {
-			fmt.Printf("\nError downloading piece %d from %v:\n", pieceTask.index, peer)
-			fmt.Println(err)
-			//atomic.AddInt32(&activeConns, -1)
-			pieceQueue <- pieceTask
+// dialCandidates starts tasks for up to dialsPerSecond newly learned peers
+func (t *Torrent) dialCandidates() {
+	for i := 0; i < dialsPerSecond && t.activeConns() < maxActiveConns; i++ {
+		select {
+		case addr := <-t.candidates:
+			t.dial(addr)
+		default:
 			return
 		}
-
-		valid := checkIntegrity(pieceTask, buff)
-		if !valid {
-			pieceQueue <- pieceTask
-			continue
-		} else {
-			pc.SendHave(pieceTask.index)
-			completed <- &pieceCompleted{pieceTask.index, buff}
-		}
 	}
 }
 
-func (t *Torrent) computeBounds(index int) (int, int) {
-	begin := index * t.PieceLength
-	end := begin + t.PieceLength
+func (t *Torrent) computeBounds(index int) (int64, int64) {
+	begin := int64(index) * int64(t.PieceLength)
+	end := begin + int64(t.PieceLength)
 
 	if end > t.TotalLength {
 		end = t.TotalLength
@@ -271,41 +631,67 @@ func (t *Torrent) computeBounds(index int) (int, int) {
 
 func (t *Torrent) computeSize(index int) int {
 	begin, end := t.computeBounds(index)
-	return end - begin
+	return int(end - begin)
 }
 
-func checkIntegrity(task *pieceTask, data []byte) bool {
+func checkIntegrity(index int, hash [20]byte, data []byte) bool {
 	h := sha1.Sum(data)
-	if !bytes.Equal(h[:], task.hash[:]) {
-		fmt.Printf("index %v did not pass integrity check\n", task.index)
+	if !bytes.Equal(h[:], hash[:]) {
+		fmt.Printf("index %v did not pass integrity check\n", index)
 		return false
 	}
 	return true
 }
 
-func (t *Torrent) Download(path string) error {
-
-	if err := t.setupFiles(path); err != nil {
-		return err
-	}
-	defer t.finalCleanup()
+// Download fetches the missing pieces into the storage until every piece is
+// verified or stop is closed, it runs once per torrent. The progress is saved
+// periodically and on return, so that a later run resumes it.
+func (t *Torrent) Download(stop <-chan struct{}) error {
+	// the peer tasks stop handing over pieces and the readers waiting for a
+	// piece give up
+	defer func() {
+		close(t.done)
+		t.haveMu.Lock()
+		t.haveCond.Broadcast()
+		t.haveMu.Unlock()
+	}()
+	defer func() {
+		if err := t.saveResume(); err != nil {
+			fmt.Printf("[INFO] failed to save resume data: %v\n", err)
+		}
+	}()
 
 	fmt.Printf("Starting download for%v\n", t.Name)
-	piecesQueue := make(chan *pieceTask, len(t.PieceHashes))
-	completed := make(chan *pieceCompleted)
-	for idx, hash := range t.PieceHashes {
-		length := t.computeSize(idx)
-		piecesQueue <- &pieceTask{idx, hash, length}
-	}
 
+	t.peersMu.Lock()
+	peers := make([]string, 0, len(t.Peers))
 	for p := range t.Peers {
-		go t.startTask(p, piecesQueue, completed)
+		peers = append(peers, p)
+	}
+	t.peersMu.Unlock()
+	for _, p := range peers {
+		t.dial(p)
+	}
 
+	dialTicker := time.NewTicker(time.Second)
+	defer dialTicker.Stop()
+	pexTicker := time.NewTicker(pex.Interval)
+	defer pexTicker.Stop()
+	chokeTicker := time.NewTicker(choker.Interval)
+	defer chokeTicker.Stop()
+	resumeTicker := time.NewTicker(resumeInterval)
+	defer resumeTicker.Stop()
+	var dhtTick <-chan time.Time
+	if t.dht != nil {
+		dhtTicker := time.NewTicker(dhtInterval)
+		defer dhtTicker.Stop()
+		dhtTick = dhtTicker.C
 	}
 	//log.Printf("pieces in compeleted %v out of %v\n", len(completed), len(t.PieceHashes))
 
+	wanted, verified := t.wantedBytes()
 	bar := progressbar.NewOptions64(
-		int64(t.TotalLength),
+		wanted,
 		progressbar.OptionSetDescription("Downloading"),
 		progressbar.OptionSetWriter(os.Stdout),
 		progressbar.OptionShowBytes(true),
@@ -326,113 +712,72 @@ func (t *Torrent) Download(path string) error {
 		}),
 	)
 
-	finishedPieces := 0
+	bar.Set64(verified)
 	startTime := time.Now()
 	totalDownloaded := int64(0)
+	lastPiece := time.Now()
 
-	timeout := time.After(20 * time.Second)
-
-	for finishedPieces < len(t.PieceHashes) {
+	for !t.picker.Complete() {
 		select {
-		case piece := <-completed:
-			// Directly write to the appropriate file using memory-mapped region
+		case piece := <-t.completed:
 			if err := t.handlePiece(piece.index, piece.buf); err != nil {
 				fmt.Printf("Failed to handle piece %d: %v\n", piece.index, err)
 				return err
 			}
-			finishedPieces++
+			t.picker.Done(piece.index)
+			t.markHave(piece.index)
 			pieceSize := int64(len(piece.buf))
 			totalDownloaded += pieceSize
-			activeConnsCount := atomic.LoadInt32(&activeConns)
+			atomic.AddInt64(&t.downloaded, pieceSize)
+			activeConnsCount := t.activeConns()
 
 			elapsedTime := time.Since(startTime).Seconds()
 			speed := float64(totalDownloaded) / elapsedTime / 1024 / 1024 // MB/s
 
-			bar.Describe(fmt.Sprintf("Downloading (%.2f MB/s) - PeersAtomic: %d - PeersG: %d ", speed, activeConnsCount, runtime.NumGoroutine()-1))
+			uploadedMB := float64(atomic.LoadInt64(&t.uploaded)) / 1024 / 1024
+			wastedMB := float64(t.scheduler.wastedBytes()) / 1024 / 1024
 
-			//log.Printf("Downloaded piece #%d out of #%d\n", finishedPieces, len(t.PieceHashes))
-			timeout = time.After(30 * time.Second) // Reset timeout after each successful piece handling
-			//log.Printf("(%0.2f%%) Downloaded piece #%d from %d peers\n", float64(finishedPieces)/float64(len(t.PieceHashes))*100, piece.index, runtime.NumGoroutine()-1)
+			bar.Describe(fmt.Sprintf("Downloading (%.2f MB/s) - Uploaded: %.2f MB - Wasted: %.2f MB - PeersAtomic: %d - PeersG: %d ", speed, uploadedMB, wastedMB, activeConnsCount, runtime.NumGoroutine()-1))
+
+			lastPiece = time.Now()
 
 			if err := bar.Add64(pieceSize); err != nil {
 				fmt.Printf("Error updating progress bar: %v\n", err)
 			}
 
-		case <-timeout:
-			fmt.Printf("Timeout: No pieces completed within the last 30 seconds")
-			return fmt.Errorf("download timeout")
-		}
-	}
-	close(piecesQueue)
-
-	return nil
-}
-
-func (t *Torrent) setupFiles(basePath string) error {
-	currentPosition := 0
-	for i, file := range t.Files {
-		fullPath := filepath.Join(basePath, file.Path)
-		if err := os.MkdirAll(filepath.Dir(fullPath), os.ModePerm); err != nil {
-			return err
-		}
-		writer, err := filewriter.New(fullPath, file.Length)
-		if err != nil {
-			return err
-		}
-		t.Files[i].Writer = writer
-		t.Files[i].Start = currentPosition
-		currentPosition += file.Length
-	}
-	return nil
-}
+		case <-dialTicker.C:
+			t.dialCandidates()
+			if time.Since(lastPiece) > stallTimeout && t.activeConns() == 0 && len(t.candidates) == 0 {
+				fmt.Printf("[INFO] no piece completed within the last %v and no peer left\n", stallTimeout)
+				return fmt.Errorf("download stalled without peers")
+			}
 
-func (t *Torrent) computeBoundsForFile(file FileData) (int, int) {
-	return file.Start, file.Start + file.Length
-}
+		case <-pexTicker.C:
+			t.sendPex()
 
-func (t *Torrent) handlePiece(pieceIndex int, pieceData []byte) error {
-	begin, end := t.computeBounds(pieceIndex)
+		case <-chokeTicker.C:
+			t.rechoke()
 
-	for _, file := range t.Files {
-		if file.Completed {
-			continue
-		}
+		case <-dhtTick:
+			go t.lookupDHT()
 
-		fileStart, fileEnd := t.computeBoundsForFile(file)
-		//Check if the piece is between the bounds of the file
-		if begin < fileEnd && end > fileStart {
-			overlapStart := max(begin, fileStart)
-			overlapEnd := min(end, fileEnd)
-			offset := overlapStart - fileStart
-			data := pieceData[overlapStart-begin : overlapEnd-begin]
-			if err := file.Writer.WriteAt(data, offset); err != nil {
-				return err
+		case <-resumeTicker.C:
+			if err := t.saveResume(); err != nil {
+				fmt.Printf("[INFO] failed to save resume data: %v\n", err)
 			}
 
-			// Update downloaded count and check for completion
-			file.Downloaded += len(data)
-			if file.Downloaded >= file.Length {
-				file.Completed = true
-				if err := file.Writer.Sync(); err != nil {
-					return err
-				}
-				if err := file.Writer.Close(); err != nil {
-					return err
-				}
-			}
+		case <-stop:
+			return fmt.Errorf("download stopped")
 		}
 	}
+	fmt.Printf("[INFO] download complete, %d bytes wasted on duplicate or unrequested blocks\n", t.scheduler.wastedBytes())
 	return nil
 }
 
-func (t *Torrent) finalCleanup() error {
-	for _, file := range t.Files {
-		if !file.Completed {
-			if file.Writer != nil {
-				file.Writer.Sync()
-				file.Writer.Close()
-			}
-		}
+// handlePiece writes a verified piece to the storage
+func (t *Torrent) handlePiece(pieceIndex int, pieceData []byte) error {
+	if err := t.storage.WriteAt(pieceIndex, 0, pieceData); err != nil {
+		return err
 	}
-	return nil
+	return t.storage.MarkComplete(pieceIndex)
 }
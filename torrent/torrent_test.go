@@ -0,0 +1,227 @@
+package torrent
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"swiftpeer/client/bencode"
+	"swiftpeer/client/handshake"
+	"swiftpeer/client/message"
+	"swiftpeer/client/peer"
+	"swiftpeer/client/peerconn"
+	"swiftpeer/client/storage"
+	"swiftpeer/client/torrent/metadata"
+	"testing"
+	"time"
+)
+
+// buildTorrent creates a torrent of a file holding data, or of a directory
+// of files a.bin, b.bin... when given several
+func buildTorrent(t *testing.T, pieceLength int, files ...[]byte) *metadata.Metadata {
+	path := filepath.Join(t.TempDir(), "data")
+	if len(files) == 1 {
+		path += ".bin"
+		if err := os.WriteFile(path, files[0], 0644); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		if err := os.Mkdir(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for i, data := range files {
+			name := string(rune('a'+i)) + ".bin"
+			if err := os.WriteFile(filepath.Join(path, name), data, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	md, err := (&metadata.Builder{Path: path, PieceLength: pieceLength}).Build()
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	return md
+}
+
+// hangUp accepts connections, completes the handshake and closes them
+func hangUp(t *testing.T, infoHash [20]byte) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			hs := handshake.NewHandshake([20]byte{1}, infoHash)
+			if _, err := hs.Deserialize(conn); err == nil {
+				conn.Write(hs.Serialize())
+			}
+			conn.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestDownloadPeersGone(t *testing.T) {
+	timeout := stallTimeout
+	stallTimeout = 100 * time.Millisecond
+	defer func() { stallTimeout = timeout }()
+
+	md := buildTorrent(t, maxBlockSize, make([]byte, 3*maxBlockSize))
+	peers := peer.AddrSet{hangUp(t, md.InfoHash): {}, hangUp(t, md.InfoHash): {}}
+	tr, err := newTorrent(md, [20]byte{}, 0, peers, t.TempDir(), storage.NewMemory(), nil)
+	if err != nil {
+		t.Fatalf("newTorrent() error = %v", err)
+	}
+	defer tr.Close()
+
+	done := make(chan error, 1)
+	go func() { done <- tr.Download(nil) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("Download() succeeded without peers")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Download() still running with every peer gone")
+	}
+	if got := tr.activeConns(); got != 0 {
+		t.Errorf("activeConns() = %d with every peer gone", got)
+	}
+}
+
+// fastPeer connects tr to a peer speaking the fast extension, which has
+// every piece and chokes us, and starts downloading from it
+func fastPeer(t *testing.T, tr *Torrent) (*peerconn.PeerConn, net.Conn) {
+	local, remote := net.Pipe()
+	hs := handshake.NewHandshake([20]byte{1}, tr.InfoHash)
+	hs.SetFlag(handshake.FastExtension)
+	go hs.Deserialize(remote)
+	pc, err := peerconn.Accept(local, hs, tr.extensions, tr.haveBitfield())
+	if err != nil {
+		t.Fatalf("Accept() error = %v", err)
+	}
+	t.Cleanup(func() {
+		pc.Close()
+		remote.Close()
+	})
+	if m, err := message.Read(remote, 1<<10); err != nil || m.Id != message.HaveNoneMsg {
+		t.Fatalf("Read() = %v, %v, want have none", m, err)
+	}
+	if _, err := remote.Write(message.NewHaveAll().Serialize()); err != nil {
+		t.Fatal(err)
+	}
+	up := tr.newUploader(pc)
+	t.Cleanup(up.close)
+	go tr.downloadFrom(pc, up)
+	return pc, remote
+}
+
+// readRequests returns the next n requests the peer receives
+func readRequests(t *testing.T, remote net.Conn, n int) []blockRequest {
+	var requests []blockRequest
+	for len(requests) < n {
+		m, err := message.Read(remote, 1<<10)
+		if err != nil {
+			t.Fatalf("Read() error = %v", err)
+		}
+		if m == nil || m.Id != message.RequestMsg {
+			continue
+		}
+		index, begin, length, err := m.ProcessRequestMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		requests = append(requests, blockRequest{index, begin, length})
+	}
+	return requests
+}
+
+func TestAllowedFastWhileChoked(t *testing.T) {
+	md := buildTorrent(t, 2*maxBlockSize, make([]byte, 8*maxBlockSize))
+	tr, err := newTorrent(md, [20]byte{}, 0, nil, t.TempDir(), storage.NewMemory(), nil)
+	if err != nil {
+		t.Fatalf("newTorrent() error = %v", err)
+	}
+	defer tr.Close()
+	_, remote := fastPeer(t, tr)
+
+	if _, err := remote.Write(message.NewAllowedFast(2).Serialize()); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range readRequests(t, remote, 2) {
+		if r.index != 2 {
+			t.Errorf("requested piece %d while choked, only 2 is allowed", r.index)
+		}
+	}
+}
+
+func TestRejectReleasesBlock(t *testing.T) {
+	md := buildTorrent(t, 2*maxBlockSize, make([]byte, 8*maxBlockSize))
+	tr, err := newTorrent(md, [20]byte{}, 0, nil, t.TempDir(), storage.NewMemory(), nil)
+	if err != nil {
+		t.Fatalf("newTorrent() error = %v", err)
+	}
+	defer tr.Close()
+	pc, remote := fastPeer(t, tr)
+
+	if _, err := remote.Write(message.NewAllowedFast(2).Serialize()); err != nil {
+		t.Fatal(err)
+	}
+	rejected := readRequests(t, remote, 2)[0]
+	if _, err := remote.Write(message.NewReject(rejected.index, rejected.begin, rejected.length).Serialize()); err != nil {
+		t.Fatal(err)
+	}
+	waitPending := time.Now().Add(5 * time.Second)
+	for tr.scheduler.pending(pc) != 1 {
+		if time.Now().After(waitPending) {
+			t.Fatalf("pending() = %d after a reject, want 1", tr.scheduler.pending(pc))
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// the block goes to the next peer asking
+	other := &peerconn.PeerConn{}
+	if r, ok := tr.scheduler.next(other, allPieces(len(tr.PieceHashes))); !ok || r != rejected {
+		t.Errorf("next() = %+v, %v, want the rejected block %+v", r, ok, rejected)
+	}
+}
+
+func TestMagnetTiers(t *testing.T) {
+	tests := []struct {
+		name     string
+		trackers []string
+		want     string // the announce-list written, empty when absent
+	}{
+		{
+			name: "No tracker",
+		},
+		{
+			name:     "Trackers",
+			trackers: []string{"http://a", "udp://b"},
+			want:     "ll8:http://a7:udp://bee",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			md := buildTorrent(t, maxBlockSize, make([]byte, 10))
+			md.AnnounceList = magnetTiers(tt.trackers)
+			var buf bytes.Buffer
+			if err := md.Write(&buf); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+			var dict map[string]bencode.RawMessage
+			if err := bencode.NewDecoder(&buf).Decode(&dict); err != nil {
+				t.Fatal(err)
+			}
+			if got := string(dict["announce-list"]); got != tt.want {
+				t.Errorf("announce-list = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
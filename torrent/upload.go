@@ -0,0 +1,333 @@
+package torrent
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"swiftpeer/client/bitfield"
+	"swiftpeer/client/handshake"
+	"swiftpeer/client/message"
+	"swiftpeer/client/peerconn"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// maxUploadBlock is the largest block we serve, peers asking for more
+	// than 128KiB are broken
+	maxUploadBlock = 1 << 17
+	// maxQueuedRequests bounds the requests of one peer waiting to be served
+	maxQueuedRequests = 250
+	// maxSuggested bounds the suggestions remembered for a peer
+	maxSuggested = 16
+)
+
+type blockRequest struct {
+	index, begin, length int
+}
+
+// uploader serves the block requests of one peer in order, a request
+// cancelled before its turn is dropped. A peer speaking the fast extension
+// may request its allowed fast pieces while choked, and is told about the
+// requests we don't serve.
+type uploader struct {
+	t           *Torrent
+	pc          *peerconn.PeerConn
+	allowedFast []int
+	mu          sync.Mutex
+	queue       []blockRequest
+	wake        chan struct{}
+	done        chan struct{}
+}
+
+func (t *Torrent) newUploader(pc *peerconn.PeerConn) *uploader {
+	up := &uploader{
+		t:    t,
+		pc:   pc,
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	if pc.SupportsFast {
+		host, _, _ := net.SplitHostPort(pc.Addr)
+		up.allowedFast = peerconn.AllowedFastSet(net.ParseIP(host), t.InfoHash, len(t.PieceHashes), peerconn.AllowedFastCount)
+		for _, index := range up.allowedFast {
+			pc.SendAllowedFast(index)
+		}
+	}
+	go up.run()
+	return up
+}
+
+func (up *uploader) allowed(index int) bool {
+	for _, i := range up.allowedFast {
+		if i == index {
+			return true
+		}
+	}
+	return false
+}
+
+func (up *uploader) close() {
+	close(up.done)
+}
+
+func (up *uploader) push(r blockRequest) error {
+	if r.length <= 0 || r.length > maxUploadBlock || r.begin < 0 || r.index < 0 || r.index >= len(up.t.PieceHashes) ||
+		r.begin+r.length > up.t.computeSize(r.index) {
+		return fmt.Errorf("invalid request for piece %d at %d, length %d", r.index, r.begin, r.length)
+	}
+	if !up.t.hasPiece(r.index) || up.pc.AmChoking() && !up.allowed(r.index) {
+		// we never announced it or the peer didn't see our choke yet, the
+		// peer is mistaken rather than hostile
+		return up.pc.SendReject(r.index, r.begin, r.length)
+	}
+
+	up.mu.Lock()
+	full := len(up.queue) >= maxQueuedRequests
+	if !full {
+		up.queue = append(up.queue, r)
+	}
+	up.mu.Unlock()
+	if full {
+		return up.pc.SendReject(r.index, r.begin, r.length)
+	}
+
+	select {
+	case up.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (up *uploader) cancel(r blockRequest) {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	for i, queued := range up.queue {
+		if queued == r {
+			up.queue = append(up.queue[:i], up.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+func (up *uploader) run() {
+	for {
+		up.mu.Lock()
+		var rejected []blockRequest
+		if up.pc.AmChoking() {
+			// choking a peer discards its pending requests but the allowed
+			// fast ones
+			kept := up.queue[:0]
+			for _, r := range up.queue {
+				if up.allowed(r.index) {
+					kept = append(kept, r)
+				} else {
+					rejected = append(rejected, r)
+				}
+			}
+			up.queue = kept
+		}
+		if len(up.queue) == 0 {
+			up.mu.Unlock()
+			if up.reject(rejected) != nil {
+				return
+			}
+			select {
+			case <-up.wake:
+				continue
+			case <-up.done:
+				return
+			}
+		}
+		r := up.queue[0]
+		up.queue = up.queue[1:]
+		up.mu.Unlock()
+		if up.reject(rejected) != nil {
+			return
+		}
+
+		block, err := up.t.readBlock(r.index, r.begin, r.length)
+		if err != nil {
+			fmt.Printf("[INFO] failed to read block of piece %d for %v: %v\n", r.index, up.pc.Addr, err)
+			continue
+		}
+		if err := up.pc.SendPiece(r.index, r.begin, block); err != nil {
+			return
+		}
+		atomic.AddInt64(&up.t.uploaded, int64(len(block)))
+	}
+}
+
+func (up *uploader) reject(requests []blockRequest) error {
+	for _, r := range requests {
+		if err := up.pc.SendReject(r.index, r.begin, r.length); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handlePeerMessage handles the messages that don't depend on what we are
+// downloading from the peer
+func (t *Torrent) handlePeerMessage(pc *peerconn.PeerConn, up *uploader, m *message.Message) error {
+	switch m.Id {
+	case message.SuggestPieceMsg, message.HaveAllMsg, message.HaveNoneMsg, message.RejectRequestMsg, message.AllowedFastMsg:
+		if !pc.SupportsFast {
+			return fmt.Errorf("%v without the fast extension", m.Name())
+		}
+	}
+
+	switch m.Id {
+	case message.HaveMsg:
+		index, err := m.ProcessHaveMsg()
+		if err != nil {
+			return err
+		}
+		added, err := pc.SetHave(index)
+		if err != nil {
+			return err
+		}
+		if added {
+			t.picker.PeerHave(index)
+		}
+	case message.BitfieldMsg:
+		t.picker.RemovePeer(pc.Pieces)
+		err := pc.SetBitfield(m.Payload)
+		t.picker.AddPeer(pc.Pieces)
+		if err != nil {
+			return err
+		}
+	case message.HaveAllMsg:
+		t.picker.RemovePeer(pc.Pieces)
+		pc.SetHaveAll()
+		t.picker.AddPeer(pc.Pieces)
+	case message.HaveNoneMsg:
+		t.picker.RemovePeer(pc.Pieces)
+		pc.SetHaveNone()
+	case message.SuggestPieceMsg:
+		index, err := m.ProcessIndexMsg()
+		if err != nil {
+			return err
+		}
+		if len(pc.Suggested) == maxSuggested {
+			pc.Suggested = pc.Suggested[1:]
+		}
+		pc.Suggested = append(pc.Suggested, index)
+	case message.AllowedFastMsg:
+		index, err := m.ProcessIndexMsg()
+		if err != nil {
+			return err
+		}
+		if pc.AllowedFast == nil {
+			pc.AllowedFast = bitfield.New(len(t.PieceHashes))
+		}
+		pc.AllowedFast.SetPiece(index)
+	case message.InterestedMsg:
+		pc.SetPeerInterested(true)
+		return t.choker.Admit(pc)
+	case message.NotInterestedMsg:
+		pc.SetPeerInterested(false)
+	case message.RequestMsg, message.CancelMsg:
+		index, begin, length, err := m.ProcessRequestMsg()
+		if err != nil {
+			return err
+		}
+		r := blockRequest{index, begin, length}
+		if m.Id == message.CancelMsg {
+			up.cancel(r)
+			return nil
+		}
+		return up.push(r)
+	case message.ExtendedMsg:
+		return pc.HandleExtended(m)
+	case message.PortMsg:
+		port, err := m.ProcessPortMsg()
+		if err != nil {
+			return err
+		}
+		if t.dht != nil {
+			host, _, _ := net.SplitHostPort(pc.Addr)
+			go t.dht.Ping(net.JoinHostPort(host, strconv.Itoa(port)))
+		}
+	}
+	return nil
+}
+
+// HandleConn serves a peer that connected to us, implementing listener.Handler.
+// While the download runs we download from it too.
+func (t *Torrent) HandleConn(conn net.Conn, hs *handshake.Handshake) {
+	defer conn.Close()
+	if t.activeConns() >= maxActiveConns {
+		return
+	}
+
+	pc, err := peerconn.Accept(conn, hs, t.extensions, t.haveBitfield())
+	if err != nil {
+		fmt.Printf("[INFO] failed to complete the handshake with %v: %v\n", conn.RemoteAddr(), err)
+		return
+	}
+	fmt.Printf("[INFO] Accepted connection from %v.\n", pc.Addr)
+
+	t.addConn(pc)
+	defer t.removeConn(pc)
+
+	up := t.newUploader(pc)
+	defer up.close()
+	defer func() { t.picker.RemovePeer(pc.Pieces) }()
+
+	defer pc.Close()
+
+	if !t.picker.Complete() {
+		if err := pc.SendInterested(); err != nil {
+			fmt.Printf("[INFO] failed to send interested to %v: %v\n", pc.Addr, err)
+		}
+		if err := t.downloadFrom(pc, up); err != nil {
+			fmt.Printf("[INFO] closing connection from %v: %v\n", pc.Addr, err)
+			return
+		}
+	}
+	for m := range pc.Events() {
+		if err := t.handlePeerMessage(pc, up, m); err != nil {
+			fmt.Printf("[INFO] closing connection from %v: %v\n", pc.Addr, err)
+			return
+		}
+	}
+}
+
+func (t *Torrent) hasPiece(index int) bool {
+	t.haveMu.Lock()
+	defer t.haveMu.Unlock()
+	return t.have.HasPiece(index)
+}
+
+func (t *Torrent) haveBitfield() bitfield.Bitfield {
+	t.haveMu.Lock()
+	defer t.haveMu.Unlock()
+	return append(bitfield.Bitfield(nil), t.have...)
+}
+
+// markHave records a verified piece and announces it to every connected peer
+func (t *Torrent) markHave(index int) {
+	t.haveMu.Lock()
+	t.have.SetPiece(index)
+	t.haveCond.Broadcast()
+	t.haveMu.Unlock()
+
+	for _, pc := range t.connections() {
+		pc.SendHave(index)
+	}
+}
+
+// readBlock reads a block of a piece from the storage
+func (t *Torrent) readBlock(index, begin, length int) ([]byte, error) {
+	block := make([]byte, length)
+	if err := t.storage.ReadAt(index, begin, block); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// Close releases the storage of the torrent
+func (t *Torrent) Close() error {
+	return t.storage.Close()
+}
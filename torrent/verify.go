@@ -0,0 +1,136 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"github.com/schollz/progressbar/v3"
+	"os"
+	"path/filepath"
+	"runtime"
+	"swiftpeer/client/bitfield"
+	"swiftpeer/client/storage"
+	"swiftpeer/client/torrent/metadata"
+	"sync"
+)
+
+// FileStatus is the completion of a file of the torrent on disk
+type FileStatus struct {
+	Path     string
+	Length   int64
+	Verified int64 // bytes of the file in pieces matching their hash
+}
+
+// VerifyFiles checks the files of a torrent in outDir against the piece
+// hashes, without contacting any peer
+func VerifyFiles(pathToTorrentFile, outDir string, progress func(checked, total int)) ([]FileStatus, error) {
+	md, err := metadata.NewMetadataFromFile(pathToTorrentFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load metadata: %v", err)
+	}
+	t, err := newTorrent(md, [20]byte{}, 0, nil, outDir, storage.NewFile(outDir), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer t.Close()
+
+	have := t.Verify(progress)
+	status := make([]FileStatus, 0, len(t.Files))
+	for _, file := range t.Files {
+		status = append(status, FileStatus{
+			Path:     file.Path,
+			Length:   file.Length,
+			Verified: t.verifiedBytes(have, file.Start, file.Start+file.Length),
+		})
+	}
+	return status, nil
+}
+
+// Verify hashes every piece read from the storage and
+// returns the bitfield of those matching. progress, when not nil, is called
+// after each piece.
+func (t *Torrent) Verify(progress func(checked, total int)) bitfield.Bitfield {
+	indices := make([]int, len(t.PieceHashes))
+	for i := range indices {
+		indices[i] = i
+	}
+	return t.verifyPieces(indices, progress)
+}
+
+// verifyPieces hashes the given pieces with a worker per CPU
+func (t *Torrent) verifyPieces(pieces []int, progress func(checked, total int)) bitfield.Bitfield {
+	have := bitfield.New(len(t.PieceHashes))
+	indices := make(chan int)
+	var mu sync.Mutex
+	checked := 0
+
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indices {
+				// a missing or short file only fails its pieces
+				data, err := t.readBlock(index, 0, t.computeSize(index))
+				ok := err == nil && sha1.Sum(data) == t.PieceHashes[index]
+
+				mu.Lock()
+				if ok {
+					have.SetPiece(index)
+				}
+				checked++
+				if progress != nil {
+					progress(checked, len(pieces))
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, index := range pieces {
+		indices <- index
+	}
+	close(indices)
+	wg.Wait()
+	return have
+}
+
+// recheck rebuilds the verified pieces from the files on disk
+func (t *Torrent) recheck() {
+	bar := progressbar.Default(int64(len(t.PieceHashes)), "Checking")
+	have := t.Verify(func(checked, total int) { bar.Set(checked) })
+
+	count := 0
+	for index := range t.PieceHashes {
+		if have.HasPiece(index) {
+			t.have.SetPiece(index)
+			t.picker.Done(index)
+			t.storage.MarkComplete(index)
+			count++
+		}
+	}
+	fmt.Printf("[INFO] %d of %d pieces found on disk\n", count, len(t.PieceHashes))
+}
+
+// restore rebuilds the progress of a previous run from the resume data, or
+// from the files when it is missing or unusable
+func (t *Torrent) restore() {
+	err := t.loadResume(t.basePath)
+	if err == nil {
+		return
+	}
+	if !os.IsNotExist(err) {
+		fmt.Printf("[INFO] ignoring resume data: %v\n", err)
+	} else if !t.filesExist() {
+		return
+	}
+	t.recheck()
+}
+
+// filesExist reports whether any file of the torrent is in the output directory
+func (t *Torrent) filesExist() bool {
+	for _, file := range t.Files {
+		if fi, err := os.Stat(filepath.Join(t.basePath, file.Path)); err == nil && fi.Size() > 0 {
+			return true
+		}
+	}
+	return false
+}
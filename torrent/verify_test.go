@@ -0,0 +1,85 @@
+package torrent
+
+import (
+	"os"
+	"path/filepath"
+	"swiftpeer/client/storage"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	// pieces of 2 blocks over files of 3 blocks and 100 bytes, and 4 blocks:
+	// piece 1 spans both files and piece 3 is short
+	a, b := randomBytes(3*maxBlockSize+100), randomBytes(4*maxBlockSize)
+	md := buildTorrent(t, 2*maxBlockSize, a, b)
+
+	tests := []struct {
+		name    string
+		file    string
+		offset  int64
+		corrupt int // the piece holding offset
+	}{
+		{
+			name:    "First piece",
+			file:    "a.bin",
+			offset:  10,
+			corrupt: 0,
+		},
+		{
+			name:    "Piece spanning two files, first part",
+			file:    "a.bin",
+			offset:  3*maxBlockSize + 10,
+			corrupt: 1,
+		},
+		{
+			name:    "Piece spanning two files, second part",
+			file:    "b.bin",
+			offset:  10,
+			corrupt: 1,
+		},
+		{
+			name:    "Short last piece",
+			file:    "b.bin",
+			offset:  4*maxBlockSize - 10,
+			corrupt: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.Mkdir(filepath.Join(dir, "data"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			for name, data := range map[string][]byte{"a.bin": a, "b.bin": b} {
+				if err := os.WriteFile(filepath.Join(dir, "data", name), data, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			corrupt(t, filepath.Join(dir, "data", tt.file), tt.offset)
+
+			tr, err := newTorrent(md, [20]byte{}, 0, nil, dir, storage.NewFile(dir), nil)
+			if err != nil {
+				t.Fatalf("newTorrent() error = %v", err)
+			}
+			defer tr.Close()
+
+			calls, last := 0, 0
+			have := tr.Verify(func(checked, total int) {
+				calls++
+				if total != len(tr.PieceHashes) {
+					t.Errorf("progress total = %d, want %d", total, len(tr.PieceHashes))
+				}
+				last = checked
+			})
+			if calls != len(tr.PieceHashes) || last != len(tr.PieceHashes) {
+				t.Errorf("progress called %d times up to %d, want %d", calls, last, len(tr.PieceHashes))
+			}
+			for index := range tr.PieceHashes {
+				if want := index != tt.corrupt; have.HasPiece(index) != want {
+					t.Errorf("piece %d verified = %v, want %v", index, have.HasPiece(index), want)
+				}
+			}
+		})
+	}
+}
@@ -1,12 +1,9 @@
 package tracker
 
 import (
-	"bufio"
 	"bytes"
-	"encoding/binary"
 	"fmt"
 	"io"
-	"net"
 	"net/http"
 	"net/url"
 	"swiftpeer/client/bencode"
@@ -15,6 +12,17 @@ import (
 	"time"
 )
 
+// maxResponseSize bounds what we read from a tracker, even a few thousand
+// compact peers fit easily
+const maxResponseSize = 1 << 20
+
+// responseLimits guards the decoder against hostile tracker responses
+var responseLimits = bencode.Options{
+	MaxStringLen: maxResponseSize,
+	MaxDepth:     8,
+	MaxBytes:     maxResponseSize,
+}
+
 type HTTPTracker struct {
 	baseUrl string
 }
@@ -79,7 +87,7 @@ func (t *HTTPTracker) sendAnnounceRequest(announceURL string) ([]byte, error) {
 		return nil, fmt.Errorf("unexpected HTTP status: %s", resp.Status)
 	}
 
-	body, err := io.ReadAll(resp.Body)
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
 	if err != nil {
 		return nil, fmt.Errorf("failed to read response body: %w", err)
 	}
@@ -87,50 +95,13 @@ func (t *HTTPTracker) sendAnnounceRequest(announceURL string) ([]byte, error) {
 	return body, nil
 }
 
-func (t *HTTPTracker) handleOriginalFormat(decoder *bencode.Decoder) ([]peer.Peer, error) {
-	var originalResp OriginalResponse
-	if err := decoder.Decode(&originalResp); err != nil {
-		return nil, fmt.Errorf("failed to decode original response: %w", err)
-	}
-
-	return t.unmarshalPeersFromBytes(originalResp.Peers)
-
-}
-
-func (t *HTTPTracker) isCompactResponse(response []byte) bool {
-	return bytes.Contains(response[:50], []byte(`5:peers`))
-}
-
 func (t *HTTPTracker) extractPeersFromResponse(response []byte) ([]peer.Peer, error) {
-	decoder := bencode.NewDecoder(bufio.NewReader(bytes.NewReader(response)))
-
-	if t.isCompactResponse(response) {
-		return t.handleCompactFormat(decoder)
+	var resp HTTPResponse
+	if err := bencode.NewDecoderWithOptions(bytes.NewReader(response), responseLimits).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("failed to decode tracker response: %w", err)
 	}
-	return t.handleOriginalFormat(decoder)
-}
-
-func (t *HTTPTracker) handleCompactFormat(decoder *bencode.Decoder) ([]peer.Peer, error) {
-	var compactResponse CompactResponse
-	if err := decoder.Decode(&compactResponse); err != nil {
-		return nil, fmt.Errorf("failed to decode compact response: %w", err)
-	}
-	return t.unmarshalPeersFromBytes(compactResponse.Peers)
-}
-
-func (t *HTTPTracker) unmarshalPeersFromBytes(data []byte) ([]peer.Peer, error) {
-	var peers []peer.Peer
-	const peerSize = 6 // 4 bytes for IP, 2 for Port
-	if len(data)%peerSize != 0 {
-		return nil, fmt.Errorf("malformed http tracker response, len(compactResponse) does not divide to 6 = 0")
+	if resp.FailureReason != "" {
+		return nil, fmt.Errorf("tracker failure: %s", resp.FailureReason)
 	}
-
-	for i := 0; i < len(data); i += peerSize {
-		addr := net.TCPAddr{IP: data[i : i+4], Port: int(binary.BigEndian.Uint16(data[i+4 : i+6]))}
-
-		peers = append(peers, peer.Peer{IP: addr.IP.String(), Port: addr.Port})
-	}
-
-	return peers, nil
-
+	return resp.Peers, nil
 }
@@ -11,21 +11,17 @@ type Tracker interface {
 	Announce(infoHash [20]byte, peerId [20]byte, port int) ([]peer.Peer, error)
 }
 
-type OriginalResponse struct {
-	FailureReason  string
-	WarningMessage string
-	Interval       int
-	MinInterval    int
-	TrackerID      string
-	Complete       int
-	Incomplete     int
-	Event          string
-	Peers          []byte
-}
-
-type CompactResponse struct {
-	Interval int
-	Peers    []byte
+// HTTPResponse is the bencoded announce response of an http tracker,
+// Peers accepts both the compact and the original format
+type HTTPResponse struct {
+	FailureReason  string    `bencode:"failure reason"`
+	WarningMessage string    `bencode:"warning message"`
+	Interval       int       `bencode:"interval"`
+	MinInterval    int       `bencode:"min interval"`
+	TrackerID      string    `bencode:"tracker id"`
+	Complete       int       `bencode:"complete"`
+	Incomplete     int       `bencode:"incomplete"`
+	Peers          peer.List `bencode:"peers"`
 }
 
 type UdpResponse struct {
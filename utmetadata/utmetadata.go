@@ -0,0 +1,201 @@
+package utmetadata
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"swiftpeer/client/bencode"
+	"swiftpeer/client/message"
+	"swiftpeer/client/peer"
+	"swiftpeer/client/peerconn"
+	"time"
+)
+
+// ut_metadata message types (BEP 9)
+const (
+	requestMsg = iota
+	dataMsg
+	rejectMsg
+)
+
+const (
+	// Name is the name of the extension in the extended handshake
+	Name      = "ut_metadata"
+	pieceSize = 1 << 14
+	// maxMetadataSize is the largest info dictionary we accept, it bounds
+	// what a peer can make us allocate
+	maxMetadataSize = 16 << 20
+	fetchTimeout    = 30 * time.Second
+	maxParallel     = 10
+)
+
+// messageLimits guards the decoder against hostile extension messages
+var messageLimits = bencode.Options{MaxDepth: 4, MaxStringLen: 1 << 12, MaxBytes: 1 << 16}
+
+type metadataMsg struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+// FetchFromPeers asks the peers for the info dictionary of infoHash, a few at
+// a time, and returns the first one matching the hash
+func FetchFromPeers(peers peer.AddrSet, infoHash [20]byte) ([]byte, error) {
+	results := make(chan []byte)
+	sem := make(chan struct{}, maxParallel)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for addr := range peers {
+			select {
+			case sem <- struct{}{}:
+			case <-done:
+				return
+			}
+			go func(addr string) {
+				defer func() { <-sem }()
+				info, err := Fetch(addr, infoHash)
+				if err != nil {
+					fmt.Printf("[INFO] failed to fetch metadata from %v: %v\n", addr, err)
+					info = nil
+				}
+				select {
+				case results <- info:
+				case <-done:
+				}
+			}(addr)
+		}
+	}()
+
+	for range peers {
+		if info := <-results; info != nil {
+			return info, nil
+		}
+	}
+	return nil, fmt.Errorf("unable to fetch metadata from any of %d peers", len(peers))
+}
+
+// Fetch downloads the info dictionary of infoHash from a single peer
+func Fetch(addr string, infoHash [20]byte) ([]byte, error) {
+	f := &fetcher{}
+	ext := peerconn.NewExtensions()
+	ext.Register(Name, f)
+
+	pc, err := peerconn.NewPeerConn(addr, infoHash, ext, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer pc.Close()
+
+	if !pc.SupportsExtensions {
+		return nil, fmt.Errorf("peer does not support the extension protocol")
+	}
+
+	timeout := time.After(fetchTimeout)
+	for !f.done() {
+		var msg *message.Message
+		select {
+		case m, ok := <-pc.Events():
+			if !ok {
+				return nil, pc.Err()
+			}
+			msg = m
+		case <-timeout:
+			return nil, fmt.Errorf("timed out fetching metadata from %v", addr)
+		}
+		if msg.Id != message.ExtendedMsg {
+			continue
+		}
+		if err := pc.HandleExtended(msg); err != nil {
+			return nil, err
+		}
+	}
+
+	if sha1.Sum(f.info) != infoHash {
+		return nil, fmt.Errorf("metadata does not match the info hash")
+	}
+	return f.info, nil
+}
+
+// fetcher is the ut_metadata handler requesting every piece of the info
+// dictionary once the peer announced its size
+type fetcher struct {
+	info     []byte
+	received []bool
+	left     int
+}
+
+func (f *fetcher) done() bool {
+	return f.info != nil && f.left == 0
+}
+
+func (f *fetcher) OnHandshake(pc *peerconn.PeerConn, hs *peerconn.ExtendedHandshake) error {
+	if f.info != nil {
+		return nil
+	}
+	if !pc.SupportsExtension(Name) {
+		return fmt.Errorf("peer does not support %s", Name)
+	}
+	if hs.MetadataSize <= 0 || hs.MetadataSize > maxMetadataSize {
+		return fmt.Errorf("invalid metadata size %d", hs.MetadataSize)
+	}
+
+	pieces := (hs.MetadataSize + pieceSize - 1) / pieceSize
+	f.info = make([]byte, hs.MetadataSize)
+	f.received = make([]bool, pieces)
+	f.left = pieces
+
+	for i := 0; i < pieces; i++ {
+		payload, err := encode(metadataMsg{MsgType: requestMsg, Piece: i})
+		if err != nil {
+			return err
+		}
+		if err := pc.SendExtended(Name, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fetcher) HandleExtended(pc *peerconn.PeerConn, payload []byte) error {
+	if f.info == nil {
+		return fmt.Errorf("unexpected %s message before the handshake", Name)
+	}
+
+	// the data of a piece follows the bencoded dictionary
+	var msg metadataMsg
+	decoder := bencode.NewDecoderWithOptions(bytes.NewReader(payload), messageLimits)
+	if err := decoder.Decode(&msg); err != nil {
+		return fmt.Errorf("malformed %s message: %w", Name, err)
+	}
+	data := payload[decoder.InputOffset():]
+
+	switch msg.MsgType {
+	case rejectMsg:
+		return fmt.Errorf("peer rejected metadata piece %d", msg.Piece)
+	case dataMsg:
+		if msg.Piece < 0 || msg.Piece >= len(f.received) || f.received[msg.Piece] {
+			return fmt.Errorf("unexpected metadata piece %d", msg.Piece)
+		}
+		expected := pieceSize
+		if msg.Piece == len(f.received)-1 {
+			expected = len(f.info) - msg.Piece*pieceSize
+		}
+		if len(data) != expected {
+			return fmt.Errorf("metadata piece %d has %d bytes, expected %d", msg.Piece, len(data), expected)
+		}
+		copy(f.info[msg.Piece*pieceSize:], data)
+		f.received[msg.Piece] = true
+		f.left--
+	}
+	return nil
+}
+
+func encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := bencode.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,227 @@
+package utmetadata
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"net"
+	"strings"
+	"swiftpeer/client/bencode"
+	"swiftpeer/client/handshake"
+	"swiftpeer/client/message"
+	"swiftpeer/client/peer"
+	"swiftpeer/client/peerconn"
+	"testing"
+)
+
+// remoteId is the id the peer assigns to ut_metadata
+const remoteId = 3
+
+func randomInfo(t *testing.T, n int) []byte {
+	info := make([]byte, n)
+	if _, err := rand.Read(info); err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+// piece returns the data message for piece index of info
+func piece(t *testing.T, info []byte, index int) []byte {
+	end := min((index+1)*pieceSize, len(info))
+	payload, err := encode(metadataMsg{MsgType: dataMsg, Piece: index, TotalSize: len(info)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(payload, info[index*pieceSize:end]...)
+}
+
+// servePeer accepts connections announcing a metadata of size bytes and
+// answers each request with the messages reply returns
+func servePeer(t *testing.T, infoHash [20]byte, size int, reply func(req metadataMsg) [][]byte) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go servePeerConn(conn, infoHash, size, reply)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func servePeerConn(conn net.Conn, infoHash [20]byte, size int, reply func(req metadataMsg) [][]byte) {
+	defer conn.Close()
+	hs := handshake.NewHandshake([20]byte{1}, infoHash)
+	hs.SetFlag(handshake.ExtensionProtocol)
+	if _, err := hs.Deserialize(conn); err != nil {
+		return
+	}
+	if _, err := conn.Write(hs.Serialize()); err != nil {
+		return
+	}
+
+	var localId byte
+	for {
+		m, err := message.Read(conn, 1<<16)
+		if err != nil {
+			return
+		}
+		if m == nil || m.Id != message.ExtendedMsg || len(m.Payload) == 0 {
+			continue
+		}
+		switch m.Payload[0] {
+		case 0:
+			var theirs peerconn.ExtendedHandshake
+			if err := bencode.NewDecoder(bytes.NewReader(m.Payload[1:])).Decode(&theirs); err != nil {
+				return
+			}
+			localId = byte(theirs.M[Name])
+			payload, err := encode(peerconn.ExtendedHandshake{M: map[string]int{Name: remoteId}, MetadataSize: size})
+			if err != nil {
+				return
+			}
+			if _, err := conn.Write(message.NewExtended(0, payload).Serialize()); err != nil {
+				return
+			}
+		case remoteId:
+			var req metadataMsg
+			if err := bencode.NewDecoder(bytes.NewReader(m.Payload[1:])).Decode(&req); err != nil || req.MsgType != requestMsg {
+				return
+			}
+			for _, payload := range reply(req) {
+				if _, err := conn.Write(message.NewExtended(localId, payload).Serialize()); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+func TestFetch(t *testing.T) {
+	info := randomInfo(t, 2*pieceSize+100)
+	infoHash := sha1.Sum(info)
+	reject, err := encode(metadataMsg{MsgType: rejectMsg, Piece: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		size    int
+		reply   func(req metadataMsg) [][]byte
+		wantErr string
+	}{
+		{
+			name:  "Every piece",
+			size:  len(info),
+			reply: func(req metadataMsg) [][]byte { return [][]byte{piece(t, info, req.Piece)} },
+		},
+		{
+			name: "Pieces out of order",
+			size: len(info),
+			reply: func(req metadataMsg) [][]byte {
+				// the first request is answered last
+				switch req.Piece {
+				case 0:
+					return nil
+				case 2:
+					return [][]byte{piece(t, info, 2), piece(t, info, 0)}
+				}
+				return [][]byte{piece(t, info, req.Piece)}
+			},
+		},
+		{
+			name: "Rejected piece",
+			size: len(info),
+			reply: func(req metadataMsg) [][]byte {
+				if req.Piece == 1 {
+					return [][]byte{reject}
+				}
+				return [][]byte{piece(t, info, req.Piece)}
+			},
+			wantErr: "rejected",
+		},
+		{
+			name: "Short piece",
+			size: len(info),
+			reply: func(req metadataMsg) [][]byte {
+				return [][]byte{piece(t, info, req.Piece)[:100]}
+			},
+			wantErr: "bytes",
+		},
+		{
+			name: "Piece sent twice",
+			size: len(info),
+			reply: func(req metadataMsg) [][]byte {
+				return [][]byte{piece(t, info, req.Piece), piece(t, info, req.Piece)}
+			},
+			wantErr: "unexpected",
+		},
+		{
+			name: "Wrong metadata",
+			size: len(info),
+			reply: func(req metadataMsg) [][]byte {
+				data := piece(t, info, req.Piece)
+				data[len(data)-1] ^= 0xff
+				return [][]byte{data}
+			},
+			wantErr: "info hash",
+		},
+		{
+			name:    "Too large",
+			size:    maxMetadataSize + 1,
+			reply:   func(req metadataMsg) [][]byte { return nil },
+			wantErr: "size",
+		},
+		{
+			name:    "No size",
+			size:    0,
+			reply:   func(req metadataMsg) [][]byte { return nil },
+			wantErr: "size",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := servePeer(t, infoHash, tt.size, tt.reply)
+			got, err := Fetch(addr, infoHash)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Fetch() error = %v, want one about %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Fetch() error = %v", err)
+			}
+			if !bytes.Equal(got, info) {
+				t.Errorf("Fetch() returned metadata differing from the info dictionary")
+			}
+		})
+	}
+}
+
+func TestFetchFromPeers(t *testing.T) {
+	info := randomInfo(t, pieceSize/2)
+	infoHash := sha1.Sum(info)
+	bad := servePeer(t, infoHash, len(info), func(req metadataMsg) [][]byte { return [][]byte{piece(t, randomInfo(t, len(info)), 0)} })
+	good := servePeer(t, infoHash, len(info), func(req metadataMsg) [][]byte { return [][]byte{piece(t, info, req.Piece)} })
+
+	got, err := FetchFromPeers(peer.AddrSet{bad: {}, good: {}}, infoHash)
+	if err != nil {
+		t.Fatalf("FetchFromPeers() error = %v", err)
+	}
+	if !bytes.Equal(got, info) {
+		t.Errorf("FetchFromPeers() returned metadata differing from the info dictionary")
+	}
+
+	if _, err := FetchFromPeers(peer.AddrSet{bad: {}}, infoHash); err == nil {
+		t.Errorf("FetchFromPeers() succeeded with a peer sending the wrong metadata")
+	}
+}
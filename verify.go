@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/schollz/progressbar/v3"
+	"swiftpeer/client/torrent"
+)
+
+func runVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	torrentFilePath := fs.String("t", "", "Path to the torrent file")
+	outDir := fs.String("o", "", "Directory the torrent was downloaded to")
+	fs.Parse(args)
+
+	if *torrentFilePath == "" || *outDir == "" {
+		return fmt.Errorf("usage: program verify -t <torrent-file-path> -o <output-directory>")
+	}
+
+	var bar *progressbar.ProgressBar
+	status, err := torrent.VerifyFiles(*torrentFilePath, *outDir, func(checked, total int) {
+		if bar == nil {
+			bar = progressbar.Default(int64(total), "Verifying")
+		}
+		bar.Set(checked)
+	})
+	if err != nil {
+		return err
+	}
+
+	incomplete := 0
+	for _, file := range status {
+		percent := 100.0
+		if file.Length > 0 {
+			percent = float64(file.Verified) / float64(file.Length) * 100
+		}
+		if file.Verified < file.Length {
+			incomplete++
+		}
+		fmt.Printf("%6.1f%%  %d/%d  %s\n", percent, file.Verified, file.Length, file.Path)
+	}
+	if incomplete > 0 {
+		return fmt.Errorf("%d of %d files incomplete", incomplete, len(status))
+	}
+	fmt.Printf("All %d files complete\n", len(status))
+	return nil
+}